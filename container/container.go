@@ -2,16 +2,21 @@ package container
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/rpc"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	. "github.com/JasonYangShadow/lpmx/docker"
@@ -25,11 +30,27 @@ import (
 	. "github.com/JasonYangShadow/lpmx/rpc"
 	. "github.com/JasonYangShadow/lpmx/utils"
 	. "github.com/JasonYangShadow/lpmx/yaml"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	IDLENGTH = 10
+	//time waiting for processes of container to exit after SIGKILL or signal given to 'lpmx kill'
+	STOP_KILL_WAIT = 2 * time.Second
+	//env variable marking lpmx started by 'lpmx resume -d'
+	DETACH_ENV = "LPMX_DETACHED"
+	//time waiting for container started in background
+	DETACH_WAIT = 5 * time.Second
+	//files inside log folder of container, output of container shell and of lpmx running in background
+	CONTAINER_LOG = "container.log"
+	LPMX_LOG      = "lpmx.log"
+	//interval of reading new output for 'lpmx logs -f'
+	LOGS_POLL = 500 * time.Millisecond
+	//file inside rw layer containing patterns of paths left out of committed layer
+	LPMX_IGNORE = ".lpmxignore"
+	//folder inside container workspace keeping excluded paths while committing
+	COMMIT_EXCLUDE_FOLDER = ".commit_exclude"
 )
 
 var (
@@ -38,7 +59,11 @@ var (
 	LD_LIBRARY_PATH_DEFAULT = []string{"lib", "lib/x86_64-linux-gnu", "usr/lib/x86_64-linux-gnu", "usr/lib", "usr/local/lib"}
 	FOLDER_MODE             = 0755
 	CACHE_FOLDER            = []string{"/var/cache/apt/archives"}
+	COMMIT_EXCLUDE          = []string{"/var/lib/apt/lists", "/etc/passwd", "/etc/group", "/proc", "/tmp", "/.wh.tmp", "/lpmx"}
 	UNSTALL_FOLDER          = []string{".lpmxsys", "sync", "bin", ".docker", "package"}
+	RESERVED_ENV            = []string{"ContainerId", "ContainerRoot", "ContainerLayers", "ContainerBasePath", "DockerBase", "LD_PRELOAD", "LD_LIBRARY_LPMX", "MEMCACHED_PID", "FAKEROOTKEY", "SHELL"}
+	GC_GRACE_PERIOD         = time.Hour                 //layer files modified within this period are left by gc, as they may be written by concurrent download or load
+	DEFAULT_SETTING         = "user_shell: /bin/bash\n" //setting of image added from archive if setting repository is unreachable and no setting is given
 )
 
 //located inside $/.lpmxsys/.info
@@ -76,7 +101,104 @@ type Container struct {
 	RPCMap              map[int]string
 	PidFile             string
 	Pid                 int
-	DataSyncFolder      string //sync folder with host
+	DataSyncFolder      string      //sync folder with host
+	ImageConfig         ImageConfig //env, entrypoint, cmd, working dir and user taken from image config
+	History             []Snapshot  //commits of container, the oldest first
+}
+
+//Snapshot is one commit of container, used by history and rollback
+type Snapshot struct {
+	Layer   string //sha256 of the layer frozen by the commit
+	Layers  string //layers of container after the commit, e.g, rw:layer2:layer1
+	Parent  string //layers of container before the commit
+	From    string //image of container before the commit
+	Image   string //image created by the commit
+	Time    string
+	Message string
+	Author  string
+	Config  *ImageConfig //image config of container, nil for snapshots recorded by old versions of lpmx
+}
+
+//ContainerRecord is one container listed by 'lpmx list'
+type ContainerRecord struct {
+	Id         string `json:"id" yaml:"id"`
+	Name       string `json:"name" yaml:"name"`
+	Status     string `json:"status" yaml:"status"` //RUNNING or STOPPED
+	Pid        int    `json:"pid" yaml:"pid"`       //0 if container is stopped
+	RPC        int    `json:"rpc" yaml:"rpc"`       //port of rpc server, 0 if container does not run in rpc mode
+	DockerBase bool   `json:"docker_base" yaml:"docker_base"`
+	Image      string `json:"image" yaml:"image"`
+}
+
+//ImageRecord is one image listed by 'lpmx docker list'
+type ImageRecord struct {
+	Name     string        `json:"name" yaml:"name"`
+	Digest   string        `json:"digest" yaml:"digest"` //digest of manifest, empty for images created locally or by old versions of lpmx
+	Platform string        `json:"platform" yaml:"platform"`
+	Size     int64         `json:"size" yaml:"size"` //sum of compressed layer sizes
+	Layers   []LayerRecord `json:"layers" yaml:"layers"`
+}
+
+//LayerRecord is one layer of image, the lowest first
+type LayerRecord struct {
+	Digest string `json:"digest" yaml:"digest"`
+	Size   int64  `json:"size" yaml:"size"`
+}
+
+//PrivilegeRecord holds privileges and path maps of one program inside container, shown by 'lpmx get'
+type PrivilegeRecord struct {
+	Id      string   `json:"id" yaml:"id"`
+	Program string   `json:"program" yaml:"program"`
+	Allow   []string `json:"allow" yaml:"allow"`
+	Deny    []string `json:"deny" yaml:"deny"`
+	Map     []string `json:"map" yaml:"map"`
+}
+
+//RPCRecord is one command executed through rpc, shown by 'lpmx rpc query'
+type RPCRecord struct {
+	Pid int    `json:"pid" yaml:"pid"`
+	Cmd string `json:"cmd" yaml:"cmd"`
+}
+
+//ContainerInspect merges the information of container kept by lpmx, printed by 'lpmx inspect'
+type ContainerInspect struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Registry   map[string]interface{} `json:"registry"`   //entry inside .lpmxsys/.info
+	Config     *Container             `json:"config"`     //content of .lpmx/.info of container
+	Layers     []string               `json:"layers"`     //paths of layers, rw layer first
+	User       string                 `json:"user"`       //user declared by image config, programs still run as fake root
+	Env        map[string]string      `json:"env"`        //env given to container shell, nil if it could not be generated
+	Privileges []PrivilegeRecord      `json:"privileges"` //only programs configured by setting.yml are known, memcache could not list keys
+	State      ContainerState         `json:"state"`
+}
+
+//ContainerState is the running state of container
+type ContainerState struct {
+	Status    string `json:"status"` //RUNNING or STOPPED
+	Pid       int    `json:"pid"`    //pid of container shell, 0 if container is stopped
+	Processes []int  `json:"processes"`
+}
+
+//ImageInspect merges the information of image kept by lpmx, printed by 'lpmx inspect'
+type ImageInspect struct {
+	Type       string                 `json:"type"`
+	Name       string                 `json:"name"`
+	Digest     string                 `json:"digest"`
+	Platform   string                 `json:"platform"`
+	Registry   map[string]interface{} `json:"registry"` //entry inside .docker/.info
+	Config     json.RawMessage        `json:"config"`   //image config blob, null for images created by old versions of lpmx
+	Layers     []ImageLayer           `json:"layers"`   //the lowest first
+	Containers []string               `json:"containers"`
+}
+
+//ImageLayer is one layer of image with its tarball and extracted folder
+type ImageLayer struct {
+	Digest  string `json:"digest"`
+	Size    int64  `json:"size"`
+	Tarball string `json:"tarball"`
+	Path    string `json:"path"`
 }
 
 type RPC struct {
@@ -96,6 +218,11 @@ type DockerInfo struct {
 	Name      string
 	LayersMap map[string]int64 //map containing layers and their sizes
 	Layers    string           //should be original order, used for extraction
+	Digest    string           //digest of the manifest actually pulled, resolved from manifest list if necessary
+	Platform  string           //platform used for resolving manifest list, e.g, linux/amd64
+	Config    []byte           //raw image config blob in json format
+	//media types of layers declared by manifest, layers missing here are decompressed according to their magic bytes
+	MediaTypes map[string]string
 }
 
 func (server *RPC) RPCExec(req Request, res *Response) error {
@@ -287,54 +414,53 @@ func Uninstall() *Error {
 	return nil
 }
 
-func List() *Error {
+func List() ([]ContainerRecord, *Error) {
 	currdir, _ := GetCurrDir()
 	var sys Sys
 	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
 	err := unmarshalObj(rootdir, &sys)
 	if err == nil {
-		fmt.Println(fmt.Sprintf("%s%15s%15s%15s%15s%15s%15s", "ContainerID", "ContainerName", "Status", "PID", "RPC", "DockerBase", "Image"))
+		records := []ContainerRecord{}
 		for k, v := range sys.Containers {
 			if cmap, ok := v.(map[string]interface{}); ok {
 				//get each container location
 				root := path.Dir(cmap["RootPath"].(string))
+				record := ContainerRecord{Id: k, Status: "STOPPED"}
+				record.Name, _ = cmap["ContainerName"].(string)
+				record.Image, _ = cmap["Image"].(string)
+				if docker, dok := cmap["DockerBase"].(string); dok {
+					record.DockerBase, _ = strconv.ParseBool(docker)
+				}
 
-				pid := -1
 				//check if container is running
-				if pok, _ := PidIsActive(fmt.Sprintf("%s/container.pid", root)); pok {
-					pid, _ = PidValue(fmt.Sprintf("%s/container.pid", root))
+				if pid, pok := containerRunning(root, k); pok {
+					record.Status = "RUNNING"
+					record.Pid = pid
 				}
 
-				//RPC MODE
+				//RPC MODE, containers whose rpc server is not reachable are left out
 				if cmap["RPC"] != nil && cmap["RPC"].(string) != "0" {
 					conn, err := net.DialTimeout("tcp", net.JoinHostPort("", cmap["RPC"].(string)), time.Millisecond*200)
-					if err == nil && conn != nil {
-						conn.Close()
-						if pid != -1 {
-							fmt.Println(fmt.Sprintf("%s%15s%15s%15s%15s%15s%15s", k, cmap["ContainerName"].(string), "RUNNING", strconv.Itoa(pid), cmap["RPC"].(string), cmap["DockerBase"].(string), cmap["Image"].(string)))
-						} else {
-							fmt.Println(fmt.Sprintf("%s%15s%15s%15s%15s%15s%15s", k, cmap["ContainerName"].(string), "STOPPED", "NA", cmap["RPC"].(string), cmap["DockerBase"].(string), cmap["Image"].(string)))
-						}
-					}
-				} else {
-					if pid != -1 {
-						fmt.Println(fmt.Sprintf("%s%15s%15s%15s%15s%15s%15s", k, cmap["ContainerName"].(string), "RUNNING", strconv.Itoa(pid), "NA", cmap["DockerBase"].(string), cmap["Image"].(string)))
-					} else {
-						fmt.Println(fmt.Sprintf("%s%15s%15s%15s%15s%15s%15s", k, cmap["ContainerName"].(string), "STOPPED", "NA", "NA", cmap["DockerBase"].(string), cmap["Image"].(string)))
+					if err != nil || conn == nil {
+						continue
 					}
+					conn.Close()
+					record.RPC, _ = strconv.Atoi(cmap["RPC"].(string))
 				}
+				records = append(records, record)
 			} else {
 				cerr := ErrNew(ErrType, "sys.Containers type error")
-				return cerr
+				return nil, cerr
 			}
 		}
-		return nil
+		sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+		return records, nil
 	}
 
 	if err == ErrNExist {
 		err.AddMsg(fmt.Sprintf("%s does not exist, you may need to use 'lpmx init' firstly", rootdir))
 	}
-	return err
+	return nil, err
 }
 
 func RPCExec(ip string, port string, timeout string, cmd string, args ...string) (*Response, *Error) {
@@ -360,7 +486,7 @@ func RPCExec(ip string, port string, timeout string, cmd string, args ...string)
 	/**err = client.Call("RPC.RPCExec", req, &res)**/
 }
 
-func RPCQuery(ip string, port string) (*Response, *Error) {
+func RPCQuery(ip string, port string) ([]RPCRecord, *Error) {
 	client, err := rpc.Dial("tcp", fmt.Sprintf("%s:%s", ip, port))
 	if err != nil {
 		cerr := ErrNew(err, "tcp dial error")
@@ -373,7 +499,12 @@ func RPCQuery(ip string, port string) (*Response, *Error) {
 		cerr := ErrNew(err, "rpc call encounters error")
 		return nil, cerr
 	}
-	return &res, nil
+	records := []RPCRecord{}
+	for k, v := range res.RPCMap {
+		records = append(records, RPCRecord{Pid: k, Cmd: v})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Pid < records[j].Pid })
+	return records, nil
 }
 
 func RPCDelete(ip string, port string, pid int) (*Response, *Error) {
@@ -393,12 +524,16 @@ func RPCDelete(ip string, port string, pid int) (*Response, *Error) {
 	return &res, nil
 }
 
-func Resume(id string, args ...string) *Error {
+//Resume starts shell of container, if detach is true, it is started in background with its output written into CONTAINER_LOG
+func Resume(id string, detach bool, args ...string) *Error {
 	currdir, _ := GetCurrDir()
 	var sys Sys
 	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
 	err := unmarshalObj(rootdir, &sys)
 	if err == nil {
+		if id, err = resolveContainer(&sys, id); err != nil {
+			return err
+		}
 		if v, ok := sys.Containers[id]; ok {
 			if val, vok := v.(map[string]interface{}); vok {
 				config_path := val["ConfigPath"].(string)
@@ -410,7 +545,14 @@ func Resume(id string, args ...string) *Error {
 				}
 				pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
 
-				if pok, _ := PidIsActive(pidfile); !pok {
+				if _, pok := containerRunning(path.Dir(con.RootPath), id); !pok {
+					//image entrypoint and cmd are used if no command is given
+					if len(args) == 0 {
+						args = con.ImageConfig.DefaultCommand()
+					}
+					if detach && os.Getenv(DETACH_ENV) == "" {
+						return con.detach(currdir, args)
+					}
 					configmap := make(map[string]interface{})
 					configmap["dir"] = con.RootPath
 					configmap["config"] = con.SettingPath
@@ -450,7 +592,13 @@ func Resume(id string, args ...string) *Error {
 
 }
 
-func Destroy(id string) *Error {
+//Destroy removes container, running container is stopped firstly if force is true
+func Destroy(id string, force bool) *Error {
+	if force {
+		if err := Stop(id, 0); err != nil && err.Err != ErrNExist {
+			return err
+		}
+	}
 	currdir, _ := GetCurrDir()
 	var sys Sys
 	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
@@ -462,15 +610,15 @@ func Destroy(id string) *Error {
 	}()
 
 	if err == nil {
+		if id, err = resolveContainer(&sys, id); err != nil {
+			return err
+		}
 		if v, ok := sys.Containers[id]; ok {
 			if val, vok := v.(map[string]interface{}); vok {
 				root := path.Dir(val["RootPath"].(string))
 
-				pid := -1
 				//check if container is running
-				if pok, _ := PidIsActive(fmt.Sprintf("%s/container.pid", root)); pok {
-					pid, _ = PidValue(fmt.Sprintf("%s/container.pid", root))
-				}
+				pid, _ := containerRunning(root, id)
 
 				if pid == -1 {
 					//check if container is based on docker
@@ -485,7 +633,7 @@ func Destroy(id string) *Error {
 					}
 					delete(sys.Containers, id)
 				} else {
-					cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't destroy", id, pid))
+					cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't destroy, please stop it firstly or use --force", id, pid))
 					return cerr
 				}
 				return nil
@@ -504,6 +652,349 @@ func Destroy(id string) *Error {
 
 }
 
+//containerRunning returns the pid of container shell recorded inside container.pid of root
+//pid file left by crashed lpmx, whose pid is reused by process outside of container, is removed
+func containerRunning(root string, id string) (int, bool) {
+	pidfile := fmt.Sprintf("%s/container.pid", root)
+	if pok, _ := PidIsActive(pidfile); !pok {
+		return -1, false
+	}
+	pid, _ := PidValue(pidfile)
+	if cid, ok := PidEnv(pid, "ContainerId"); !ok || cid != id {
+		LOGGER.WithFields(logrus.Fields{
+			"pidfile": pidfile,
+			"pid":     pid,
+		}).Warn("pid file is stale, process does not belong to container")
+		os.Remove(pidfile)
+		return -1, false
+	}
+	return pid, true
+}
+
+//processes returns pids of container, the shell with its descendants and the processes detached from shell but still carrying ContainerId
+func (con *Container) processes() []int {
+	var pids []int
+	seen := make(map[int]bool)
+	if pid, ok := containerRunning(filepath.Dir(con.RootPath), con.Id); ok {
+		pids = append(pids, pid)
+		seen[pid] = true
+		for _, child := range PidDescendants(pid) {
+			pids = append(pids, child)
+			seen[child] = true
+		}
+	}
+	for _, pid := range PidList() {
+		if seen[pid] || pid == os.Getpid() {
+			continue
+		}
+		if cid, ok := PidEnv(pid, "ContainerId"); ok && cid == con.Id {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+//signalProcesses sends sig to pids and waits at most timeout for them to exit, pids still alive are returned
+func signalProcesses(pids []int, sig syscall.Signal, timeout time.Duration) []int {
+	for _, pid := range pids {
+		syscall.Kill(pid, sig)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var alive []int
+		for _, pid := range pids {
+			if syscall.Kill(pid, 0) == nil {
+				alive = append(alive, pid)
+			}
+		}
+		if len(alive) == 0 || time.Now().After(deadline) {
+			return alive
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//cleanup kills faked-sysv and rpc service of stopped container and removes their pid files
+//pid files left by crashed lpmx may contain pids reused by other processes, which are not killed
+func (con *Container) cleanup() {
+	root := filepath.Dir(con.RootPath)
+	for _, name := range []string{"faked.pid", "rpc.pid"} {
+		pidfile := fmt.Sprintf("%s/%s", root, name)
+		if pok, _ := PidIsActive(pidfile); pok {
+			pid, _ := PidValue(pidfile)
+			if pid != os.Getpid() && con.ownsProcess(name, pid) {
+				fmt.Println(fmt.Sprintf("cleaning up %s with pid: %d", strings.TrimSuffix(name, ".pid"), pid))
+				syscall.Kill(pid, syscall.SIGKILL)
+			} else if pid != os.Getpid() {
+				LOGGER.WithFields(logrus.Fields{
+					"pidfile": pidfile,
+					"pid":     pid,
+				}).Warn("pid file is stale, process does not belong to container")
+			}
+		}
+		os.Remove(pidfile)
+	}
+	os.Remove(fmt.Sprintf("%s/container.pid", root))
+}
+
+//ownsProcess checks whether pid recorded inside pidfile name is still the process started for container
+//faked.pid should be faked-sysv, rpc.pid should be lpmx serving rpc with container id or its folder among the arguments
+func (con *Container) ownsProcess(name string, pid int) bool {
+	comm, ok := PidComm(pid)
+	if !ok {
+		return false
+	}
+	switch name {
+	case "faked.pid":
+		return comm == "faked-sysv"
+	case "rpc.pid":
+		if comm != "lpmx" {
+			return false
+		}
+		args, _ := PidCmdline(pid)
+		for _, arg := range args {
+			if arg == con.Id || filepath.Clean(arg) == filepath.Clean(con.RootPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Stop terminates all the processes of container, the ones still alive after timeout(in seconds) are killed
+func Stop(id string, timeout int) *Error {
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	pids := con.processes()
+	if len(pids) == 0 {
+		fmt.Println(fmt.Sprintf("container %s is not running", id))
+	} else {
+		//interactive shell ignores SIGTERM but exits on SIGHUP, detached and exec'd processes only receive SIGTERM
+		if shell, ok := containerRunning(filepath.Dir(con.RootPath), con.Id); ok {
+			syscall.Kill(shell, syscall.SIGHUP)
+		}
+		alive := signalProcesses(pids, syscall.SIGTERM, time.Duration(timeout)*time.Second)
+		if len(alive) > 0 {
+			fmt.Println(fmt.Sprintf("%d processes are still alive after %d seconds, killing them", len(alive), timeout))
+			alive = signalProcesses(alive, syscall.SIGKILL, STOP_KILL_WAIT)
+		}
+		if len(alive) > 0 {
+			cerr := ErrNew(ErrExist, fmt.Sprintf("processes %v of container %s could not be killed", alive, id))
+			return cerr
+		}
+	}
+	con.cleanup()
+	return nil
+}
+
+//Kill sends sig to all the processes of container, container is cleaned up if they all exit
+func Kill(id string, sig string) *Error {
+	signal, err := PidSignal(sig)
+	if err != nil {
+		return err
+	}
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	pids := con.processes()
+	if len(pids) == 0 {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("container %s is not running", id))
+		return cerr
+	}
+	alive := signalProcesses(pids, signal, STOP_KILL_WAIT)
+	if len(alive) > 0 {
+		fmt.Println(fmt.Sprintf("%d processes of container %s are still alive", len(alive), id))
+		return nil
+	}
+	con.cleanup()
+	return nil
+}
+
+//detach runs 'lpmx resume' of container as background session, its own output is written into LPMX_LOG under log folder of container
+func (con *Container) detach(currdir string, args []string) *Error {
+	if len(args) == 0 {
+		cerr := ErrNew(ErrNil, fmt.Sprintf("container %s has no default command, command is required for running in background", con.Id))
+		return cerr
+	}
+	_, err := MakeDir(con.LogPath)
+	if err != nil {
+		return err
+	}
+	lpmx_log := fmt.Sprintf("%s/%s", con.LogPath, LPMX_LOG)
+	out, oerr := os.OpenFile(lpmx_log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if oerr != nil {
+		cerr := ErrNew(oerr, fmt.Sprintf("could not open file %s", lpmx_log))
+		return cerr
+	}
+	defer out.Close()
+
+	cmd := exec.Command(fmt.Sprintf("%s/lpmx", currdir), append([]string{"resume", con.Id, "--"}, args...)...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=1", DETACH_ENV))
+	cmd.Stdout = out
+	cmd.Stderr = out
+	//new session is not affected by hangup of login shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if serr := cmd.Start(); serr != nil {
+		cerr := ErrNew(serr, fmt.Sprintf("could not start container %s in background", con.Id))
+		return cerr
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	//waiting for container shell so that failures of starting are reported
+	deadline := time.Now().Add(DETACH_WAIT)
+	for time.Now().Before(deadline) {
+		select {
+		case werr := <-exited:
+			if werr != nil {
+				cerr := ErrNew(werr, fmt.Sprintf("container %s exits with error, please check %s", con.Id, lpmx_log))
+				return cerr
+			}
+			fmt.Println(fmt.Sprintf("container %s finished, use 'lpmx logs %s' to read its output", con.Id, con.Id))
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+		if pid, ok := containerRunning(filepath.Dir(con.RootPath), con.Id); ok {
+			fmt.Println(fmt.Sprintf("container %s is running in background with pid: %d, use 'lpmx logs %s' to read its output", con.Id, pid, con.Id))
+			return nil
+		}
+	}
+	fmt.Println(fmt.Sprintf("container %s is starting in background, use 'lpmx logs %s' to read its output", con.Id, con.Id))
+	return nil
+}
+
+//Logs prints output of container written in background, lines before since are skipped
+//since is either duration(e.g, 10m) or RFC3339 time, if follow is true, new output is printed until container stops
+func Logs(id string, follow bool, since string) *Error {
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	var since_time time.Time
+	if since != "" {
+		if d, derr := time.ParseDuration(since); derr == nil {
+			since_time = time.Now().Add(-d)
+		} else if t, terr := time.Parse(time.RFC3339, since); terr == nil {
+			since_time = t
+		} else {
+			cerr := ErrNew(ErrType, fmt.Sprintf("since %s should be either duration like 10m or RFC3339 time like 2006-01-02T15:04:05Z", since))
+			return cerr
+		}
+	}
+	output := func(line LogLine) {
+		if !line.Time.IsZero() && line.Time.Before(since_time) {
+			return
+		}
+		if line.Stream == "stderr" {
+			fmt.Fprintln(os.Stderr, line.Text)
+		} else {
+			fmt.Println(line.Text)
+		}
+	}
+
+	files := LogFiles(con.LogPath, CONTAINER_LOG)
+	if len(files) == 0 && !follow {
+		return nil
+	}
+	for idx, file := range files {
+		if follow && idx == len(files)-1 {
+			break
+		}
+		f, ferr := os.Open(file)
+		if ferr != nil {
+			cerr := ErrNew(ferr, fmt.Sprintf("could not open file %s", file))
+			return cerr
+		}
+		rest, _ := ReadLogLines(f, output)
+		f.Close()
+		if rest != "" {
+			output(ParseLogLine(rest))
+		}
+	}
+	if !follow {
+		return nil
+	}
+
+	//current log file is read repeatedly, it is reopened after rotation
+	current := fmt.Sprintf("%s/%s", con.LogPath, CONTAINER_LOG)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	pending := ""
+	for {
+		_, running := containerRunning(filepath.Dir(con.RootPath), con.Id)
+		if f == nil {
+			f, _ = os.Open(current)
+		}
+		if f != nil {
+			pending, _ = ReadLogLines(io.MultiReader(strings.NewReader(pending), f), output)
+			if fi, serr := os.Stat(current); serr == nil {
+				if ofi, oerr := f.Stat(); oerr == nil && !os.SameFile(fi, ofi) {
+					//rotated file is drained before the new one is opened
+					pending, _ = ReadLogLines(io.MultiReader(strings.NewReader(pending), f), output)
+					f.Close()
+					f = nil
+					continue
+				}
+			}
+		}
+		if !running {
+			if pending != "" {
+				output(ParseLogLine(pending))
+			}
+			return nil
+		}
+		time.Sleep(LOGS_POLL)
+	}
+}
+
+//Exec runs command(or interactive shell if no command is given) inside running container
+//the process shares env, faked-sysv and memcached with the shell started by resume
+func Exec(id string, args ...string) *Error {
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	pid, ok := containerRunning(filepath.Dir(con.RootPath), con.Id)
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id: %s is not running, please resume it firstly", id))
+		return cerr
+	}
+	//memcached servers and lpmx sys dir are filled in
+	err = con.appendToSys()
+	if err != nil {
+		return err
+	}
+	env, err := con.genEnv()
+	if err != nil {
+		return err
+	}
+	//keys of faked-sysv and memcached used by running container are taken from its shell
+	for _, key := range []string{"FAKEROOTKEY", "MEMCACHED_PID"} {
+		if value, vok := PidEnv(pid, key); vok {
+			env[key] = value
+		}
+	}
+	if _, fok := env["FAKEROOTKEY"]; !fok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("could not get FAKEROOTKEY of container %s from its shell with pid: %d", id, pid))
+		return cerr
+	}
+
+	dir := con.RootPath
+	if con.ImageConfig.WorkingDir != "" && FolderExist(filepath.Join(con.RootPath, con.ImageConfig.WorkingDir)) {
+		dir = filepath.Join(con.RootPath, con.ImageConfig.WorkingDir)
+	}
+	return ShellEnv(con.UserShell, env, dir, args...)
+}
+
 func Run(configmap *map[string]interface{}, args ...string) *Error {
 	//dir is rw folder of container
 	dir, _ := (*configmap)["dir"].(string)
@@ -526,6 +1017,9 @@ func Run(configmap *map[string]interface{}, args ...string) *Error {
 			con.BaseLayerPath = (*configmap)["baselayerpath"].(string)
 			con.PatchedELFLoader = (*configmap)["elf_loader"].(string)
 			con.DataSyncFolder = (*configmap)["sync_folder"].(string)
+			if ic, ok := (*configmap)["image_config"].(*ImageConfig); ok {
+				con.ImageConfig = *ic
+			}
 		}
 	} else {
 		con.DockerBase = false
@@ -579,6 +1073,13 @@ func Run(configmap *map[string]interface{}, args ...string) *Error {
 		if err != nil {
 			return err
 		}
+		//lpmx itself serves rpc, its pid is recorded for 'lpmx stop'
+		rpc_pidfile := fmt.Sprintf("%s/rpc.pid", filepath.Dir(con.RootPath))
+		err = PidCreateByPid(rpc_pidfile, os.Getpid())
+		if err != nil {
+			return err
+		}
+		defer os.Remove(rpc_pidfile)
 		err = con.startRPCService(con.RPCPort)
 		if err != nil {
 			err.AddMsg("starting rpc service encounters error")
@@ -600,29 +1101,49 @@ func Run(configmap *map[string]interface{}, args ...string) *Error {
 	return nil
 }
 
-func Get(id string, name string) *Error {
+func Get(id string, name string) (*PrivilegeRecord, *Error) {
 	currdir, _ := GetCurrDir()
 	var sys Sys
 	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
 	err := unmarshalObj(rootdir, &sys)
 
 	if err == nil {
+		if id, err = resolveContainer(&sys, id); err != nil {
+			return nil, err
+		}
 		if _, ok := sys.Containers[id]; ok {
-			fmt.Println(fmt.Sprintf("|%-s|%-30s|%-20s|%-20s|%-10s|", "ContainerID", "PROGRAM", "ALLOW_PRIVILEGES", "DENY_PRIVILEGES", "REMAP"))
 			a_val, _ := getPrivilege(id, name, sys.MemcachedPid, true)
 			d_val, _ := getPrivilege(id, name, sys.MemcachedPid, false)
 			m_val, _ := getMap(id, name, sys.MemcachedPid)
-			fmt.Println(fmt.Sprintf("|%-s|%-30s|%-20s|%-20s|%-10s|", id, name, a_val, d_val, m_val))
+			record := &PrivilegeRecord{
+				Id:      id,
+				Program: name,
+				Allow:   splitEntries(a_val),
+				Deny:    splitEntries(d_val),
+				Map:     splitEntries(m_val),
+			}
+			return record, nil
 		} else {
 			cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id: %s doesn't exist", id))
-			return cerr
+			return nil, cerr
 		}
 	}
 
 	if err == ErrNExist {
 		err.AddMsg(fmt.Sprintf("%s does not exist, you may need to use 'lpmx init' firstly", rootdir))
 	}
-	return err
+	return nil, err
+}
+
+//splitEntries splits privileges or maps stored in memcache, which are separated by ';'
+func splitEntries(value string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(value, ";") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
 }
 
 func Set(id string, tp string, name string, value string) *Error {
@@ -632,6 +1153,9 @@ func Set(id string, tp string, name string, value string) *Error {
 	err := unmarshalObj(rootdir, &sys)
 
 	if err == nil {
+		if id, err = resolveContainer(&sys, id); err != nil {
+			return err
+		}
 		if v, ok := sys.Containers[id]; ok {
 			if _, vok := v.(map[string]interface{}); vok {
 				tp = strings.ToLower(strings.TrimSpace(tp))
@@ -682,7 +1206,7 @@ func DockerSearch(name string) ([]string, *Error) {
 	return tags, err
 }
 
-func DockerPackage(name string, user string, pass string) *Error {
+func DockerPackage(name string, user string, pass string, platform string, parallel int) *Error {
 	currdir, _ := GetCurrDir()
 	packagedir := fmt.Sprintf("%s/package", currdir)
 	if !FolderExist(packagedir) {
@@ -694,6 +1218,10 @@ func DockerPackage(name string, user string, pass string) *Error {
 	if err != nil {
 		return err
 	}
+	name, err = normalizeImageName(name)
+	if err != nil {
+		return err
+	}
 	if dvalue, dok := doc.Images[name]; dok {
 		if dmap, dmok := dvalue.(map[string]interface{}); dmok {
 			var filelist []string
@@ -714,7 +1242,7 @@ func DockerPackage(name string, user string, pass string) *Error {
 			return cerr
 		}
 	} else {
-		cerr := DockerDownload(name, user, pass)
+		cerr := DockerDownload(name, user, pass, platform, parallel)
 		if cerr != nil && cerr.Err != ErrExist {
 			return cerr
 		}
@@ -722,8 +1250,15 @@ func DockerPackage(name string, user string, pass string) *Error {
 	return nil
 }
 
-func DockerAdd(file string) *Error {
-	if !FileExist(file) {
+//DockerAdd imports images from the package created by 'lpmx docker package', the archive created by 'docker save' or OCI image layout(directory or tarball)
+//name selects(or renames) the image to add, which is required if the image inside archive is untagged
+//setting is the path of local setting.yml used instead of the one inside package or the one downloaded from setting repository
+func DockerAdd(file string, name string, platform string, setting string) *Error {
+	if setting != "" && !FileExist(setting) {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist", setting))
+		return cerr
+	}
+	if !FileExist(file) && !FolderExist(file) {
 		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist", file))
 		return cerr
 	}
@@ -743,139 +1278,622 @@ func DockerAdd(file string) *Error {
 		}
 	}
 
-	//start untaring offline file
-	//create tmp folder
-	dir, derr := ioutil.TempDir("", "lpmx")
-	if derr != nil {
-		cerr := ErrNew(derr, "could not create temp dir")
-		return cerr
-	}
+	//OCI image layout could be a directory, others should be untared firstly
+	dir := file
+	if !FolderExist(file) {
+		tdir, derr := ioutil.TempDir("", "lpmx")
+		if derr != nil {
+			cerr := ErrNew(derr, "could not create temp dir")
+			return cerr
+		}
+		defer os.RemoveAll(tdir)
+		dir = tdir
 
-	//Uncompressing
-	cerr := Untar(file, dir)
-	if cerr != nil {
-		return cerr
-	}
-	//read .info
-	if !FileExist(fmt.Sprintf("%s/.info", dir)) {
-		cerr := ErrNew(ErrNExist, ".info metafile does not exist inside package, maybe the package is not created by 'lpmx docker package' command")
-		return cerr
+		//Uncompressing
+		cerr := Untar(file, dir)
+		if cerr != nil {
+			return cerr
+		}
 	}
-	var docinfo DockerInfo
-	cerr = unmarshalObj(dir, &docinfo)
-	if cerr != nil {
-		return cerr
+
+	image_dir := fmt.Sprintf("%s/.image", doc.RootDir)
+	if !FolderExist(image_dir) {
+		MakeDir(image_dir)
 	}
-	if _, ok := doc.Images[docinfo.Name]; ok {
-		return nil
-	} else {
-		tdata := strings.Split(docinfo.Name, ":")
-		tname := tdata[0]
-		ttag := tdata[1]
-		mdata := make(map[string]interface{})
-		mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", doc.RootDir, tname, ttag)
-		mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"])
-		mdata["image"] = fmt.Sprintf("%s/image", mdata["rootdir"])
-		image_dir, _ := mdata["image"].(string)
 
-		if !FolderExist(mdata["rootdir"].(string)) {
-			MakeDir(mdata["rootdir"].(string))
+	//package created by lpmx
+	if FileExist(fmt.Sprintf("%s/.info", dir)) {
+		var docinfo DockerInfo
+		cerr := unmarshalObj(dir, &docinfo)
+		if cerr != nil {
+			return cerr
 		}
-
-		if !FolderExist(mdata["image"].(string)) {
-			MakeDir(mdata["image"].(string))
+		if name != "" {
+			docinfo.Name = name
+		}
+		docinfo.Name, cerr = normalizeImageName(docinfo.Name)
+		if cerr != nil {
+			return cerr
+		}
+		if _, ok := doc.Images[docinfo.Name]; ok {
+			return nil
 		}
 
 		//move layers
-		layers := strings.Split(docinfo.Layers, ":")
-		for _, lay := range layers {
+		for _, lay := range strings.Split(docinfo.Layers, ":") {
 			lay_path := fmt.Sprintf("%s/%s", dir, lay)
 			if !FileExist(lay_path) {
 				cerr := ErrNew(ErrNExist, fmt.Sprintf("%s layer does not exist", lay_path))
 				return cerr
 			}
-			lay_new_path := fmt.Sprintf("%s/%s", mdata["image"], lay)
-			err := os.Rename(lay_path, lay_new_path)
-			if err != nil {
-				cerr := ErrNew(err, fmt.Sprintf("could not move file %s to %s", lay_path, lay_new_path))
+			//layers inside package are named by their sha256 values
+			cerr := VerifyLayer(lay_path, digest.NewDigestFromHex(string(digest.SHA256), lay), "")
+			if cerr != nil {
+				return cerr
+			}
+			lay_new_path := fmt.Sprintf("%s/%s", image_dir, lay)
+			if FileExist(lay_new_path) {
+				continue
+			}
+			_, cerr = CopyFile(lay_path, lay_new_path)
+			if cerr != nil {
 				return cerr
 			}
 		}
 
-		//move setting.yml
 		config_path := fmt.Sprintf("%s/setting.yml", dir)
+		if setting != "" {
+			config_path = setting
+		}
 		if !FileExist(config_path) {
 			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist", config_path))
 			return cerr
 		}
-		err := os.Rename(config_path, mdata["config"].(string))
-		if err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("could not move file %s to %s", config_path, mdata["config"]))
-			return cerr
-		}
-
-		//here we have to restore absolute path
-		layersmap := make(map[string]int64)
-		for k, v := range docinfo.LayersMap {
-			layersmap[fmt.Sprintf("%s/%s", mdata["image"].(string), k)] = v
-		}
-		mdata["layer"] = layersmap
-		mdata["layer_order"] = docinfo.Layers
+		return registerImage(&doc, &docinfo, config_path)
+	}
 
-		workspace := fmt.Sprintf("%s/workspace", mdata["rootdir"])
-		if !FolderExist(workspace) {
-			MakeDir(workspace)
+	var images []ArchiveImage
+	var cerr *Error
+	if IsDockerArchive(dir) {
+		images, cerr = ReadDockerArchive(dir)
+	} else if IsOCILayout(dir) {
+		plat, perr := ParsePlatform(platform)
+		if perr != nil {
+			return perr
 		}
-		mdata["workspace"] = workspace
+		images, cerr = ReadOCILayout(dir, plat)
+	} else {
+		cerr = ErrNew(ErrType, fmt.Sprintf("%s is neither created by 'lpmx docker package', 'docker save' nor an OCI image layout", file))
+	}
+	if cerr != nil {
+		return cerr
+	}
 
-		//extract layers
-		base := fmt.Sprintf("%s/base", mdata["rootdir"])
-		if !FolderExist(base) {
-			MakeDir(base)
+	//select images to add
+	if name != "" {
+		name, cerr = normalizeImageName(name)
+		if cerr != nil {
+			return cerr
 		}
-		mdata["base"] = base
-
-		layer_order := strings.Split(docinfo.Layers, ":")
-		for _, k := range layer_order {
-			tar_path := fmt.Sprintf("%s/%s", image_dir, k)
-			layerfolder := fmt.Sprintf("%s/%s", mdata["base"], k)
-			if !FolderExist(layerfolder) {
-				MakeDir(layerfolder)
-			}
-
-			err := Untar(tar_path, layerfolder)
-			if err != nil {
-				return err
+		var selected []ArchiveImage
+		for _, image := range images {
+			iname, ierr := normalizeImageName(image.Name)
+			if ierr == nil && iname == name {
+				selected = append(selected, image)
 			}
 		}
-
-		//move .info
-		info_path := fmt.Sprintf("%s/.info", dir)
-		info_new_path := fmt.Sprintf("%s/.info", mdata["rootdir"])
-		err = os.Rename(info_path, info_new_path)
-		if err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("could not move file %s to %s", info_path, info_new_path))
+		//the only image inside archive could be renamed
+		if len(selected) == 0 && len(images) == 1 {
+			selected = images
+		}
+		if len(selected) == 0 {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s is not found inside %s", name, file))
+			return cerr
+		}
+		images = selected[:1]
+		images[0].Name = name
+	}
+	if len(images) == 0 {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("no image is found inside %s", file))
+		return cerr
+	}
+
+	for _, image := range images {
+		if image.Name == "" {
+			cerr := ErrNew(ErrNil, fmt.Sprintf("image inside %s is untagged, please specify the name of image", file))
+			return cerr
+		}
+		iname, cerr := normalizeImageName(image.Name)
+		if cerr != nil {
 			return cerr
 		}
+		if _, ok := doc.Images[iname]; ok {
+			continue
+		}
+
+		var docinfo DockerInfo
+		docinfo.Name = iname
+		docinfo.Digest = image.Digest
+		docinfo.Config = image.Config
+		docinfo.LayersMap = make(map[string]int64)
+		docinfo.MediaTypes = make(map[string]string)
+		var layer_sha []string
+		for idx, layer := range image.Layers {
+			var dig, diff_id digest.Digest
+			var media_type string
+			if idx < len(image.Digests) {
+				dig = image.Digests[idx]
+			}
+			if idx < len(image.MediaTypes) {
+				media_type = image.MediaTypes[idx]
+			}
+			if idx < len(image.DiffIDs) {
+				diff_id = image.DiffIDs[idx]
+			}
+			cerr := VerifyLayer(layer, dig, diff_id)
+			if cerr != nil {
+				return cerr
+			}
+			sha, size, media_type, cerr := importLayer(layer, media_type, image_dir)
+			if cerr != nil {
+				return cerr
+			}
+			docinfo.LayersMap[sha] = size
+			docinfo.MediaTypes[sha] = media_type
+			layer_sha = append(layer_sha, sha)
+		}
+		docinfo.Layers = strings.Join(layer_sha, ":")
 
-		doc.Images[docinfo.Name] = mdata
+		fmt.Println(fmt.Sprintf("adding image %s...", iname))
+		config_path, cerr := archiveSetting(iname, setting)
+		if cerr != nil {
+			return cerr
+		}
+		cerr = registerImage(&doc, &docinfo, config_path)
+		if config_path != setting {
+			os.RemoveAll(filepath.Dir(config_path))
+		}
+		if cerr != nil {
+			return cerr
+		}
+	}
+	return nil
+}
 
-		ddata, _ := StructMarshal(doc)
-		cerr := WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
+//archiveSetting returns the path of setting.yml of image added from archive, which is the given setting or the one downloaded from setting repository
+//archives are often added on hosts without internet access, so DEFAULT_SETTING is used if setting repository is unreachable
+func archiveSetting(name string, setting string) (string, *Error) {
+	if setting != "" {
+		return setting, nil
+	}
+	ref, cerr := ParseReference(name)
+	if cerr != nil {
+		return "", cerr
+	}
+	tdir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		cerr := ErrNew(err, "could not create temp dir")
+		return "", cerr
+	}
+	config_path := fmt.Sprintf("%s/setting.yml", tdir)
+	cerr = DownloadFilefromGithub(ref.Name(), ref.Reference(), "setting.yml", SETTING_URL, tdir)
+	if cerr != nil {
+		LOGGER.WithFields(logrus.Fields{
+			"err":   cerr,
+			"image": name,
+		}).Warn("Download setting from github failure, default setting is used, which could be replaced by 'lpmx docker add -s'")
+		cerr = WriteToFile([]byte(DEFAULT_SETTING), config_path)
 		if cerr != nil {
+			os.RemoveAll(tdir)
+			return "", cerr
+		}
+	}
+	return config_path, nil
+}
+
+//DockerExport writes image as the archive loadable by 'docker load' or as the tarball of OCI image layout
+func DockerExport(name string, output string, format string) *Error {
+	name, cerr := normalizeImageName(name)
+	if cerr != nil {
+		return cerr
+	}
+	currdir, _ := GetCurrDir()
+	rootdir := fmt.Sprintf("%s/.docker", currdir)
+	var doc Docker
+	err := unmarshalObj(rootdir, &doc)
+	if err != nil {
+		return err
+	}
+	vval, ok := doc.Images[name].(map[string]interface{})
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("image %s does not exist", name))
+		return cerr
+	}
+
+	var docinfo DockerInfo
+	rdir, _ := vval["rootdir"].(string)
+	err = unmarshalObj(rdir, &docinfo)
+	if err != nil {
+		return err
+	}
+	image_dir, _ := vval["image"].(string)
+	var layers []string
+	for _, layer := range strings.Split(vval["layer_order"].(string), ":") {
+		layers = append(layers, fmt.Sprintf("%s/%s", image_dir, path.Base(layer)))
+	}
+	return ExportImage(output, format, name, docinfo.Config, docinfo.Platform, layers)
+}
+
+//DockerVerify re-hashes layer tarballs of image(all images if name is empty) and reports corrupted or missing ones
+func DockerVerify(name string) *Error {
+	currdir, _ := GetCurrDir()
+	rootdir := fmt.Sprintf("%s/.docker", currdir)
+	var doc Docker
+	err := unmarshalObj(rootdir, &doc)
+	if err != nil {
+		return err
+	}
+	var names []string
+	if name != "" {
+		name, err = normalizeImageName(name)
+		if err != nil {
+			return err
+		}
+		if _, ok := doc.Images[name]; !ok {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("image %s does not exist", name))
+			return cerr
+		}
+		names = append(names, name)
+	} else {
+		for k := range doc.Images {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+	}
+
+	//layers shared by images are only hashed once
+	checked := make(map[string]string)
+	failed := 0
+	fmt.Println(fmt.Sprintf("%-40s%-70s%s", "Image", "Layer", "Status"))
+	for _, iname := range names {
+		vval, ok := doc.Images[iname].(map[string]interface{})
+		if !ok {
+			cerr := ErrNew(ErrType, "doc.Images type error")
 			return cerr
 		}
+		var docinfo DockerInfo
+		rdir, _ := vval["rootdir"].(string)
+		err := unmarshalObj(rdir, &docinfo)
+		if err != nil {
+			return err
+		}
+		image_dir, _ := vval["image"].(string)
+		for _, sha := range strings.Split(docinfo.Layers, ":") {
+			status, ok := checked[sha]
+			if !ok {
+				status = verifyImageLayer(fmt.Sprintf("%s/%s", image_dir, sha), sha, docinfo.LayersMap[sha])
+				checked[sha] = status
+			}
+			if status != "OK" {
+				failed++
+			}
+			fmt.Println(fmt.Sprintf("%-40s%-70s%s", iname, sha, status))
+		}
+	}
+	if failed > 0 {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("%d layers are corrupted or missing, please use 'lpmx docker delete' and download or add the images again", failed))
+		return cerr
+	}
+	return nil
+}
+
+//verifyImageLayer checks layer tarball stored inside .docker/.image, which is named by its sha256 value
+func verifyImageLayer(tar_path string, sha string, size int64) string {
+	if !FileExist(tar_path) {
+		return "MISSING"
+	}
+	//size is not recorded by old versions of lpmx
+	if fsize, err := GetFileSize(tar_path); err != nil || (size > 0 && fsize != size) {
+		return "CORRUPTED(size mismatch)"
+	}
+	if VerifyLayer(tar_path, digest.NewDigestFromHex(string(digest.SHA256), sha), "") != nil {
+		return "CORRUPTED(digest mismatch)"
+	}
+	return "OK"
+}
+
+//DockerGC removes layer tarballs, extracted layers and workspaces which are not referenced by any image or container
+//layer tarballs and extracted layers modified within GC_GRACE_PERIOD are kept, they may belong to download or load in progress
+func DockerGC(dry_run bool) *Error {
+	currdir, _ := GetCurrDir()
+	var sys Sys
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	err := unmarshalObj(sysdir, &sys)
+	if err != nil {
+		if err.Err == ErrNExist {
+			err.AddMsg(fmt.Sprintf("%s does not exist, you may need to use 'lpmx init' firstly", sysdir))
+		}
+		return err
+	}
+	rootdir := fmt.Sprintf("%s/.docker", currdir)
+	var doc Docker
+	err = unmarshalObj(rootdir, &doc)
+	if err != nil {
+		if err.Err == ErrNExist {
+			return nil
+		}
+		return err
+	}
+
+	refs, err := layerRefs(&doc, &sys)
+	if err != nil {
+		return err
+	}
+	var garbage []string
+
+	//layer tarballs and partially downloaded ones
+	image_dir := fmt.Sprintf("%s/.image", doc.RootDir)
+	base_dir := fmt.Sprintf("%s/.base", doc.RootDir)
+	for _, dir := range []string{image_dir, base_dir} {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			if _, ok := refs[strings.TrimSuffix(entry.Name(), PARTIAL_SUFFIX)]; !ok || strings.HasSuffix(entry.Name(), PARTIAL_SUFFIX) {
+				if time.Since(entry.ModTime()) < GC_GRACE_PERIOD {
+					LOGGER.WithFields(logrus.Fields{
+						"path":  fmt.Sprintf("%s/%s", dir, entry.Name()),
+						"mtime": entry.ModTime(),
+					}).Debug("unreferenced layer is modified recently, skip it")
+					continue
+				}
+				garbage = append(garbage, fmt.Sprintf("%s/%s", dir, entry.Name()))
+			}
+		}
+	}
+
+	//workspaces of deleted images and containers
+	images := make(map[string]bool)
+	for _, v := range doc.Images {
+		if vval, ok := v.(map[string]interface{}); ok {
+			if rdir, rok := vval["rootdir"].(string); rok {
+				images[filepath.Clean(rdir)] = true
+			}
+		}
+	}
+	containers := make(map[string]bool)
+	for _, v := range sys.Containers {
+		if cmap, ok := v.(map[string]interface{}); ok {
+			if root, rok := cmap["RootPath"].(string); rok {
+				containers[filepath.Dir(filepath.Clean(root))] = true
+			}
+		}
+	}
+	filepath.Walk(doc.RootDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if p == image_dir || p == base_dir {
+			return filepath.SkipDir
+		}
+		//image folder always contains .info, which avoids treating repository named workspace as image folder
+		if info.Name() != "workspace" || !FileExist(filepath.Join(filepath.Dir(p), ".info")) {
+			return nil
+		}
+		if !images[filepath.Dir(p)] {
+			garbage = append(garbage, filepath.Dir(p))
+			return filepath.SkipDir
+		}
+		entries, _ := ioutil.ReadDir(p)
+		for _, entry := range entries {
+			if !containers[filepath.Join(p, entry.Name())] {
+				garbage = append(garbage, filepath.Join(p, entry.Name()))
+			}
+		}
+		return filepath.SkipDir
+	})
+
+	var total int64
+	for _, g := range garbage {
+		size := diskUsage(g)
+		total += size
+		if dry_run {
+			fmt.Println(fmt.Sprintf("would remove %s (%d bytes)", g, size))
+			continue
+		}
+		fmt.Println(fmt.Sprintf("removing %s (%d bytes)", g, size))
+		if rerr := forceRemoveAll(g); rerr != nil {
+			return rerr
+		}
+	}
+	if dry_run {
+		fmt.Println(fmt.Sprintf("%d bytes could be freed", total))
+	} else {
+		fmt.Println(fmt.Sprintf("%d bytes are freed", total))
+	}
+	return nil
+}
+
+//layerRefs returns the images and containers referencing each layer, the key is the sha256 value of layer
+//containers are checked by both their layers info and the layer symlinks inside their folders, so that broken containers still protect their layers
+func layerRefs(doc *Docker, sys *Sys) (map[string][]string, *Error) {
+	refs := make(map[string][]string)
+	for name, v := range doc.Images {
+		vval, ok := v.(map[string]interface{})
+		if !ok {
+			cerr := ErrNew(ErrType, "doc.Images type error")
+			return nil, cerr
+		}
+		layer_order, _ := vval["layer_order"].(string)
+		for _, layer := range strings.Split(layer_order, ":") {
+			if layer != "" {
+				refs[path.Base(layer)] = append(refs[path.Base(layer)], name)
+			}
+		}
+	}
+	for id, v := range sys.Containers {
+		cmap, ok := v.(map[string]interface{})
+		if !ok {
+			cerr := ErrNew(ErrType, "sys.Containers type error")
+			return nil, cerr
+		}
+		layers := make(map[string]bool)
+		if config_path, cok := cmap["ConfigPath"].(string); cok {
+			var con Container
+			if unmarshalObj(config_path, &con) == nil {
+				for _, layer := range strings.Split(con.Layers, ":") {
+					layers[layer] = true
+				}
+				//snapshots inside history are kept for rollback
+				for _, snapshot := range con.History {
+					for _, layer := range strings.Split(snapshot.Layers, ":") {
+						layers[layer] = true
+					}
+				}
+			}
+		}
+		if root, rok := cmap["RootPath"].(string); rok {
+			entries, _ := ioutil.ReadDir(filepath.Dir(root))
+			for _, entry := range entries {
+				if entry.Mode()&os.ModeSymlink != 0 {
+					layers[entry.Name()] = true
+				}
+			}
+		}
+		delete(layers, "rw")
+		delete(layers, "")
+		for layer := range layers {
+			refs[layer] = append(refs[layer], id)
+		}
+	}
+	return refs, nil
+}
+
+//diskUsage returns the total size of files inside p
+func diskUsage(p string) int64 {
+	var size int64
+	filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+//forceRemoveAll removes p, folders without write permission(common inside extracted layers) are made writable firstly
+func forceRemoveAll(p string) *Error {
+	filepath.Walk(p, func(fp string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && info.Mode().Perm()&0700 != 0700 {
+			os.Chmod(fp, info.Mode().Perm()|0700)
+		}
 		return nil
+	})
+	if err := os.RemoveAll(p); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not remove %s", p))
+		return cerr
+	}
+	return nil
+}
+
+//commitExclude returns patterns of paths left out of committed layer
+//they are the default ones, commit_exclude list inside setting.yml and the patterns inside .lpmxignore of rw layer
+func (con *Container) commitExclude() ([]string, *Error) {
+	excludes := append([]string{}, CACHE_FOLDER...)
+	excludes = append(excludes, COMMIT_EXCLUDE...)
+	excludes = append(excludes, "/"+LPMX_IGNORE)
+	if _, setting, err := LoadConfig(con.SettingPath); err == nil {
+		if patterns, ok := setting["commit_exclude"].([]interface{}); ok {
+			for _, pattern := range patterns {
+				excludes = append(excludes, fmt.Sprint(pattern))
+			}
+		}
+	}
+	ignore := fmt.Sprintf("%s/%s", con.RootPath, LPMX_IGNORE)
+	if FileExist(ignore) {
+		patterns, cerr := ReadIgnoreFile(ignore)
+		if cerr != nil {
+			return nil, cerr
+		}
+		excludes = append(excludes, patterns...)
+	}
+	return excludes, nil
+}
+
+//movePaths moves paths relative to src folder into the same places of dst folder
+func movePaths(src string, dst string, paths []string) *Error {
+	for _, p := range paths {
+		from := fmt.Sprintf("%s%s", src, p)
+		to := fmt.Sprintf("%s%s", dst, p)
+		if _, err := os.Lstat(from); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(to), os.FileMode(FOLDER_MODE)); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not make dir %s", filepath.Dir(to)))
+			return cerr
+		}
+		if err := os.Rename(from, to); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not rename(move): %s to %s", from, to))
+			return cerr
+		}
+	}
+	return nil
+}
+
+//restoreExcluded moves paths excluded from commit back into rw layer, the folder keeping them is inside workspace, which may have been moved
+func (con *Container) restoreExcluded(excluded []string) *Error {
+	exclude_dir := fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), COMMIT_EXCLUDE_FOLDER)
+	cerr := movePaths(exclude_dir, con.RootPath, excluded)
+	if cerr != nil {
+		return cerr
+	}
+	os.RemoveAll(exclude_dir)
+	return nil
+}
+
+//keepExcluded is deferred once excluded paths are moved out of rw layer, they are moved back into the current rw layer unless restored is set
+func (con *Container) keepExcluded(excluded []string, restored *bool) {
+	if *restored {
+		return
+	}
+	if cerr := con.restoreExcluded(excluded); cerr != nil {
+		LOGGER.WithFields(logrus.Fields{
+			"err":      cerr,
+			"rootpath": con.RootPath,
+		}).Error(fmt.Sprintf("could not move excluded paths back to rw layer, they are kept inside %s", COMMIT_EXCLUDE_FOLDER))
 	}
 }
 
-func DockerCommit(id, newname, newtag string) *Error {
+//CommitOptions controls how DockerCommit freezes rw layer
+type CommitOptions struct {
+	Compression string //compression of layer tarball, either gzip or zstd
+	//layer tarball only depends on the content of rw layer so that identical commits share the same layer
+	Reproducible bool
+	DryRun       bool //only paths excluded from the layer are printed
+	Message      string
+	Author       string //current user is recorded if it is empty
+}
+
+//DockerCommit freezes rw layer of container as the top layer of new image, the commit is recorded inside container history
+func DockerCommit(id, newname, newtag string, opts CommitOptions) *Error {
+	compression := opts.Compression
+	if compression != COMPRESSION_GZIP && compression != COMPRESSION_ZSTD {
+		cerr := ErrNew(ErrType, fmt.Sprintf("layer compression %s is not supported, should be either %s or %s", compression, COMPRESSION_GZIP, COMPRESSION_ZSTD))
+		return cerr
+	}
+	//new image is registered under its normalized name, and its folder is named in the same way as registerImage
+	ref, cerr := ParseReference(fmt.Sprintf("%s:%s", newname, newtag))
+	if cerr != nil {
+		return cerr
+	}
+	image_name := ref.String()
 	currdir, _ := GetCurrDir()
 	var sys Sys
 	//first check whether the container is running
 	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
 	err := unmarshalObj(rootdir, &sys)
 	if err == nil {
+		if id, err = resolveContainer(&sys, id); err != nil {
+			return err
+		}
 		if v, ok := sys.Containers[id]; ok {
 			if val, vok := v.(map[string]interface{}); vok {
 				config_path := val["ConfigPath"].(string)
@@ -896,56 +1914,26 @@ func DockerCommit(id, newname, newtag string) *Error {
 					if err != nil {
 						return err
 					}
-					if _, ok := doc.Images[fmt.Sprintf("%s:%s", newname, newtag)]; ok {
-						cerr := ErrNew(ErrExist, fmt.Sprintf("%s:%s already exists, please choose another name and tag", newname, newtag))
+					if _, ok := doc.Images[image_name]; ok {
+						cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists, please choose another name and tag", image_name))
 						return cerr
 					}
 
-					//step0: before taring rw layer, remove unecessary folders
-					for _, cache := range CACHE_FOLDER {
-						cache = fmt.Sprintf("%s%s", con.RootPath, cache)
-						if FolderExist(cache) {
-							RemoveAll(cache)
-						}
-					}
-					//moving /etc/group /etc/passwd /proc /tmp folder to temp folder
-					cache_temp_dir, _ := ioutil.TempDir("", "lpmx")
-					if FileExist(fmt.Sprintf("%s/etc/group", con.RootPath)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/group", con.RootPath), fmt.Sprintf("%s/etc/group", cache_temp_dir))
-						if cerr != nil {
-							return cerr
-						}
+					//step0: paths matching exclusion rules are left out of layer tarball and kept inside new rw layer
+					excludes, cerr := con.commitExclude()
+					if cerr != nil {
+						return cerr
 					}
-					if FileExist(fmt.Sprintf("%s/etc/passwd", con.RootPath)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/passwd", con.RootPath), fmt.Sprintf("%s/etc/passwd", cache_temp_dir))
-						if cerr != nil {
-							return cerr
-						}
+					excluded, cerr := ExcludedPaths(con.RootPath, excludes)
+					if cerr != nil {
+						return cerr
 					}
-					if FolderExist(fmt.Sprintf("%s/proc", con.RootPath)) {
-						cerr := Rename(fmt.Sprintf("%s/proc", con.RootPath), fmt.Sprintf("%s/proc", cache_temp_dir))
-						if cerr != nil {
-							return cerr
+					if opts.DryRun {
+						fmt.Println(fmt.Sprintf("paths excluded from the layer committed from container %s:", id))
+						for _, p := range excluded {
+							fmt.Println(p)
 						}
-					}
-					if FolderExist(fmt.Sprintf("%s/tmp", con.RootPath)) {
-						RemoveAll(fmt.Sprintf("%s/tmp", con.RootPath))
-					}
-					if FileExist(fmt.Sprintf("%s/.wh.tmp", con.RootPath)) {
-						RemoveFile(fmt.Sprintf("%s/.wh.tmp", con.RootPath))
-					}
-					//remove data symlink
-					if FolderExist(fmt.Sprintf("%s/lpmx", con.RootPath)) {
-						RemoveAll(fmt.Sprintf("%s/lpmx", con.RootPath))
-					}
-
-					//remove apt cache
-					if FolderExist(fmt.Sprintf("%s/var/lib/apt/lists", con.RootPath)) {
-						RemoveAll(fmt.Sprintf("%s/var/lib/apt/lists", con.RootPath))
-					}
-
-					if FolderExist(fmt.Sprintf("%s/var/lib/dpkg", con.RootPath)) {
-						RemoveAll(fmt.Sprintf("%s/var/lib/dpkg", con.RootPath))
+						return nil
 					}
 
 					//step 1: tar rw layer
@@ -957,17 +1945,37 @@ func DockerCommit(id, newname, newtag string) *Error {
 					}
 					fmt.Println("taring rw layers...")
 					//get temp dir
-					temp_dir, _ := ioutil.TempDir("", "lpmx")
-					cerr := TarLayer(con.RootPath, temp_dir, con.Id, layers_full_path)
+					temp_dir, terr := ioutil.TempDir("", "lpmx")
+					if terr != nil {
+						cerr := ErrNew(terr, "could not create temp dir")
+						return cerr
+					}
+					defer os.RemoveAll(temp_dir)
+					cerr = TarLayer(con.RootPath, temp_dir, con.Id, layers_full_path, TarOptions{Compression: compression, Deterministic: opts.Reproducible, Exclude: excludes})
 					if cerr != nil {
 						return cerr
 					}
 					//step 2: calculate shasum value and move it to image folder
-					rw_tar_path := fmt.Sprintf("%s/%s.tar.gz", temp_dir, con.Id)
+					rw_tar_path := fmt.Sprintf("%s/%s%s", temp_dir, con.Id, TarSuffix(compression))
 					shasum, serr := Sha256file(rw_tar_path)
 					if serr != nil {
 						return serr
 					}
+					//reproducible commit of unchanged rw layer produces the layer which container already has
+					for _, layer := range layers {
+						if layer == shasum {
+							cerr := ErrNew(ErrExist, fmt.Sprintf("nothing to commit, rw layer of container %s is the same as its layer %s", id, shasum))
+							return cerr
+						}
+					}
+					//moving excluded paths out so that frozen layer matches its tarball, they are moved back if any following step fails
+					exclude_dir := fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), COMMIT_EXCLUDE_FOLDER)
+					restored := false
+					defer con.keepExcluded(excluded, &restored)
+					cerr = movePaths(con.RootPath, exclude_dir, excluded)
+					if cerr != nil {
+						return cerr
+					}
 					//image dir is LPMX/.docker/.image
 					//moving layer tarball to image folder
 					fmt.Println("renaming rw layer...")
@@ -981,24 +1989,34 @@ func DockerCommit(id, newname, newtag string) *Error {
 					}
 
 					//moving rw layer to base folder
-					rerr = os.Rename(con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum))
-					if rerr != nil {
-						cerr := ErrNew(rerr, fmt.Sprintf("could not rename(move): %s to %s", con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)))
-						return cerr
+					//reproducible commit of the same content produces existing layer, which is shared rather than replaced
+					if FolderExist(fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)) {
+						cerr := forceRemoveAll(con.RootPath)
+						if cerr != nil {
+							return cerr
+						}
+					} else {
+						rerr = os.Rename(con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum))
+						if rerr != nil {
+							cerr := ErrNew(rerr, fmt.Sprintf("could not rename(move): %s to %s", con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)))
+							return cerr
+						}
 					}
 
-					//create new symlink
+					//create new symlink, which already exists if the same layer is committed again
 					new_symlink_path := fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), shasum)
 					old_symlink_path := fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)
-					rerr = os.Symlink(old_symlink_path, new_symlink_path)
-					if rerr != nil {
-						cerr := ErrNew(rerr, fmt.Sprintf("could not symlink: %s to %s", old_symlink_path, new_symlink_path))
-						return cerr
+					if _, lerr := os.Lstat(new_symlink_path); lerr != nil {
+						rerr = os.Symlink(old_symlink_path, new_symlink_path)
+						if rerr != nil {
+							cerr := ErrNew(rerr, fmt.Sprintf("could not symlink: %s to %s", old_symlink_path, new_symlink_path))
+							return cerr
+						}
 					}
 
 					//moving workspace and copyting setting.yml to new place
 					docker_path := filepath.Dir(con.BaseLayerPath)
-					new_workspace_path := fmt.Sprintf("%s/%s/%s/workspace", docker_path, newname, newtag)
+					new_workspace_path := fmt.Sprintf("%s/%s/%s/workspace", docker_path, ref.Name(), ref.Reference())
 					if !FolderExist(new_workspace_path) {
 						derr := os.MkdirAll(new_workspace_path, os.FileMode(FOLDER_MODE))
 						if derr != nil {
@@ -1013,17 +2031,17 @@ func DockerCommit(id, newname, newtag string) *Error {
 						cerr := ErrNew(rerr, fmt.Sprintf("could not rename(move): %s to %s", old_workspace_path, fmt.Sprintf("%s/%s", new_workspace_path, id)))
 						return cerr
 					}
+					con.RootPath = fmt.Sprintf("%s/%s/rw", new_workspace_path, id)
+					con.ConfigPath = fmt.Sprintf("%s/%s/.lpmx", new_workspace_path, id)
+					con.LogPath = fmt.Sprintf("%s/log", con.ConfigPath)
+					con.PatchedELFLoader = fmt.Sprintf("%s/%s/ld.so.patch", new_workspace_path, id)
 					//copy setting.yml rather than rename
 					new_setting_path := fmt.Sprintf("%s/setting.yml", filepath.Dir(new_workspace_path))
 					_, cerr = CopyFile(con.SettingPath, new_setting_path)
 					if cerr != nil {
 						return cerr
 					}
-					con.RootPath = fmt.Sprintf("%s/%s/rw", new_workspace_path, id)
 					con.SettingPath = new_setting_path
-					con.ConfigPath = fmt.Sprintf("%s/%s/.lpmx", new_workspace_path, id)
-					con.LogPath = fmt.Sprintf("%s/log", con.ConfigPath)
-					con.PatchedELFLoader = fmt.Sprintf("%s/%s/ld.so.patch", new_workspace_path, id)
 
 					//step 3: froze rw layer and create new rw layer
 					fmt.Println("cleaning up...")
@@ -1032,21 +2050,16 @@ func DockerCommit(id, newname, newtag string) *Error {
 						cerr := ErrNew(derr, fmt.Sprintf("could not make new folder: %s", con.RootPath))
 						return cerr
 					}
-					derr = os.Symlink(con.DataSyncFolder, fmt.Sprintf("%s/lpmx", con.RootPath))
-					if derr != nil {
-						cerr := ErrNew(derr, fmt.Sprintf("could not symlink, oldpath: %s, newpath: %s", con.DataSyncFolder, fmt.Sprintf("%s/lpmx", con.RootPath)))
+					//moving excluded paths back to new rw folder
+					cerr = con.restoreExcluded(excluded)
+					if cerr != nil {
 						return cerr
 					}
-					//moving folders back to new rw folder
-					if FileExist(fmt.Sprintf("%s/etc/group", cache_temp_dir)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/group", cache_temp_dir), fmt.Sprintf("%s/etc/group", con.RootPath))
-						if cerr != nil {
-							return cerr
-						}
-					}
-					if FileExist(fmt.Sprintf("%s/etc/passwd", cache_temp_dir)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/passwd", cache_temp_dir), fmt.Sprintf("%s/etc/passwd", con.RootPath))
-						if cerr != nil {
+					restored = true
+					if _, err := os.Lstat(fmt.Sprintf("%s/lpmx", con.RootPath)); err != nil {
+						derr = os.Symlink(con.DataSyncFolder, fmt.Sprintf("%s/lpmx", con.RootPath))
+						if derr != nil {
+							cerr := ErrNew(derr, fmt.Sprintf("could not symlink, oldpath: %s, newpath: %s", con.DataSyncFolder, fmt.Sprintf("%s/lpmx", con.RootPath)))
 							return cerr
 						}
 					}
@@ -1061,9 +2074,29 @@ func DockerCommit(id, newname, newtag string) *Error {
 					f.Close()
 
 					//step 4: modify container info
+					old_layers := con.Layers
 					new_layers := []string{"rw", shasum}
 					new_layers = append(new_layers, strings.Split(con.Layers, ":")[1:]...)
 					con.Layers = strings.Join(new_layers, ":")
+					old_imagebase := con.ImageBase
+					con.ImageBase = image_name
+					author := opts.Author
+					if author == "" {
+						if u, uerr := user.Current(); uerr == nil {
+							author = u.Username
+						}
+					}
+					con.History = append(con.History, Snapshot{
+						Layer:   shasum,
+						Layers:  con.Layers,
+						Parent:  old_layers,
+						From:    old_imagebase,
+						Image:   con.ImageBase,
+						Time:    time.Now().Format(time.RFC3339),
+						Message: opts.Message,
+						Author:  author,
+						Config:  &con.ImageConfig,
+					})
 
 					data, _ := StructMarshal(&con)
 					LOGGER.WithFields(logrus.Fields{
@@ -1073,8 +2106,6 @@ func DockerCommit(id, newname, newtag string) *Error {
 					if cerr != nil {
 						return cerr
 					}
-					old_imagebase := con.ImageBase
-					con.ImageBase = fmt.Sprintf("%s:%s", newname, newtag)
 					//update $/.lpmxsys/.info
 					con.appendToSys()
 					//end of updating container info
@@ -1083,7 +2114,7 @@ func DockerCommit(id, newname, newtag string) *Error {
 					//start updating image info
 					fmt.Println("updating image info...")
 					mdata := make(map[string]interface{})
-					mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", docker_path, newname, newtag)
+					mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", docker_path, ref.Name(), ref.Reference())
 					mdata["config"] = con.SettingPath
 					mdata["image"] = fmt.Sprintf("%s/.image", docker_path)
 					//get old layer map
@@ -1110,7 +2141,7 @@ func DockerCommit(id, newname, newtag string) *Error {
 					mdata["workspace"] = fmt.Sprintf("%s/workspace", mdata["rootdir"])
 					mdata["base"] = fmt.Sprintf("%s/.base", docker_path)
 
-					doc.Images[fmt.Sprintf("%s:%s", newname, newtag)] = mdata
+					doc.Images[image_name] = mdata
 					mddata, _ := StructMarshal(doc)
 					LOGGER.WithFields(logrus.Fields{
 						"doc": doc,
@@ -1122,7 +2153,7 @@ func DockerCommit(id, newname, newtag string) *Error {
 
 					//start adding docinfo
 					var docinfo DockerInfo
-					docinfo.Name = fmt.Sprintf("%s:%s", newname, newtag)
+					docinfo.Name = image_name
 					// layer_order is absolute path
 					docinfo.LayersMap = make(map[string]int64)
 					if mdata["layer"] != nil {
@@ -1137,6 +2168,18 @@ func DockerCommit(id, newname, newtag string) *Error {
 						layersorder[idx] = path.Base(l)
 					}
 					docinfo.Layers = strings.Join(layersorder, ":")
+					//new image inherits the config of old image, so that env and entrypoint still work
+					if map_interface, map_ok := image_map.(map[string]interface{}); map_ok {
+						var old_docinfo DockerInfo
+						if old_rootdir, rok := map_interface["rootdir"].(string); rok && unmarshalObj(old_rootdir, &old_docinfo) == nil {
+							docinfo.Config = old_docinfo.Config
+							docinfo.MediaTypes = old_docinfo.MediaTypes
+						}
+					}
+					if docinfo.MediaTypes == nil {
+						docinfo.MediaTypes = make(map[string]string)
+					}
+					docinfo.MediaTypes[shasum] = LayerMediaType(compression)
 
 					LOGGER.WithFields(logrus.Fields{
 						"docinfo": docinfo,
@@ -1148,27 +2191,1280 @@ func DockerCommit(id, newname, newtag string) *Error {
 					}
 					//end
 
-					return nil
-					//done
-				} else {
-					pid, _ := PidValue(pidfile)
-					cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't package layer, please stop it firstly", id, pid))
-					return cerr
-				}
+					return nil
+					//done
+				} else {
+					pid, _ := PidValue(pidfile)
+					cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't package layer, please stop it firstly", id, pid))
+					return cerr
+				}
+			}
+		} else {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id: %s doesn't exist", id))
+			return cerr
+		}
+		return nil
+	}
+	if err == ErrNExist {
+		err.AddMsg(fmt.Sprintf("%s does not exist", rootdir))
+	}
+	return err
+}
+
+//DockerSquash merges layers of image or container into one layer and registers the result as image name:tag
+//for container, its committed layers are merged and stopped container is rebased onto the new image, rw layer is kept untouched
+//name and tag default to the ones of source image with '-squashed' appended to tag
+func DockerSquash(target string, name string, tag string) *Error {
+	currdir, _ := GetCurrDir()
+	rootdir := fmt.Sprintf("%s/.docker", currdir)
+	var doc Docker
+	err := unmarshalObj(rootdir, &doc)
+	if err != nil {
+		return err
+	}
+	image_dir := fmt.Sprintf("%s/.image", doc.RootDir)
+
+	//layers are collected base layer first
+	var layers []string
+	var image string
+	var con *Container
+	if c, cerr := getContainer(target); cerr == nil {
+		con = c
+		pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
+		if pok, _ := PidIsActive(pidfile); pok {
+			pid, _ := PidValue(pidfile)
+			cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't squash, please stop it firstly", target, pid))
+			return cerr
+		}
+		con_layers := strings.Split(con.Layers, ":")[1:]
+		for idx := len(con_layers) - 1; idx >= 0; idx-- {
+			layers = append(layers, con_layers[idx])
+		}
+		image = con.ImageBase
+	} else if cerr.Err == ErrAmbiguous {
+		return cerr
+	} else {
+		iname, cerr := normalizeImageName(target)
+		if cerr != nil {
+			return cerr
+		}
+		image_map, ok := doc.Images[iname].(map[string]interface{})
+		if !ok {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s is neither a container id nor an image", target))
+			return cerr
+		}
+		layer_order, _ := image_map["layer_order"].(string)
+		for _, layer := range strings.Split(layer_order, ":") {
+			layers = append(layers, path.Base(layer))
+		}
+		image = iname
+	}
+	if len(layers) < 2 {
+		cerr := ErrNew(ErrType, fmt.Sprintf("%s has only %d layer, nothing to squash", target, len(layers)))
+		return cerr
+	}
+
+	//new image inherits config and setting of source image
+	var docinfo DockerInfo
+	setting := ""
+	if con != nil {
+		setting = con.SettingPath
+	}
+	if image_map, ok := doc.Images[image].(map[string]interface{}); ok {
+		var old_docinfo DockerInfo
+		if old_rootdir, rok := image_map["rootdir"].(string); rok && unmarshalObj(old_rootdir, &old_docinfo) == nil {
+			docinfo.Config = old_docinfo.Config
+			docinfo.Platform = old_docinfo.Platform
+		}
+		if setting == "" {
+			setting, _ = image_map["config"].(string)
+		}
+	}
+	if name == "" || tag == "" {
+		ref, cerr := ParseReference(image)
+		if cerr != nil {
+			return cerr
+		}
+		if name == "" {
+			name = ref.Name()
+		}
+		if tag == "" {
+			tag = fmt.Sprintf("%s-squashed", ref.Reference())
+		}
+	}
+	docinfo.Name, err = normalizeImageName(fmt.Sprintf("%s:%s", name, tag))
+	if err != nil {
+		return err
+	}
+	if _, ok := doc.Images[docinfo.Name]; ok {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists, please choose another name and tag", docinfo.Name))
+		return cerr
+	}
+
+	var tarballs []string
+	for _, layer := range layers {
+		tarball := fmt.Sprintf("%s/%s", image_dir, layer)
+		if !FileExist(tarball) {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("layer tarball %s does not exist", tarball))
+			return cerr
+		}
+		tarballs = append(tarballs, tarball)
+	}
+	fmt.Println(fmt.Sprintf("merging %d layers...", len(tarballs)))
+	temp_dir, terr := ioutil.TempDir("", "lpmx")
+	if terr != nil {
+		cerr := ErrNew(terr, "could not create temp dir")
+		return cerr
+	}
+	defer os.RemoveAll(temp_dir)
+	merged := fmt.Sprintf("%s/squash%s", temp_dir, TarSuffix(COMPRESSION_GZIP))
+	err = MergeLayers(tarballs, merged, COMPRESSION_GZIP)
+	if err != nil {
+		return err
+	}
+	shasum, err := Sha256file(merged)
+	if err != nil {
+		return err
+	}
+	size, err := GetFileSize(merged)
+	if err != nil {
+		return err
+	}
+	target_tar_path := fmt.Sprintf("%s/%s", image_dir, shasum)
+	if !FileExist(target_tar_path) {
+		_, err = CopyFile(merged, target_tar_path)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(fmt.Sprintf("adding image %s...", docinfo.Name))
+	docinfo.LayersMap = map[string]int64{shasum: size}
+	docinfo.MediaTypes = map[string]string{shasum: LayerMediaType(COMPRESSION_GZIP)}
+	docinfo.Layers = shasum
+	err = registerImage(&doc, &docinfo, setting)
+	if err != nil {
+		return err
+	}
+	if con == nil {
+		return nil
+	}
+
+	//rebase container onto squashed layer, the squash is recorded inside history so that it could be rolled back
+	//workspace of container stays inside the folder of its old image, which is therefore kept by DockerDelete
+	fmt.Println(fmt.Sprintf("rebasing container %s onto %s...", con.Id, docinfo.Name))
+	link := fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), shasum)
+	if _, lerr := os.Lstat(link); lerr != nil {
+		serr := os.Symlink(fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum), link)
+		if serr != nil {
+			cerr := ErrNew(serr, fmt.Sprintf("could not symlink: %s to %s", fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum), link))
+			return cerr
+		}
+	}
+	author := ""
+	if u, uerr := user.Current(); uerr == nil {
+		author = u.Username
+	}
+	con.History = append(con.History, Snapshot{
+		Layer:   shasum,
+		Layers:  fmt.Sprintf("rw:%s", shasum),
+		Parent:  con.Layers,
+		From:    con.ImageBase,
+		Image:   docinfo.Name,
+		Time:    time.Now().Format(time.RFC3339),
+		Message: fmt.Sprintf("squash %d layers", len(layers)),
+		Author:  author,
+		Config:  &con.ImageConfig,
+	})
+	con.Layers = fmt.Sprintf("rw:%s", shasum)
+	con.ImageBase = docinfo.Name
+	data, _ := StructMarshal(con)
+	err = WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
+	if err != nil {
+		return err
+	}
+	return con.appendToSys()
+}
+
+//Change is one path of container changed by rw layer, relative to the layers below
+type Change struct {
+	Kind string `json:"kind"` //A(added), C(changed) or D(deleted)
+	Path string `json:"path"`
+	Size int64  `json:"size"` //size of regular file inside rw layer, 0 for the others
+}
+
+//changes compares rw layer of container with the layers below, folders existing in both are not reported
+//paths matching excludes are left out, as they never end up in committed layers
+func (con *Container) changes(excludes []string) ([]Change, *Error) {
+	layers := strings.Split(con.Layers, ":")[1:]
+	lowerExist := func(rel string) bool {
+		if _, err := GuessPathContainer(con.BaseLayerPath, layers, rel, true); err == nil {
+			return true
+		}
+		_, err := GuessPathContainer(con.BaseLayerPath, layers, rel, false)
+		return err == nil
+	}
+
+	var changes []Change
+	err := filepath.Walk(con.RootPath, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == con.RootPath {
+			return nil
+		}
+		rel := strings.TrimPrefix(file, con.RootPath+"/")
+		if MatchExclude(excludes, rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		dir := filepath.Dir(rel)
+		if fi.Name() == WHITEOUT_OPAQUE {
+			//content of lower layers not written again inside rw layer is deleted
+			lowers, _ := GuessPathsContainer(con.BaseLayerPath, layers, dir, false)
+			deleted := make(map[string]bool)
+			for _, lower := range lowers {
+				entries, _ := ioutil.ReadDir(lower)
+				for _, entry := range entries {
+					name := entry.Name()
+					if strings.HasPrefix(name, WHITEOUT_PREFIX) || deleted[name] {
+						continue
+					}
+					if _, err := os.Lstat(filepath.Join(filepath.Dir(file), name)); err == nil {
+						continue
+					}
+					deleted[name] = true
+					changes = append(changes, Change{Kind: "D", Path: "/" + filepath.Join(dir, name)})
+				}
+			}
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), WHITEOUT_PREFIX) {
+			hidden := filepath.Join(dir, strings.TrimPrefix(fi.Name(), WHITEOUT_PREFIX))
+			if lowerExist(hidden) {
+				changes = append(changes, Change{Kind: "D", Path: "/" + hidden})
+			}
+			return nil
+		}
+
+		change := Change{Kind: "A", Path: "/" + rel}
+		if fi.Mode().IsRegular() {
+			change.Size = fi.Size()
+		}
+		if lowerExist(rel) {
+			if fi.IsDir() {
+				if _, err := GuessPathContainer(con.BaseLayerPath, layers, rel, false); err == nil {
+					return nil
+				}
+			}
+			change.Kind = "C"
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not walk rw layer %s", con.RootPath))
+		return nil, cerr
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+//Diff prints paths added(A), changed(C) and deleted(D) by container, paths excluded from commits are not shown
+//if size is true, the number of changes and the total size of added and changed files are printed as well
+func Diff(id string, json_output bool, size bool) *Error {
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	if !con.DockerBase {
+		cerr := ErrNew(ErrType, fmt.Sprintf("container %s is not based on docker image, it has no layers to compare with", id))
+		return cerr
+	}
+	excludes, err := con.commitExclude()
+	if err != nil {
+		return err
+	}
+	changes, err := con.changes(excludes)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	var total int64
+	for _, change := range changes {
+		counts[change.Kind] += 1
+		total += change.Size
+	}
+	if json_output {
+		result := map[string]interface{}{"changes": changes}
+		if changes == nil {
+			result["changes"] = []Change{}
+		}
+		if size {
+			result["summary"] = map[string]interface{}{
+				"added":   counts["A"],
+				"changed": counts["C"],
+				"deleted": counts["D"],
+				"size":    total,
+			}
+		}
+		data, jerr := json.MarshalIndent(result, "", "  ")
+		if jerr != nil {
+			cerr := ErrNew(jerr, "could not marshal changes of container")
+			return cerr
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	for _, change := range changes {
+		if size {
+			fmt.Println(fmt.Sprintf("%s %-80s%d", change.Kind, change.Path, change.Size))
+		} else {
+			fmt.Println(fmt.Sprintf("%s %s", change.Kind, change.Path))
+		}
+	}
+	if size {
+		fmt.Println(fmt.Sprintf("%d added, %d changed, %d deleted, %d bytes in total", counts["A"], counts["C"], counts["D"], total))
+	}
+	return nil
+}
+
+//layerView returns the folder containing layers of container and the layers from top to bottom, rw layer first
+func (con *Container) layerView() (string, []string) {
+	if !con.DockerBase {
+		return filepath.Dir(con.RootPath), []string{filepath.Base(con.RootPath)}
+	}
+	return filepath.Dir(con.RootPath), strings.Split(con.Layers, ":")
+}
+
+//splitContainerPath splits <id>:<path> into container id and path inside container
+func splitContainerPath(arg string) (string, string, bool) {
+	idx := strings.Index(arg, ":")
+	if idx <= 0 || strings.Contains(arg[:idx], "/") {
+		return "", "", false
+	}
+	return arg[:idx], arg[idx+1:], true
+}
+
+//Cp copies files between container and host, either src or dst should be <id>:<path>
+//paths inside container are read through its layers and written into its rw layer, container is not required to be running
+func Cp(src string, dst string) *Error {
+	src_id, src_path, src_ok := splitContainerPath(src)
+	dst_id, dst_path, dst_ok := splitContainerPath(dst)
+	if src_ok == dst_ok {
+		cerr := ErrNew(ErrType, fmt.Sprintf("either source or destination should be <id>:<path>, got %s and %s", src, dst))
+		return cerr
+	}
+	if src_ok {
+		con, err := getContainer(src_id)
+		if err != nil {
+			return err
+		}
+		return con.copyOut(src_path, dst)
+	}
+	con, err := getContainer(dst_id)
+	if err != nil {
+		return err
+	}
+	return con.copyIn(src, dst_path)
+}
+
+//copyOut copies path inside container to host, folders are merged from all layers
+func (con *Container) copyOut(in string, host string) *Error {
+	base, layers := con.layerView()
+	rel, err := LayerResolve(base, layers, in)
+	if err != nil {
+		return err
+	}
+	tpath, fi, err := LayerLstat(base, layers, rel)
+	if err != nil {
+		return err
+	}
+	if hfi, herr := os.Stat(host); herr == nil && hfi.IsDir() && rel != "" {
+		host = filepath.Join(host, filepath.Base(rel))
+	}
+
+	var copyTree func(rel string, tpath string, fi os.FileInfo, target string) *Error
+	copyTree = func(rel string, tpath string, fi os.FileInfo, target string) *Error {
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, fi.Mode().Perm()|0700); err != nil {
+				cerr := ErrNew(err, fmt.Sprintf("could not make dir %s", target))
+				return cerr
+			}
+			entries, err := LayerReadDir(base, layers, rel)
+			if err != nil {
+				return err
+			}
+			for name, entry := range entries {
+				efi, lerr := os.Lstat(entry)
+				if lerr != nil {
+					continue
+				}
+				err := copyTree(filepath.Join(rel, name), entry, efi, filepath.Join(target, name))
+				if err != nil {
+					return err
+				}
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, lerr := os.Readlink(tpath)
+			if lerr != nil {
+				cerr := ErrNew(lerr, fmt.Sprintf("could not read symlink %s", tpath))
+				return cerr
+			}
+			os.Remove(target)
+			if serr := os.Symlink(link, target); serr != nil {
+				cerr := ErrNew(serr, fmt.Sprintf("could not symlink: %s to %s", link, target))
+				return cerr
+			}
+		case fi.Mode().IsRegular():
+			return copyContent(tpath, target, fi.Mode().Perm())
+		default:
+			LOGGER.WithFields(logrus.Fields{
+				"path": "/" + rel,
+				"mode": fi.Mode(),
+			}).Warn("special file is not copied")
+		}
+		return nil
+	}
+	return copyTree(rel, tpath, fi, host)
+}
+
+//copyIn copies file or folder of host into rw layer of container, parent folders are created inside rw layer if they only exist in lower layers
+func (con *Container) copyIn(host string, in string) *Error {
+	host = filepath.Clean(host)
+	base, layers := con.layerView()
+	rel, err := LayerResolve(base, layers, in)
+	if err != nil {
+		return err
+	}
+	if _, fi, lerr := LayerLstat(base, layers, rel); lerr == nil && fi.IsDir() {
+		rel = filepath.Join(rel, filepath.Base(host))
+	}
+	if _, serr := os.Lstat(host); serr != nil {
+		cerr := ErrNew(serr, fmt.Sprintf("%s does not exist", host))
+		return cerr
+	}
+
+	werr := filepath.Walk(host, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		crel := filepath.Join(rel, strings.TrimPrefix(file, host))
+		target := filepath.Join(con.RootPath, crel)
+		if err := os.MkdirAll(filepath.Dir(target), os.FileMode(FOLDER_MODE)); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		}
+		//file written back is no longer deleted
+		os.Remove(filepath.Join(filepath.Dir(target), WHITEOUT_PREFIX+filepath.Base(target)))
+		if tfi, terr := os.Lstat(target); terr == nil && tfi.IsDir() {
+			return fmt.Errorf("%s is a folder inside container, could not be replaced by %s", "/"+crel, file)
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			if cerr := copyContent(file, target, fi.Mode().Perm()); cerr != nil {
+				return cerr
+			}
+		default:
+			LOGGER.WithFields(logrus.Fields{
+				"path": file,
+				"mode": fi.Mode(),
+			}).Warn("special file is not copied")
+		}
+		return nil
+	})
+	if werr != nil {
+		cerr := ErrNew(werr, fmt.Sprintf("could not copy %s into container %s", host, con.Id))
+		return cerr
+	}
+	return nil
+}
+
+//copyContent copies regular file src to dst with mode, existing dst is replaced
+func copyContent(src string, dst string, mode os.FileMode) *Error {
+	in, err := os.Open(src)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("can't open file %s", src))
+		return cerr
+	}
+	defer in.Close()
+	os.Remove(dst)
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("can't open file %s", dst))
+		return cerr
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not copy %s to %s", src, dst))
+		return cerr
+	}
+	os.Chmod(dst, mode)
+	return nil
+}
+
+//mergedView returns the folder containing layers and the layers from top to bottom of container or image
+//paths mapped by add_map of container are returned as well, target matching both container name and image is reported as ambiguous
+func mergedView(target string) (string, []string, map[string]string, *Error) {
+	currdir, _ := GetCurrDir()
+	var doc Docker
+	err := unmarshalObj(fmt.Sprintf("%s/.docker", currdir), &doc)
+	if err != nil && err.Err != ErrNExist {
+		return "", nil, nil, err
+	}
+	name, nerr := normalizeImageName(target)
+	image_map, image_ok := doc.Images[name].(map[string]interface{})
+	image_ok = image_ok && nerr == nil
+
+	if con, err := getContainer(target); err == nil {
+		//full container id is never taken as image name
+		if image_ok && con.Id != target {
+			cerr := ErrNew(ErrAmbiguous, fmt.Sprintf("%s refers to both container: %s and image: %s, please use container id or image name with tag instead", target, con.Id, name))
+			return "", nil, nil, cerr
+		}
+		base, layers := con.layerView()
+		return base, layers, con.addMaps(), nil
+	} else if err.Err == ErrAmbiguous {
+		return "", nil, nil, err
+	}
+	if image_ok {
+		base, _ := image_map["base"].(string)
+		layer_order, _ := image_map["layer_order"].(string)
+		var layers []string
+		order := strings.Split(layer_order, ":")
+		for idx := len(order) - 1; idx >= 0; idx-- {
+			layers = append(layers, path.Base(order[idx]))
+		}
+		return base, layers, nil, nil
+	}
+	cerr := ErrNew(ErrNExist, fmt.Sprintf("%s is neither a container id nor an image", target))
+	return "", nil, nil, cerr
+}
+
+//addMaps returns the entries of add_map inside setting.yml keyed by their paths inside container, values are the paths they are mapped to
+//mappings are applied by fakechroot only when container runs, so they are marked rather than resolved when browsing layers
+func (con *Container) addMaps() map[string]string {
+	setting := con.SettingConf
+	if _, conf, err := LoadConfig(con.SettingPath); err == nil {
+		setting = conf
+	}
+	maps := make(map[string]string)
+	items, _ := jsonValue(setting["add_map"]).([]interface{})
+	for _, item := range items {
+		entries, _ := item.(map[string]interface{})
+		for key, value := range entries {
+			var values []string
+			switch v := value.(type) {
+			case string:
+				values = append(values, v)
+			case []interface{}:
+				for _, e := range v {
+					values = append(values, fmt.Sprint(e))
+				}
+			}
+			key = strings.TrimLeft(key, "^$")
+			if strings.HasPrefix(key, con.RootPath+"/") {
+				key = strings.TrimPrefix(key, con.RootPath)
+			}
+			maps[strings.TrimPrefix(filepath.Clean("/"+key), "/")] = strings.Join(values, ";")
+		}
+	}
+	return maps
+}
+
+//mappedPath returns the paths rel inside container is mapped to
+func mappedPath(maps map[string]string, rel string) (string, bool) {
+	value, ok := maps[strings.TrimPrefix(filepath.Clean("/"+rel), "/")]
+	return value, ok
+}
+
+//mappedName appends the paths name is mapped to if rel is one of maps
+func mappedName(maps map[string]string, rel string, name string) string {
+	if value, ok := mappedPath(maps, rel); ok {
+		return fmt.Sprintf("%s (mapped: %s)", name, value)
+	}
+	return name
+}
+
+//layerName returns the layer providing tpath
+func layerName(base string, tpath string) string {
+	return strings.Split(strings.TrimPrefix(tpath, base+"/"), "/")[0]
+}
+
+//mergedLstat resolves path inside merged view, symlinks among parent folders are followed
+//the last element is followed as well if follow is true
+func mergedLstat(base string, layers []string, in string, follow bool) (string, string, os.FileInfo, *Error) {
+	rel := in
+	for hops := 0; ; hops++ {
+		var err *Error
+		rel, err = LayerResolve(base, layers, rel)
+		if err != nil {
+			return "", "", nil, err
+		}
+		tpath, fi, err := LayerLstat(base, layers, rel)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if !follow || fi.Mode()&os.ModeSymlink == 0 {
+			return rel, tpath, fi, nil
+		}
+		if hops >= 40 {
+			cerr := ErrNew(ErrType, fmt.Sprintf("too many levels of symbolic links while resolving %s", in))
+			return "", "", nil, cerr
+		}
+		link, lerr := os.Readlink(tpath)
+		if lerr != nil {
+			cerr := ErrNew(lerr, fmt.Sprintf("could not read symlink %s", tpath))
+			return "", "", nil, cerr
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join("/", filepath.Dir(rel), link)
+		}
+		rel = link
+	}
+}
+
+//Ls lists folder inside container or image with the layers providing its entries, without running container
+func Ls(target string, in string) *Error {
+	base, layers, maps, err := mergedView(target)
+	if err != nil {
+		return err
+	}
+	rel, tpath, fi, err := mergedLstat(base, layers, in, true)
+	if err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("%-14s%-14s%-70s%s", "MODE", "SIZE", "LAYER", "NAME"))
+	if !fi.IsDir() {
+		fmt.Println(fmt.Sprintf("%-14s%-14d%-70s%s", fi.Mode(), fi.Size(), layerName(base, tpath), mappedName(maps, rel, "/"+rel)))
+		return nil
+	}
+	entries, err := LayerReadDir(base, layers, rel)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		efi, lerr := os.Lstat(entries[name])
+		if lerr != nil {
+			continue
+		}
+		display := name
+		if efi.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(entries[name])
+			display = fmt.Sprintf("%s -> %s", name, link)
+		}
+		display = mappedName(maps, filepath.Join(rel, name), display)
+		fmt.Println(fmt.Sprintf("%-14s%-14d%-70s%s", efi.Mode(), efi.Size(), layerName(base, entries[name]), display))
+	}
+	return nil
+}
+
+//Cat prints file inside container or image to stdout, the layer providing it is logged with debug level
+func Cat(target string, in string) *Error {
+	base, layers, maps, err := mergedView(target)
+	if err != nil {
+		return err
+	}
+	rel, tpath, fi, err := mergedLstat(base, layers, in, true)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		cerr := ErrNew(ErrType, fmt.Sprintf("%s is not a regular file", in))
+		return cerr
+	}
+	LOGGER.WithFields(logrus.Fields{
+		"path":  in,
+		"layer": layerName(base, tpath),
+	}).Debug("Cat reads file from layer")
+	for _, p := range []string{in, rel} {
+		if value, ok := mappedPath(maps, p); ok {
+			LOGGER.WithFields(logrus.Fields{
+				"path": filepath.Clean("/" + p),
+				"map":  value,
+			}).Warn("path is mapped by add_map of setting.yml when container runs, file inside layers is printed")
+			break
+		}
+	}
+	f, ferr := os.Open(tpath)
+	if ferr != nil {
+		cerr := ErrNew(ferr, fmt.Sprintf("can't open file %s", tpath))
+		return cerr
+	}
+	defer f.Close()
+	if _, cperr := io.Copy(os.Stdout, f); cperr != nil {
+		cerr := ErrNew(cperr, fmt.Sprintf("could not read file %s", tpath))
+		return cerr
+	}
+	return nil
+}
+
+//Find walks folder inside container or image and prints the entries whose names match pattern, together with the layers providing them
+//ftype filters entries by type, f for regular files, d for folders and l for symlinks, empty means all
+func Find(target string, in string, pattern string, ftype string) *Error {
+	switch ftype {
+	case "", "f", "d", "l":
+	default:
+		cerr := ErrNew(ErrType, fmt.Sprintf("type %s is not supported, should be f, d or l", ftype))
+		return cerr
+	}
+	base, layers, maps, err := mergedView(target)
+	if err != nil {
+		return err
+	}
+	rel, tpath, fi, err := mergedLstat(base, layers, in, true)
+	if err != nil {
+		return err
+	}
+	match := func(rel string, fi os.FileInfo) bool {
+		if pattern != "" {
+			if ok, _ := filepath.Match(pattern, filepath.Base("/"+rel)); !ok {
+				return false
+			}
+		}
+		switch ftype {
+		case "f":
+			return fi.Mode().IsRegular()
+		case "d":
+			return fi.IsDir()
+		case "l":
+			return fi.Mode()&os.ModeSymlink != 0
+		}
+		return true
+	}
+
+	var walk func(rel string, tpath string, fi os.FileInfo) *Error
+	walk = func(rel string, tpath string, fi os.FileInfo) *Error {
+		if match(rel, fi) {
+			fmt.Println(fmt.Sprintf("%-70s%s", layerName(base, tpath), mappedName(maps, rel, "/"+rel)))
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		entries, err := LayerReadDir(base, layers, rel)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			efi, lerr := os.Lstat(entries[name])
+			if lerr != nil {
+				continue
+			}
+			if err := walk(filepath.Join(rel, name), entries[name], efi); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(rel, tpath, fi)
+}
+
+//Inspect returns the information of container or image kept by lpmx, either *ContainerInspect or *ImageInspect
+func Inspect(target string) (interface{}, *Error) {
+	currdir, _ := GetCurrDir()
+	var sys Sys
+	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	err := unmarshalObj(rootdir, &sys)
+	if err != nil {
+		if err.Err == ErrNExist {
+			err.AddMsg(fmt.Sprintf("%s does not exist, you may need to use 'lpmx init' firstly", rootdir))
+		}
+		return nil, err
+	}
+	if id, err := resolveContainer(&sys, target); err == nil {
+		con, err := getContainer(id)
+		if err != nil {
+			return nil, err
+		}
+		return con.inspect(&sys), nil
+	} else if err.Err == ErrAmbiguous {
+		return nil, err
+	}
+
+	var doc Docker
+	err = unmarshalObj(fmt.Sprintf("%s/.docker", currdir), &doc)
+	if err != nil && err.Err != ErrNExist {
+		return nil, err
+	}
+	if name, nerr := normalizeImageName(target); nerr == nil {
+		if image_map, ok := doc.Images[name].(map[string]interface{}); ok {
+			var docinfo DockerInfo
+			rdir, _ := image_map["rootdir"].(string)
+			if ierr := unmarshalObj(rdir, &docinfo); ierr != nil {
+				LOGGER.WithFields(logrus.Fields{
+					"image": name,
+					"err":   ierr,
+				}).Warn("could not read .info of image, it may be created by old versions of lpmx")
+			}
+			return inspectImage(name, image_map, &docinfo, &sys), nil
+		}
+	}
+	cerr := ErrNew(ErrNExist, fmt.Sprintf("%s is neither a container id nor an image", target))
+	return nil, cerr
+}
+
+func (con *Container) inspect(sys *Sys) *ContainerInspect {
+	info := &ContainerInspect{Type: "container", Id: con.Id, Name: con.ContainerName, User: con.ImageConfig.User}
+	info.Registry, _ = jsonValue(sys.Containers[con.Id]).(map[string]interface{})
+
+	config := *con
+	config.SettingConf, _ = jsonValue(con.SettingConf).(map[string]interface{})
+	info.Config = &config
+
+	base, layers := con.layerView()
+	for _, layer := range layers {
+		info.Layers = append(info.Layers, filepath.Join(base, layer))
+	}
+
+	//genEnv requires memcached server of container
+	if len(con.MemcachedServerList) > 0 {
+		env, err := con.genEnv()
+		if err == nil {
+			info.Env = env
+		} else {
+			LOGGER.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("could not generate env of container")
+		}
+	}
+
+	info.Privileges = []PrivilegeRecord{}
+	for _, program := range con.privilegePrograms() {
+		a_val, _ := getPrivilege(con.Id, program, sys.MemcachedPid, true)
+		d_val, _ := getPrivilege(con.Id, program, sys.MemcachedPid, false)
+		m_val, _ := getMap(con.Id, program, sys.MemcachedPid)
+		info.Privileges = append(info.Privileges, PrivilegeRecord{
+			Id:      con.Id,
+			Program: program,
+			Allow:   splitEntries(a_val),
+			Deny:    splitEntries(d_val),
+			Map:     splitEntries(m_val),
+		})
+	}
+
+	info.State = ContainerState{Status: "STOPPED", Processes: []int{}}
+	if pid, ok := containerRunning(filepath.Dir(con.RootPath), con.Id); ok {
+		info.State.Status = "RUNNING"
+		info.State.Pid = pid
+	}
+	if pids := con.processes(); len(pids) > 0 {
+		info.State.Processes = pids
+	}
+	return info
+}
+
+//privilegePrograms returns programs having allow_list, deny_list or add_map inside setting.yml, resolved in the same way as setProgPrivileges
+func (con *Container) privilegePrograms() []string {
+	seen := make(map[string]bool)
+	var programs []string
+	for _, key := range []string{"allow_list", "deny_list", "add_map"} {
+		items, _ := con.SettingConf[key].([]interface{})
+		for _, item := range items {
+			var names []string
+			switch m := item.(type) {
+			case map[interface{}]interface{}:
+				for k := range m {
+					if name, ok := k.(string); ok {
+						names = append(names, name)
+					}
+				}
+			case map[string]interface{}:
+				for k := range m {
+					names = append(names, k)
+				}
+			}
+			for _, name := range names {
+				if program, err := GuessPath(con.RootPath, name, true); err == nil {
+					name = program
+				}
+				if !seen[name] {
+					seen[name] = true
+					programs = append(programs, name)
+				}
+			}
+		}
+	}
+	sort.Strings(programs)
+	return programs
+}
+
+//inspectImage merges the entry of image inside .docker/.info with its DockerInfo and the containers created from it
+func inspectImage(name string, image_map map[string]interface{}, docinfo *DockerInfo, sys *Sys) *ImageInspect {
+	info := &ImageInspect{Type: "image", Name: name, Digest: docinfo.Digest, Platform: docinfo.Platform, Containers: []string{}}
+	info.Registry, _ = jsonValue(image_map).(map[string]interface{})
+	if len(docinfo.Config) > 0 && json.Valid(docinfo.Config) {
+		info.Config = json.RawMessage(docinfo.Config)
+	}
+
+	base, _ := image_map["base"].(string)
+	layer_order, _ := image_map["layer_order"].(string)
+	for _, tarball := range strings.Split(layer_order, ":") {
+		if tarball == "" {
+			continue
+		}
+		sha := path.Base(tarball)
+		info.Layers = append(info.Layers, ImageLayer{
+			Digest:  fmt.Sprintf("sha256:%s", sha),
+			Size:    docinfo.LayersMap[sha],
+			Tarball: tarball,
+			Path:    fmt.Sprintf("%s/%s", base, sha),
+		})
+	}
+
+	for id, v := range sys.Containers {
+		cmap, _ := v.(map[string]interface{})
+		image, _ := cmap["Image"].(string)
+		if image == "" {
+			continue
+		}
+		if image_name, err := normalizeImageName(image); err == nil && image_name == name {
+			info.Containers = append(info.Containers, id)
+		}
+	}
+	sort.Strings(info.Containers)
+	return info
+}
+
+//jsonValue converts maps decoded from yaml, whose keys are interface{}, so that value could be marshalled into json
+func jsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, val := range value {
+			m[fmt.Sprintf("%v", k)] = jsonValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, val := range value {
+			m[k] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(value))
+		for idx, val := range value {
+			l[idx] = jsonValue(val)
+		}
+		return l
+	}
+	return v
+}
+
+//resolveContainer returns the id of container referenced by ref, which is either full id, name or unique prefix of id
+//full id is preferred over name, and name over prefix
+func resolveContainer(sys *Sys, ref string) (string, *Error) {
+	if _, ok := sys.Containers[ref]; ok {
+		return ref, nil
+	}
+	var names, prefixes []string
+	if ref != "" {
+		for id, v := range sys.Containers {
+			cmap, _ := v.(map[string]interface{})
+			if name, _ := cmap["ContainerName"].(string); name == ref {
+				names = append(names, id)
+			}
+			if strings.HasPrefix(id, ref) {
+				prefixes = append(prefixes, id)
+			}
+		}
+	}
+	if len(names) > 1 {
+		sort.Strings(names)
+		cerr := ErrNew(ErrAmbiguous, fmt.Sprintf("name: %s is shared by containers: %s, please use id instead", ref, strings.Join(names, ", ")))
+		return "", cerr
+	}
+	if len(names) == 1 {
+		return names[0], nil
+	}
+	if len(prefixes) > 1 {
+		sort.Strings(prefixes)
+		cerr := ErrNew(ErrAmbiguous, fmt.Sprintf("id prefix: %s matches containers: %s, please use longer prefix", ref, strings.Join(prefixes, ", ")))
+		return "", cerr
+	}
+	if len(prefixes) == 1 {
+		return prefixes[0], nil
+	}
+	cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id or name: %s doesn't exist", ref))
+	return "", cerr
+}
+
+//checkContainerName checks that name could be given to container with id, it should not be taken by other containers as name or id
+//':' and '/' are not allowed as name is used in <name>:<path> of 'lpmx cp'
+func checkContainerName(sys *Sys, id string, name string) *Error {
+	if name == "" {
+		return nil
+	}
+	if strings.ContainsAny(name, ":/") {
+		cerr := ErrNew(ErrType, fmt.Sprintf("container name: %s should not contain ':' or '/'", name))
+		return cerr
+	}
+	for k, v := range sys.Containers {
+		if k == id {
+			continue
+		}
+		cmap, _ := v.(map[string]interface{})
+		if cname, _ := cmap["ContainerName"].(string); cname == name || k == name {
+			cerr := ErrNew(ErrExist, fmt.Sprintf("container name: %s is already used by container: %s", name, k))
+			return cerr
+		}
+	}
+	return nil
+}
+
+//RenameContainer changes the name of container referenced by id, name or unique prefix of id, running container can't be renamed
+func RenameContainer(ref string, name string) *Error {
+	currdir, _ := GetCurrDir()
+	var sys Sys
+	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	err := unmarshalObj(rootdir, &sys)
+	if err != nil {
+		if err.Err == ErrNExist {
+			err.AddMsg(fmt.Sprintf("%s does not exist, you may need to use 'lpmx init' firstly", rootdir))
+		}
+		return err
+	}
+	id, err := resolveContainer(&sys, ref)
+	if err != nil {
+		return err
+	}
+	err = checkContainerName(&sys, id, name)
+	if err != nil {
+		return err
+	}
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	//info of running container is written back when it exits, which would undo renaming
+	if pid, ok := containerRunning(filepath.Dir(con.RootPath), con.Id); ok {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't rename, please stop it firstly", id, pid))
+		return cerr
+	}
+	con.ContainerName = name
+	data, _ := StructMarshal(con)
+	err = WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
+	if err != nil {
+		return err
+	}
+
+	cmap, ok := sys.Containers[id].(map[string]interface{})
+	if !ok {
+		cerr := ErrNew(ErrType, fmt.Sprintf("sys.Containers type is not right, actual: %T, want: map[string]interface{}", sys.Containers[id]))
+		return cerr
+	}
+	cmap["ContainerName"] = name
+	data, _ = StructMarshal(&sys)
+	return WriteToFile(data, fmt.Sprintf("%s/.info", sys.RootDir))
+}
+
+//getContainer loads the info of container referenced by id, name or unique prefix of id
+func getContainer(id string) (*Container, *Error) {
+	currdir, _ := GetCurrDir()
+	var sys Sys
+	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	err := unmarshalObj(rootdir, &sys)
+	if err != nil {
+		if err.Err == ErrNExist {
+			err.AddMsg(fmt.Sprintf("%s does not exist, you may need to use 'lpmx init' firstly", rootdir))
+		}
+		return nil, err
+	}
+	id, err = resolveContainer(&sys, id)
+	if err != nil {
+		return nil, err
+	}
+	v := sys.Containers[id]
+	val, vok := v.(map[string]interface{})
+	if !vok {
+		cerr := ErrNew(ErrType, fmt.Sprintf("sys.Containers type is not right, actual: %T, want: map[string]interface{}", v))
+		return nil, cerr
+	}
+	config_path, _ := val["ConfigPath"].(string)
+	var con Container
+	err = unmarshalObj(config_path, &con)
+	if err != nil {
+		return nil, err
+	}
+	return &con, nil
+}
+
+//snapshotLayers returns the layers and image of container at step of its history
+//step 0 is the state before the first commit, step n is the state after the nth commit
+func snapshotLayers(history []Snapshot, step int) (string, string, *Error) {
+	if step < 0 || step > len(history) {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("step %d doesn't exist, should be between 0 and %d", step, len(history)))
+		return "", "", cerr
+	}
+	if step > 0 {
+		return history[step-1].Layers, history[step-1].Image, nil
+	}
+	return history[0].Parent, history[0].From, nil
+}
+
+//History prints the snapshots committed from container, the latest first
+func History(id string) *Error {
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("%-10s%-70s%-30s%-20s%s", "STEP", "LAYER", "TIME", "AUTHOR", "MESSAGE"))
+	for step := len(con.History); step > 0; step-- {
+		snapshot := con.History[step-1]
+		fmt.Println(fmt.Sprintf("%-10d%-70s%-30s%-20s%s", step, snapshot.Layer, snapshot.Time, snapshot.Author, snapshot.Message))
+	}
+	fmt.Println(fmt.Sprintf("%-10d%-70s%-30s%-20s%s", 0, "-", "-", "-", fmt.Sprintf("created from %s", creationImage(con))))
+	return nil
+}
+
+//creationImage returns the image container is created from
+func creationImage(con *Container) string {
+	if len(con.History) > 0 {
+		return con.History[0].From
+	}
+	return con.ImageBase
+}
+
+//Rollback restores layers of stopped container to the snapshot at step of its history, later snapshots are dropped
+//if keep is false, contents of rw layer are discarded except the paths excluded from commits
+func Rollback(id string, step int, keep bool) *Error {
+	con, err := getContainer(id)
+	if err != nil {
+		return err
+	}
+	pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
+	if pok, _ := PidIsActive(pidfile); pok {
+		pid, _ := PidValue(pidfile)
+		cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't rollback, please stop it firstly", id, pid))
+		return cerr
+	}
+	if step == len(con.History) && keep {
+		return nil
+	}
+	if len(con.History) == 0 {
+		if step != 0 {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("step %d doesn't exist, container %s has no commit history", step, id))
+			return cerr
+		}
+	} else {
+		layers, image, cerr := snapshotLayers(con.History, step)
+		if cerr != nil {
+			return cerr
+		}
+		//layers of snapshot may be removed together with images
+		for _, layer := range strings.Split(layers, ":")[1:] {
+			if !FolderExist(fmt.Sprintf("%s/%s", con.BaseLayerPath, layer)) {
+				cerr := ErrNew(ErrNExist, fmt.Sprintf("layer %s of step %d doesn't exist, can't rollback", layer, step))
+				return cerr
 			}
-		} else {
-			cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id: %s doesn't exist", id))
+			link := fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), layer)
+			if _, lerr := os.Lstat(link); lerr != nil {
+				os.Symlink(fmt.Sprintf("%s/%s", con.BaseLayerPath, layer), link)
+			}
+		}
+		//commits do not change image config, so the one recorded by the nearest snapshot is restored
+		snapshot := con.History[0]
+		if step > 0 {
+			snapshot = con.History[step-1]
+		}
+		if snapshot.Config != nil {
+			con.ImageConfig = *snapshot.Config
+		}
+		con.Layers = layers
+		con.ImageBase = image
+		con.History = con.History[:step]
+	}
+
+	if !keep {
+		cerr := con.resetRW()
+		if cerr != nil {
 			return cerr
 		}
-		return nil
 	}
-	if err == ErrNExist {
-		err.AddMsg(fmt.Sprintf("%s does not exist", rootdir))
+
+	data, _ := StructMarshal(con)
+	LOGGER.WithFields(logrus.Fields{
+		"con": con,
+	}).Debug("Rollback update container info")
+	cerr := WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
+	if cerr != nil {
+		return cerr
 	}
-	return err
+	return con.appendToSys()
+}
+
+//resetRW empties rw layer of container, paths excluded from commits are kept
+func (con *Container) resetRW() *Error {
+	excludes, cerr := con.commitExclude()
+	if cerr != nil {
+		return cerr
+	}
+	excluded, cerr := ExcludedPaths(con.RootPath, excludes)
+	if cerr != nil {
+		return cerr
+	}
+	exclude_dir := fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), COMMIT_EXCLUDE_FOLDER)
+	restored := false
+	defer con.keepExcluded(excluded, &restored)
+	cerr = movePaths(con.RootPath, exclude_dir, excluded)
+	if cerr != nil {
+		return cerr
+	}
+	cerr = forceRemoveAll(con.RootPath)
+	if cerr != nil {
+		return cerr
+	}
+	derr := os.Mkdir(con.RootPath, os.FileMode(FOLDER_MODE))
+	if derr != nil {
+		cerr := ErrNew(derr, fmt.Sprintf("could not make new folder: %s", con.RootPath))
+		return cerr
+	}
+	cerr = con.restoreExcluded(excluded)
+	if cerr != nil {
+		return cerr
+	}
+	restored = true
+	if _, err := os.Lstat(fmt.Sprintf("%s/lpmx", con.RootPath)); err != nil && con.DataSyncFolder != "" {
+		os.Symlink(con.DataSyncFolder, fmt.Sprintf("%s/lpmx", con.RootPath))
+	}
+	//create rw/proc/self/cwd to fake cwd
+	proc_self_path := fmt.Sprintf("%s/proc/self", con.RootPath)
+	os.MkdirAll(proc_self_path, os.FileMode(FOLDER_MODE))
+	os.Symlink("/", fmt.Sprintf("%s/cwd", proc_self_path))
+	os.Symlink("/", fmt.Sprintf("%s/exe", proc_self_path))
+	//create new tmp
+	os.MkdirAll(fmt.Sprintf("%s/tmp", con.RootPath), os.FileMode(FOLDER_MODE))
+	f, _ := os.Create(fmt.Sprintf("%s/.wh.tmp", con.RootPath))
+	f.Close()
+	return nil
 }
 
-func DockerDownload(name string, user string, pass string) *Error {
+func DockerDownload(name string, user string, pass string, platform string, parallel int) *Error {
 	currdir, _ := GetCurrDir()
 	rootdir := fmt.Sprintf("%s/.docker", currdir)
 	var doc Docker
@@ -1184,41 +3480,33 @@ func DockerDownload(name string, user string, pass string) *Error {
 			return err
 		}
 	}
-	if !strings.Contains(name, ":") {
-		name = name + ":latest"
+	ref, cerr := ParseReference(name)
+	if cerr != nil {
+		return cerr
+	}
+	plat, cerr := ParsePlatform(platform)
+	if cerr != nil {
+		return cerr
 	}
+	name = ref.String()
 	if _, ok := doc.Images[name]; ok {
 		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", name))
 		return cerr
 	} else {
-		//downloading image from github
-		tdata := strings.Split(name, ":")
-		tname := tdata[0]
-		ttag := tdata[1]
-		mdata := make(map[string]interface{})
-		mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", doc.RootDir, tname, ttag)
-		mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"].(string))
-		mdata["image"] = fmt.Sprintf("%s/.image", rootdir)
-		image_dir, _ := mdata["image"].(string)
-
-		//download layers
-		ret, layer_order, err := DownloadLayers(user, pass, tname, ttag, image_dir)
+		//downloading image from registry
+		image_dir := fmt.Sprintf("%s/.image", rootdir)
+
+		//download layers and image config, which contains env, entrypoint and cmd
+		ret, media_types, layer_order, man_digest, config_data, err := DownloadLayers(user, pass, ref, plat, image_dir, parallel)
 		if err != nil {
 			return err
 		}
-		mdata["layer"] = ret
-		mdata["layer_order"] = strings.Join(layer_order, ":")
 
-		//add docker info file(.info)
-		if !FolderExist(mdata["rootdir"].(string)) {
-			merr := os.MkdirAll(mdata["rootdir"].(string), os.FileMode(FOLDER_MODE))
-			if merr != nil {
-				cerr := ErrNew(merr, fmt.Sprintf("could not mkdir %s", mdata["rootdir"].(string)))
-				return cerr
-			}
-		}
 		var docinfo DockerInfo
 		docinfo.Name = name
+		docinfo.Digest = man_digest
+		docinfo.Platform = plat.String()
+		docinfo.Config = config_data
 		// layer_order is absolute path
 		//docinfo layers map should remove absolute path of host
 		layersmap := make(map[string]int64)
@@ -1226,6 +3514,10 @@ func DockerDownload(name string, user string, pass string) *Error {
 			layersmap[path.Base(k)] = v
 		}
 		docinfo.LayersMap = layersmap
+		docinfo.MediaTypes = make(map[string]string)
+		for k, v := range media_types {
+			docinfo.MediaTypes[path.Base(k)] = v
+		}
 
 		var layer_sha []string
 		for _, layer := range layer_order {
@@ -1233,74 +3525,25 @@ func DockerDownload(name string, user string, pass string) *Error {
 		}
 		docinfo.Layers = strings.Join(layer_sha, ":")
 
-		LOGGER.WithFields(logrus.Fields{
-			"docinfo": docinfo,
-		}).Debug("DockerDownload debug, docinfo debug")
-
-		dinfodata, _ := StructMarshal(docinfo)
-		err = WriteToFile(dinfodata, fmt.Sprintf("%s/.info", mdata["rootdir"].(string)))
-		if err != nil {
-			return err
-		}
-		//end
-
-		workspace := fmt.Sprintf("%s/workspace", mdata["rootdir"])
-		if !FolderExist(workspace) {
-			MakeDir(workspace)
-		}
-		mdata["workspace"] = workspace
-
-		//extract layers
-		base := fmt.Sprintf("%s/.base", rootdir)
-		if !FolderExist(base) {
-			MakeDir(base)
-		}
-		mdata["base"] = base
-
-		for _, k := range layer_order {
-			k = path.Base(k)
-			tar_path := fmt.Sprintf("%s/%s", image_dir, k)
-			layerfolder := fmt.Sprintf("%s/%s", mdata["base"], k)
-			if !FolderExist(layerfolder) {
-				MakeDir(layerfolder)
-			}
-
-			err := Untar(tar_path, layerfolder)
-			if err != nil {
-				return err
-			}
-		}
-
-		//download setting from github
-		rdir, _ := mdata["rootdir"].(string)
-		err = DownloadFilefromGithub(tname, ttag, "setting.yml", SETTING_URL, rdir)
-		if err != nil {
-			LOGGER.WithFields(logrus.Fields{
-				"err":    err,
-				"toPath": rdir,
-			}).Error("Download setting from github failure and could not rollback to default one")
-			return err
-		}
-
-		//add map to this image
-		doc.Images[name] = mdata
-
-		ddata, _ := StructMarshal(doc)
-		err = WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
-		if err != nil {
-			return err
-		}
-		return nil
+		return registerImage(&doc, &docinfo, "")
 	}
 }
 
-func DockerPush(user string, pass string, name string, tag string, id string) *Error {
+func DockerPush(username string, pass string, name string, tag string, id string) *Error {
+	ref, cerr := ParseReference(fmt.Sprintf("%s:%s", name, tag))
+	if cerr != nil {
+		return cerr
+	}
+	image_name := ref.String()
 	currdir, _ := GetCurrDir()
 	var sys Sys
 	//first check whether the container is running
 	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
 	err := unmarshalObj(rootdir, &sys)
 	if err == nil {
+		if id, err = resolveContainer(&sys, id); err != nil {
+			return err
+		}
 		if v, ok := sys.Containers[id]; ok {
 			if val, vok := v.(map[string]interface{}); vok {
 				config_path := val["ConfigPath"].(string)
@@ -1322,17 +3565,25 @@ func DockerPush(user string, pass string, name string, tag string, id string) *E
 						layers_full_path = append(layers_full_path, fmt.Sprintf("%s/%s", con.BaseLayerPath, layer))
 					}
 					fmt.Println("taring rw layers...")
-					cerr := TarLayer(con.RootPath, "/tmp", con.Id, layers_full_path)
+					excludes, cerr := con.commitExclude()
+					if cerr != nil {
+						return cerr
+					}
+					excluded, cerr := ExcludedPaths(con.RootPath, excludes)
+					if cerr != nil {
+						return cerr
+					}
+					cerr = TarLayer(con.RootPath, "/tmp", con.Id, layers_full_path, TarOptions{Compression: COMPRESSION_GZIP, Exclude: excludes})
 					if cerr != nil {
 						return cerr
 					}
 					//step 2: upload this tar ball to docker hub and backup inside lpmx
 					fmt.Println("uploading layers...")
-					shasum, cerr := UploadLayers(user, pass, name, tag, fmt.Sprintf("/tmp/%s.tar.gz", con.Id), con.ImageBase)
+					shasum, cerr := UploadLayers(username, pass, name, tag, fmt.Sprintf("/tmp/%s.tar.gz", con.Id), con.ImageBase)
 					if cerr != nil {
 						return cerr
 					}
-					image_dir := fmt.Sprintf("%s/image", filepath.Dir(con.BaseLayerPath))
+					image_dir := fmt.Sprintf("%s/.image", filepath.Dir(con.BaseLayerPath))
 					src_tar_path := fmt.Sprintf("/tmp/%s.tar.gz", con.Id)
 					target_tar_path := fmt.Sprintf("%s/%s", image_dir, shasum)
 					err := os.Rename(src_tar_path, target_tar_path)
@@ -1341,6 +3592,14 @@ func DockerPush(user string, pass string, name string, tag string, id string) *E
 						return cerr
 					}
 
+					//moving excluded paths out so that frozen layer matches the pushed tarball, they are moved back if any following step fails
+					exclude_dir := fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), COMMIT_EXCLUDE_FOLDER)
+					restored := false
+					defer con.keepExcluded(excluded, &restored)
+					cerr = movePaths(con.RootPath, exclude_dir, excluded)
+					if cerr != nil {
+						return cerr
+					}
 					err = os.Rename(con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum))
 					if err != nil {
 						cerr := ErrNew(err, fmt.Sprintf("could not rename(move): %s to %s", con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)))
@@ -1353,17 +3612,40 @@ func DockerPush(user string, pass string, name string, tag string, id string) *E
 						cerr := ErrNew(err, fmt.Sprintf("could not make new folder: %s", con.RootPath))
 						return cerr
 					}
+					//moving excluded paths back to new rw folder
+					cerr = con.restoreExcluded(excluded)
+					if cerr != nil {
+						return cerr
+					}
+					restored = true
 					//step 4: modify container info
 					new_layers := []string{"rw", shasum}
 					new_layers = append(new_layers, layers...)
+					//push is recorded inside history in the same way as commit, so that it could be rolled back
+					author := ""
+					if u, uerr := user.Current(); uerr == nil {
+						author = u.Username
+					}
+					con.History = append(con.History, Snapshot{
+						Layer:   shasum,
+						Layers:  strings.Join(new_layers, ":"),
+						Parent:  con.Layers,
+						From:    con.ImageBase,
+						Image:   image_name,
+						Time:    time.Now().Format(time.RFC3339),
+						Message: fmt.Sprintf("push %s", image_name),
+						Author:  author,
+						Config:  &con.ImageConfig,
+					})
 					con.Layers = strings.Join(new_layers, ":")
+					//pushed image becomes the base of container, named in the same way as images inside Docker.Images
+					con.ImageBase = image_name
 
 					data, _ := StructMarshal(&con)
 					cerr = WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
 					if cerr != nil {
 						return cerr
 					}
-					con.ImageBase = fmt.Sprintf("%s:%s", name, tag)
 					con.appendToSys()
 					//done
 				} else {
@@ -1384,27 +3666,47 @@ func DockerPush(user string, pass string, name string, tag string, id string) *E
 	return err
 }
 
-func DockerList() *Error {
+func DockerList() ([]ImageRecord, *Error) {
 	currdir, _ := GetCurrDir()
 	rootdir := fmt.Sprintf("%s/.docker", currdir)
 	var doc Docker
 	err := unmarshalObj(rootdir, &doc)
-	fmt.Println(fmt.Sprintf("%s", "Name"))
+	records := []ImageRecord{}
 	if err == nil {
-		for k, _ := range doc.Images {
-			fmt.Println(fmt.Sprintf("%s", k))
+		for k, v := range doc.Images {
+			record := ImageRecord{Name: k, Layers: []LayerRecord{}}
+			//images without .info are still listed by name
+			if vval, ok := v.(map[string]interface{}); ok {
+				var docinfo DockerInfo
+				rdir, _ := vval["rootdir"].(string)
+				if ierr := unmarshalObj(rdir, &docinfo); ierr == nil {
+					record.Digest = docinfo.Digest
+					record.Platform = docinfo.Platform
+					for _, sha := range strings.Split(docinfo.Layers, ":") {
+						if sha == "" {
+							continue
+						}
+						size := docinfo.LayersMap[sha]
+						record.Size += size
+						record.Layers = append(record.Layers, LayerRecord{Digest: fmt.Sprintf("sha256:%s", sha), Size: size})
+					}
+				}
+			}
+			records = append(records, record)
 		}
-		return nil
+		sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+		return records, nil
 	}
 	if err.Err != ErrNExist {
-		return err
+		return nil, err
 	}
-	return nil
+	return records, nil
 }
 
 func DockerReset(name string) *Error {
-	if !strings.Contains(name, ":") {
-		name = name + ":latest"
+	name, cerr := normalizeImageName(name)
+	if cerr != nil {
+		return cerr
 	}
 	currdir, _ := GetCurrDir()
 	rootdir := fmt.Sprintf("%s/.docker", currdir)
@@ -1414,6 +3716,11 @@ func DockerReset(name string) *Error {
 		if name_data, name_ok := doc.Images[name].(map[string]interface{}); name_ok {
 			image_dir, _ := name_data["image"].(string)
 			layer_order := name_data["layer_order"].(string)
+			//media types of layers are recorded inside docinfo, images added by old versions have none of them
+			var docinfo DockerInfo
+			if rdir, rok := name_data["rootdir"].(string); rok {
+				unmarshalObj(rdir, &docinfo)
+			}
 			for _, k := range strings.Split(layer_order, ":") {
 				k = path.Base(k)
 				tar_path := fmt.Sprintf("%s/%s", image_dir, k)
@@ -1430,7 +3737,7 @@ func DockerReset(name string) *Error {
 					MakeDir(layerfolder)
 				}
 
-				err := Untar(tar_path, layerfolder)
+				err := UntarLayer(tar_path, layerfolder, docinfo.MediaTypes[k])
 				if err != nil {
 					return err
 				}
@@ -1444,7 +3751,18 @@ func DockerReset(name string) *Error {
 }
 
 func DockerCreate(name string, container_name string) *Error {
+	name, cerr := normalizeImageName(name)
+	if cerr != nil {
+		return cerr
+	}
 	currdir, _ := GetCurrDir()
+	//container name should be unique as it is used for referencing container
+	var sys Sys
+	if err := unmarshalObj(fmt.Sprintf("%s/.lpmxsys", currdir), &sys); err == nil {
+		if err := checkContainerName(&sys, "", container_name); err != nil {
+			return err
+		}
+	}
 	rootdir := fmt.Sprintf("%s/.docker", currdir)
 	var doc Docker
 	err := unmarshalObj(rootdir, &doc)
@@ -1496,6 +3814,16 @@ func DockerCreate(name string, container_name string) *Error {
 				configmap["id"] = id
 				configmap["image"] = name
 				configmap["docker"] = true
+				//images downloaded by old versions of lpmx do not have config
+				var docinfo DockerInfo
+				rdir, _ := vval["rootdir"].(string)
+				if err := unmarshalObj(rdir, &docinfo); err == nil && len(docinfo.Config) > 0 {
+					ic, err := ParseImageConfig(docinfo.Config)
+					if err != nil {
+						return err
+					}
+					configmap["image_config"] = ic
+				}
 				LOGGER.WithFields(logrus.Fields{
 					"keys":   keys,
 					"layers": layers,
@@ -1646,7 +3974,20 @@ func DockerCreate(name string, container_name string) *Error {
 }
 
 func DockerDelete(name string) *Error {
+	name, cerr := normalizeImageName(name)
+	if cerr != nil {
+		return cerr
+	}
 	currdir, _ := GetCurrDir()
+	//workspace of container stays inside the folder of image it is created from, even after commit, rollback or squash changes its image
+	var image_dir string
+	var image_doc Docker
+	if derr := unmarshalObj(fmt.Sprintf("%s/.docker", currdir), &image_doc); derr == nil {
+		if vval, vok := image_doc.Images[name].(map[string]interface{}); vok {
+			image_dir, _ = vval["rootdir"].(string)
+		}
+	}
+
 	//check if there are containers assocated with current image
 	var sys Sys
 	rootdir := fmt.Sprintf("%s/.lpmxsys", currdir)
@@ -1667,6 +4008,10 @@ func DockerDelete(name string) *Error {
 					cerr := ErrNew(ErrOperation, fmt.Sprintf("container: %s still relies on image: %s", key, name))
 					return cerr
 				}
+				if image_dir != "" && (strings.HasPrefix(con.RootPath, image_dir+"/") || strings.HasPrefix(con.ConfigPath, image_dir+"/")) {
+					cerr := ErrNew(ErrOperation, fmt.Sprintf("workspace of container: %s is still inside image: %s, please destroy the container firstly", key, name))
+					return cerr
+				}
 			} else {
 				cerr := ErrNew(ErrType, "container type is not map[string]interface{}")
 				return cerr
@@ -1691,6 +4036,19 @@ func DockerDelete(name string) *Error {
 					if err != nil {
 						return err
 					}
+					//layers are shared, so they are only freed by 'lpmx docker gc'
+					if refs, rerr := layerRefs(&doc, &sys); rerr == nil {
+						unused := 0
+						layer_order, _ := vval["layer_order"].(string)
+						for _, layer := range strings.Split(layer_order, ":") {
+							if _, ok := refs[path.Base(layer)]; !ok {
+								unused++
+							}
+						}
+						if unused > 0 {
+							fmt.Println(fmt.Sprintf("%d layers of %s are not used any more, please use 'lpmx docker gc' to free disk space", unused, name))
+						}
+					}
 					return nil
 				} else {
 					return rerr
@@ -1710,6 +4068,9 @@ func Expose(id string, name string) *Error {
 	err := unmarshalObj(rootdir, &sys)
 
 	if err == nil {
+		if id, err = resolveContainer(&sys, id); err != nil {
+			return err
+		}
 		if v, ok := sys.Containers[id]; ok {
 			if val, vok := v.(map[string]interface{}); vok {
 				var con Container
@@ -1860,7 +4221,14 @@ func (con *Container) genEnv() (map[string]string, *Error) {
 	env["ContainerBasePath"] = con.BaseLayerPath
 	env["FAKECHROOT_ELFLOADER"] = con.PatchedELFLoader
 	env["PWD"] = "/"
+	if con.ImageConfig.WorkingDir != "" {
+		env["PWD"] = con.ImageConfig.WorkingDir
+	}
 	env["HOME"] = "/root"
+	//programs still run as fake root, USER only tells them the user declared by image
+	if user := con.ImageConfig.UserName(); user != "" {
+		env["USER"] = user
+	}
 	env["FAKED_MODE"] = "unknown-is-root"
 	//used for faking proc file
 	env["FAKECHROOT_EXCLUDE_PROC_PATH"] = "/proc/self/cwd:/proc/self/exe"
@@ -1873,6 +4241,32 @@ func (con *Container) genEnv() (map[string]string, *Error) {
 
 	//set default LD_LIBRARY_LPMX
 	var libs []string
+
+	//merge env from image config, variables used by lpmx itself can't be overridden
+	//LD_LIBRARY_PATH of image is translated and appended to LD_LIBRARY_LPMX instead
+	for _, e := range con.ImageConfig.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		if kv[0] == "LD_LIBRARY_PATH" {
+			for _, v := range strings.Split(kv[1], ":") {
+				lib_paths, err := GuessPathsContainer(filepath.Dir(con.RootPath), strings.Split(con.Layers, ":"), strings.TrimPrefix(v, "/"), false)
+				if err != nil {
+					continue
+				}
+				libs = append(libs, lib_paths...)
+			}
+			continue
+		}
+		if isReservedEnv(kv[0]) {
+			LOGGER.WithFields(logrus.Fields{
+				"env": e,
+			}).Debug("image env is ignored as it is reserved by lpmx")
+			continue
+		}
+		env[kv[0]] = kv[1]
+	}
 	//add libmemcached and other libs
 	currdir, _ := GetCurrDir()
 	libs = append(libs, fmt.Sprintf("%s/.lpmxsys", currdir))
@@ -2058,20 +4452,64 @@ func (con *Container) bashShell(args ...string) *Error {
 
 	if FolderExist(con.RootPath) {
 		//we need to start faked-sysv firstly
+		//ownership and device nodes recorded while extracting layers are loaded into faked
+		var fake_db []byte
+		for _, layer := range strings.Split(con.Layers, ":") {
+			if data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(con.RootPath), layer, FAKEROOT_DB)); err == nil {
+				fake_db = append(fake_db, data...)
+			}
+		}
 		faked_sysv := fmt.Sprintf("%s/faked-sysv", con.SysDir)
-		foutput, ferr := Command(faked_sysv)
+		var foutput string
+		var ferr *Error
+		if len(fake_db) > 0 {
+			foutput, ferr = CommandInput(fake_db, faked_sysv, "--load")
+		} else {
+			foutput, ferr = Command(faked_sysv)
+		}
 		if ferr != nil {
 			return ferr
 		}
 		faked_str := strings.Split(foutput, ":")
 		env["FAKEROOTKEY"] = faked_str[0]
+		//pid of faked-sysv is recorded so that 'lpmx stop' could clean it up if lpmx itself is killed
+		faked_pidfile := fmt.Sprintf("%s/faked.pid", filepath.Dir(con.RootPath))
+		WriteToFile([]byte(strings.TrimSpace(faked_str[1])), faked_pidfile)
 
 		defer func() {
 			fmt.Sprintf("cleanning up faked-sysv with pid: %s\n", faked_str[1])
 			KillProcessByPid(faked_str[1])
+			os.Remove(faked_pidfile)
 		}()
 
-		cerr := ShellEnvPid(con.UserShell, env, con.RootPath, args...)
+		//working dir of image is created inside rw layer if it does not exist
+		dir := con.RootPath
+		if con.ImageConfig.WorkingDir != "" {
+			wd := filepath.Join(con.RootPath, con.ImageConfig.WorkingDir)
+			if !FolderExist(wd) {
+				if err := os.MkdirAll(wd, os.FileMode(FOLDER_MODE)); err != nil {
+					cerr := ErrNew(err, fmt.Sprintf("could not mkdir working dir %s", wd))
+					return cerr
+				}
+			}
+			dir = wd
+		}
+		pidfile := fmt.Sprintf("%s/container.pid", filepath.Dir(con.RootPath))
+		//shell started by 'lpmx resume -d' writes its output into rotated log files
+		if os.Getenv(DETACH_ENV) != "" {
+			rlog, lerr := NewRotateLog(con.LogPath, CONTAINER_LOG)
+			if lerr != nil {
+				cerr := ErrNew(lerr, fmt.Sprintf("could not open log file inside %s", con.LogPath))
+				return cerr
+			}
+			defer rlog.Close()
+			stdout := rlog.Writer("stdout")
+			stderr := rlog.Writer("stderr")
+			defer stdout.Flush()
+			defer stderr.Flush()
+			return ShellEnvPidOutput(con.UserShell, env, dir, pidfile, nil, stdout, stderr, args...)
+		}
+		cerr := ShellEnvPid(con.UserShell, env, dir, pidfile, args...)
 		if cerr != nil {
 			return cerr
 		}
@@ -2551,6 +4989,186 @@ func walkfs(dir string) ([]string, *Error) {
 	return fileList, nil
 }
 
+//isReservedEnv checks whether env variable is set by lpmx and fakechroot, which should not be taken from image
+func isReservedEnv(key string) bool {
+	for _, r := range RESERVED_ENV {
+		if key == r {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, "FAKECHROOT_") || strings.HasPrefix(key, "FAKED_")
+}
+
+//registerImage extracts layers stored inside .docker/.image into .docker/.base, writes image info and adds image to Docker.Images
+//setting is the path of setting.yml copied to image folder, setting is downloaded from setting repository if it is empty
+//image folder and layers extracted by registerImage are removed if it fails, so that no half-registered image is left
+func registerImage(doc *Docker, docinfo *DockerInfo, setting string) *Error {
+	ref, cerr := ParseReference(docinfo.Name)
+	if cerr != nil {
+		return cerr
+	}
+	tname := ref.Name()
+	ttag := ref.Reference()
+	mdata := make(map[string]interface{})
+	mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", doc.RootDir, tname, ttag)
+	mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"].(string))
+	mdata["image"] = fmt.Sprintf("%s/.image", doc.RootDir)
+	image_dir, _ := mdata["image"].(string)
+
+	//here we have to restore absolute path
+	layersmap := make(map[string]int64)
+	for k, v := range docinfo.LayersMap {
+		layersmap[fmt.Sprintf("%s/%s", image_dir, k)] = v
+	}
+	var layer_order []string
+	for _, k := range strings.Split(docinfo.Layers, ":") {
+		layer_order = append(layer_order, fmt.Sprintf("%s/%s", image_dir, k))
+	}
+	mdata["layer"] = layersmap
+	mdata["layer_order"] = strings.Join(layer_order, ":")
+
+	//paths created here are removed once any step fails, layer folders existing before may be shared with other images and are kept
+	var created []string
+	rollback := func(err *Error) *Error {
+		for idx := len(created) - 1; idx >= 0; idx-- {
+			os.RemoveAll(created[idx])
+		}
+		delete(doc.Images, docinfo.Name)
+		return err
+	}
+
+	//add docker info file(.info)
+	rdir, _ := mdata["rootdir"].(string)
+	if !FolderExist(rdir) {
+		merr := os.MkdirAll(rdir, os.FileMode(FOLDER_MODE))
+		if merr != nil {
+			cerr := ErrNew(merr, fmt.Sprintf("could not mkdir %s", rdir))
+			return cerr
+		}
+		created = append(created, rdir)
+	}
+
+	LOGGER.WithFields(logrus.Fields{
+		"docinfo": docinfo,
+	}).Debug("registerImage debug, docinfo debug")
+
+	dinfodata, _ := StructMarshal(docinfo)
+	created = append(created, fmt.Sprintf("%s/.info", rdir))
+	err := WriteToFile(dinfodata, fmt.Sprintf("%s/.info", rdir))
+	if err != nil {
+		return rollback(err)
+	}
+	//end
+
+	workspace := fmt.Sprintf("%s/workspace", rdir)
+	if !FolderExist(workspace) {
+		MakeDir(workspace)
+		created = append(created, workspace)
+	}
+	mdata["workspace"] = workspace
+
+	//extract layers
+	base := fmt.Sprintf("%s/.base", doc.RootDir)
+	if !FolderExist(base) {
+		MakeDir(base)
+	}
+	mdata["base"] = base
+
+	for _, k := range strings.Split(docinfo.Layers, ":") {
+		tar_path := fmt.Sprintf("%s/%s", image_dir, k)
+		layerfolder := fmt.Sprintf("%s/%s", base, k)
+		if !FolderExist(layerfolder) {
+			MakeDir(layerfolder)
+			created = append(created, layerfolder)
+		}
+
+		err := UntarLayer(tar_path, layerfolder, docinfo.MediaTypes[k])
+		if err != nil {
+			return rollback(err)
+		}
+	}
+
+	created = append(created, mdata["config"].(string))
+	if setting != "" {
+		_, err = CopyFile(setting, mdata["config"].(string))
+		if err != nil {
+			return rollback(err)
+		}
+	} else {
+		//download setting from github
+		err = DownloadFilefromGithub(tname, ttag, "setting.yml", SETTING_URL, rdir)
+		if err != nil {
+			LOGGER.WithFields(logrus.Fields{
+				"err":    err,
+				"toPath": rdir,
+			}).Error("Download setting from github failure and could not rollback to default one")
+			return rollback(err)
+		}
+	}
+
+	//add map to this image
+	doc.Images[docinfo.Name] = mdata
+
+	ddata, _ := StructMarshal(doc)
+	err = WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
+	if err != nil {
+		return rollback(err)
+	}
+	return nil
+}
+
+//importLayer stores layer tarball inside image_dir named by its sha256 value, gzip and zstd tarballs are stored as they are while uncompressed tarball is gzipped firstly
+//compression is declared by media_type, or detected by magic bytes if media_type is empty, media type of the stored tarball is returned
+func importLayer(layer string, media_type string, image_dir string) (string, int64, string, *Error) {
+	comp := MediaTypeCompression(media_type)
+	if comp == "" {
+		var cerr *Error
+		comp, cerr = DetectCompression(layer)
+		if cerr != nil {
+			return "", 0, "", cerr
+		}
+		media_type = LayerMediaType(comp)
+	}
+	src := layer
+	switch comp {
+	case COMPRESSION_GZIP, COMPRESSION_ZSTD:
+	case COMPRESSION_NONE:
+		src = fmt.Sprintf("%s/.%s.tmp", image_dir, RandomString(IDLENGTH))
+		defer os.Remove(src)
+		cerr := GzipFile(layer, src)
+		if cerr != nil {
+			return "", 0, "", cerr
+		}
+		media_type = LayerMediaType(COMPRESSION_GZIP)
+	}
+
+	sha, cerr := Sha256file(src)
+	if cerr != nil {
+		return "", 0, "", cerr
+	}
+	size, cerr := GetFileSize(src)
+	if cerr != nil {
+		return "", 0, "", cerr
+	}
+	target := fmt.Sprintf("%s/%s", image_dir, sha)
+	if !FileExist(target) {
+		_, cerr := CopyFile(src, target)
+		if cerr != nil {
+			return "", 0, "", cerr
+		}
+	}
+	return sha, size, media_type, nil
+}
+
+//normalizeImageName converts user input like ubuntu or docker.io/library/ubuntu:latest to the key of Docker.Images
+func normalizeImageName(name string) (string, *Error) {
+	ref, err := ParseReference(name)
+	if err != nil {
+		return "", err
+	}
+	return ref.String(), nil
+}
+
 func unmarshalObj(rootdir string, inf interface{}) *Error {
 	info := fmt.Sprintf("%s/.info", rootdir)
 	if FileExist(info) {
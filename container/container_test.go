@@ -1,9 +1,20 @@
 package container
 
 import (
+	"encoding/json"
+	. "github.com/JasonYangShadow/lpmx/docker"
+	. "github.com/JasonYangShadow/lpmx/error"
 	. "github.com/JasonYangShadow/lpmx/msgpack"
+	. "github.com/JasonYangShadow/lpmx/pid"
 	. "github.com/JasonYangShadow/lpmx/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestContainerMarshal(t *testing.T) {
@@ -38,3 +49,909 @@ func TestUnmarshal(t *testing.T) {
 	}
 	t.Log(con)
 }
+
+func TestLayerRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//container whose info records layer sha2 and whose folder links layer sha3
+	workspace := filepath.Join(dir, "workspace", "id")
+	os.MkdirAll(filepath.Join(workspace, ".lpmx"), 0755)
+	os.Symlink(filepath.Join(dir, ".base", "sha3"), filepath.Join(workspace, "sha3"))
+	con := Container{Layers: "rw:sha2"}
+	data, _ := StructMarshal(&con)
+	WriteToFile(data, filepath.Join(workspace, ".lpmx", ".info"))
+
+	doc := Docker{Images: map[string]interface{}{
+		"ubuntu:latest": map[string]interface{}{"layer_order": "/lpmx/.docker/.image/sha1:/lpmx/.docker/.image/sha2"},
+	}}
+	sys := Sys{Containers: map[string]interface{}{
+		"id": map[string]interface{}{"ConfigPath": filepath.Join(workspace, ".lpmx"), "RootPath": filepath.Join(workspace, "rw")},
+	}}
+	refs, cerr := layerRefs(&doc, &sys)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(refs["sha1"]) != 1 || len(refs["sha2"]) != 2 || len(refs["sha3"]) != 1 {
+		t.Errorf("layer references are not counted correctly, got %v", refs)
+	}
+	if _, ok := refs["rw"]; ok {
+		t.Error("rw layer of container should not be counted")
+	}
+}
+
+func TestCommitExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	con := Container{
+		RootPath:    filepath.Join(dir, "rw"),
+		SettingPath: filepath.Join(dir, "setting.yml"),
+	}
+	if err := os.MkdirAll(filepath.Join(con.RootPath, "var/lib/dpkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(con.RootPath, "opt/build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(con.SettingPath, []byte("commit_exclude:\n  - /opt/build\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(con.RootPath, LPMX_IGNORE), []byte("# comment\n*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(con.RootPath, "opt/install.log"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	excludes, cerr := con.commitExclude()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	excluded, cerr := ExcludedPaths(con.RootPath, excludes)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	want := []string{"/" + LPMX_IGNORE, "/opt/build", "/opt/install.log"}
+	if len(excluded) != len(want) {
+		t.Fatalf("excluded paths should be %v, got %v", want, excluded)
+	}
+	for idx := range want {
+		if excluded[idx] != want[idx] {
+			t.Errorf("excluded paths should be %v, got %v", want, excluded)
+		}
+	}
+}
+
+func TestSnapshotLayers(t *testing.T) {
+	history := []Snapshot{
+		{Layer: "sha3", Layers: "rw:sha3:sha2:sha1", Parent: "rw:sha2:sha1", From: "ubuntu:18.04", Image: "ubuntu:pip"},
+		{Layer: "sha4", Layers: "rw:sha4:sha3:sha2:sha1", Parent: "rw:sha3:sha2:sha1", From: "ubuntu:pip", Image: "ubuntu:numpy"},
+	}
+	cases := []struct {
+		step   int
+		layers string
+		image  string
+	}{
+		{0, "rw:sha2:sha1", "ubuntu:18.04"},
+		{1, "rw:sha3:sha2:sha1", "ubuntu:pip"},
+		{2, "rw:sha4:sha3:sha2:sha1", "ubuntu:numpy"},
+	}
+	for _, c := range cases {
+		layers, image, err := snapshotLayers(history, c.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if layers != c.layers || image != c.image {
+			t.Errorf("step %d should be %s of %s, got %s of %s", c.step, c.layers, c.image, layers, image)
+		}
+	}
+	if _, _, err := snapshotLayers(history, 3); err == nil {
+		t.Error("step 3 should not exist")
+	}
+}
+
+func TestChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	con := Container{
+		RootPath:      filepath.Join(dir, "rw"),
+		BaseLayerPath: filepath.Join(dir, ".base"),
+		Layers:        "rw:sha2:sha1",
+	}
+	files := []string{
+		".base/sha1/etc/passwd", ".base/sha1/etc/hosts", ".base/sha1/opt/old/file", ".base/sha2/usr/bin/python",
+		"rw/etc/hosts", "rw/etc/.wh.passwd", "rw/etc/.wh.nothing", "rw/opt/.wh..wh..opq", "rw/usr/bin/pip", "rw/tmp/cache",
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, cerr := con.changes([]string{"/tmp"})
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	want := []Change{
+		{Kind: "C", Path: "/etc/hosts", Size: 7},
+		{Kind: "D", Path: "/etc/passwd"},
+		{Kind: "D", Path: "/opt/old"},
+		{Kind: "A", Path: "/usr/bin/pip", Size: 7},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes should be %v, got %v", want, changes)
+	}
+	for idx := range want {
+		if changes[idx] != want[idx] {
+			t.Errorf("changes should be %v, got %v", want, changes)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	con := Container{
+		Id:         "test",
+		RootPath:   filepath.Join(dir, "workspace", "rw"),
+		Layers:     "rw:sha1",
+		DockerBase: true,
+	}
+	for _, file := range []string{"workspace/sha1/etc/hosts", "workspace/sha1/etc/passwd", "workspace/rw/etc/.wh.passwd", "host/data/input.txt"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//folder is merged from layers
+	out := filepath.Join(dir, "out")
+	if cerr := con.copyOut("/etc", out); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(out, "hosts")); err != nil || string(data) != "workspace/sha1/etc/hosts" {
+		t.Errorf("hosts should be copied out of lower layer, got %s, %v", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(out, "passwd")); err == nil {
+		t.Error("deleted passwd should not be copied out")
+	}
+
+	//files are written into rw layer and parent folders are created
+	if cerr := con.copyIn(filepath.Join(dir, "host/data"), "/opt"); cerr != nil {
+		t.Fatal(cerr)
+	}
+	fi, err := os.Stat(filepath.Join(con.RootPath, "opt/input.txt"))
+	if err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("input.txt should be copied into rw layer with its mode, got %v, %v", fi, err)
+	}
+	if cerr := con.copyIn(filepath.Join(dir, "host/data/input.txt"), "/etc/passwd"); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if _, err := os.Lstat(filepath.Join(con.RootPath, "etc/.wh.passwd")); err == nil {
+		t.Error("whiteout should be removed when file is copied back")
+	}
+}
+
+func TestMergedLstat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sha1/usr/lib/libc.so.6")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("libc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "rw/usr/lib"), 0755)
+	os.Symlink("usr/lib", filepath.Join(dir, "sha1/lib"))
+	os.Symlink("libc.so.6", filepath.Join(dir, "rw/usr/lib/libc.so"))
+	layers := []string{"rw", "sha1"}
+
+	rel, tpath, _, cerr := mergedLstat(dir, layers, "/lib/libc.so", true)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if rel != "usr/lib/libc.so.6" || layerName(dir, tpath) != "sha1" {
+		t.Errorf("/lib/libc.so should resolve to usr/lib/libc.so.6 of sha1, got %s of %s", rel, layerName(dir, tpath))
+	}
+	rel, tpath, fi, cerr := mergedLstat(dir, layers, "/lib/libc.so", false)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if rel != "usr/lib/libc.so" || layerName(dir, tpath) != "rw" || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("/lib/libc.so should be the symlink inside rw, got %s of %s", rel, layerName(dir, tpath))
+	}
+}
+
+func TestGenEnvUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	con := &Container{
+		Id:                  "c1",
+		RootPath:            filepath.Join(dir, "rw"),
+		Layers:              "rw",
+		MemcachedServerList: []string{filepath.Join(dir, "memcached.sock")},
+	}
+	for user, want := range map[string]string{"app:staff": "app", "1000": "", "": ""} {
+		con.ImageConfig = ImageConfig{User: user}
+		env, cerr := con.genEnv()
+		if cerr != nil {
+			t.Fatal(cerr)
+		}
+		if env["USER"] != want {
+			t.Errorf("USER of image user %q should be %q, got %q", user, want, env["USER"])
+		}
+	}
+	//env declared by image still takes precedence
+	con.ImageConfig = ImageConfig{User: "app", Env: []string{"USER=other"}}
+	env, cerr := con.genEnv()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if env["USER"] != "other" {
+		t.Errorf("USER declared by image env should be kept, got %q", env["USER"])
+	}
+	if info := con.inspect(&Sys{}); info.User != "app" {
+		t.Errorf("user of container should be shown by inspect, got %q", info.User)
+	}
+}
+
+func TestInspectImage(t *testing.T) {
+	image_map := map[string]interface{}{
+		"rootdir":     "/lpmx/.docker/library/ubuntu/16.04",
+		"image":       "/lpmx/.docker/.image",
+		"base":        "/lpmx/.docker/.base",
+		"layer_order": "/lpmx/.docker/.image/sha1:/lpmx/.docker/.image/sha2",
+		"layer":       map[string]interface{}{"/lpmx/.docker/.image/sha1": int64(10)},
+	}
+	docinfo := DockerInfo{
+		Name:      "library/ubuntu:16.04",
+		LayersMap: map[string]int64{"sha1": 10, "sha2": 20},
+		Layers:    "sha1:sha2",
+		Digest:    "sha256:manifest",
+		Config:    []byte(`{"architecture":"amd64"}`),
+	}
+	sys := Sys{Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"Image": "ubuntu:16.04"},
+		"c2": map[string]interface{}{"Image": "centos:7"},
+		"c3": map[string]interface{}{},
+	}}
+	name, cerr := normalizeImageName("ubuntu:16.04")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	info := inspectImage(name, image_map, &docinfo, &sys)
+	if len(info.Layers) != 2 || info.Layers[0].Digest != "sha256:sha1" || info.Layers[1].Size != 20 || info.Layers[1].Path != "/lpmx/.docker/.base/sha2" || info.Layers[1].Tarball != "/lpmx/.docker/.image/sha2" {
+		t.Errorf("layers of image are not right, got %+v", info.Layers)
+	}
+	if len(info.Containers) != 1 || info.Containers[0] != "c1" {
+		t.Errorf("only c1 is created from image, got %v", info.Containers)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"config":{"architecture":"amd64"}`) {
+		t.Errorf("image config should be embedded as json, got %s", data)
+	}
+
+	//maps decoded from setting.yml have interface{} keys
+	setting := map[string]interface{}{"allow_list": []interface{}{map[interface{}]interface{}{"$/bin/ls": "/tmp"}}}
+	if _, err := json.Marshal(jsonValue(setting)); err != nil {
+		t.Errorf("converted setting should be marshalled into json, got %v", err)
+	}
+	con := Container{RootPath: "/tmp", SettingConf: setting}
+	if programs := con.privilegePrograms(); len(programs) != 1 || programs[0] != "/bin/ls" {
+		t.Errorf("program of allow_list is not found, got %v", programs)
+	}
+}
+
+func TestResolveContainer(t *testing.T) {
+	sys := Sys{Containers: map[string]interface{}{
+		"abc1234567": map[string]interface{}{"ContainerName": "web"},
+		"abd7654321": map[string]interface{}{"ContainerName": "db"},
+		"xyz0000000": map[string]interface{}{"ContainerName": "abc1234567"},
+		"qqq1111111": map[string]interface{}{"ContainerName": "dup"},
+		"qqq2222222": map[string]interface{}{"ContainerName": "dup"},
+	}}
+
+	cases := map[string]string{
+		"abc1234567": "abc1234567", //full id is preferred over name
+		"web":        "abc1234567",
+		"abd":        "abd7654321",
+		"xyz":        "xyz0000000",
+	}
+	for ref, id := range cases {
+		if got, cerr := resolveContainer(&sys, ref); cerr != nil || got != id {
+			t.Errorf("%s should be resolved into %s, got %s, %v", ref, id, got, cerr)
+		}
+	}
+	for _, ref := range []string{"ab", "dup", "qqq"} {
+		if _, cerr := resolveContainer(&sys, ref); cerr == nil || cerr.Err != ErrAmbiguous {
+			t.Errorf("%s should be ambiguous, got %v", ref, cerr)
+		}
+	}
+	for _, ref := range []string{"", "none"} {
+		if _, cerr := resolveContainer(&sys, ref); cerr == nil || cerr.Err != ErrNExist {
+			t.Errorf("%s should not exist, got %v", ref, cerr)
+		}
+	}
+
+	if cerr := checkContainerName(&sys, "", "web"); cerr == nil {
+		t.Error("name used by other container should be rejected")
+	}
+	if cerr := checkContainerName(&sys, "", "abd7654321"); cerr == nil {
+		t.Error("name equal to id of other container should be rejected")
+	}
+	if cerr := checkContainerName(&sys, "", "a:b"); cerr == nil {
+		t.Error("name containing ':' should be rejected")
+	}
+	if cerr := checkContainerName(&sys, "abc1234567", "web"); cerr != nil {
+		t.Errorf("container could keep its own name, got %v", cerr)
+	}
+}
+
+//fakeLpmx makes a temporary folder the current directory of lpmx, which is located by GetCurrDir
+func fakeLpmx(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err := ioutil.WriteFile(filepath.Join(dir, "lpmx"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func writeInfo(t *testing.T, folder string, obj interface{}) {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := StructMarshal(obj)
+	if cerr := WriteToFile(data, filepath.Join(folder, ".info")); cerr != nil {
+		t.Fatal(cerr)
+	}
+}
+
+func TestRollbackDelete(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	old_image, _ := normalizeImageName("ubuntu:18.04")
+	new_image, _ := normalizeImageName("ubuntu:pip")
+	docker_dir := filepath.Join(dir, ".docker")
+	new_dir := filepath.Join(docker_dir, "ubuntu", "pip")
+	base := filepath.Join(docker_dir, ".base")
+	for _, layer := range []string{"sha1", "sha2"} {
+		os.MkdirAll(filepath.Join(base, layer), 0755)
+	}
+	writeInfo(t, docker_dir, Docker{RootDir: docker_dir, Images: map[string]interface{}{
+		old_image: map[string]interface{}{"rootdir": filepath.Join(docker_dir, "ubuntu", "18.04")},
+		new_image: map[string]interface{}{"rootdir": new_dir},
+	}})
+
+	//container committed into ubuntu:pip has its workspace moved there
+	workspace := filepath.Join(new_dir, "workspace", "c1")
+	os.MkdirAll(filepath.Join(workspace, "rw"), 0755)
+	old_config := ImageConfig{Env: []string{"A=old"}}
+	con := Container{
+		Id:            "c1",
+		RootPath:      filepath.Join(workspace, "rw"),
+		ConfigPath:    filepath.Join(workspace, ".lpmx"),
+		BaseLayerPath: base,
+		DockerBase:    true,
+		Layers:        "rw:sha2:sha1",
+		ImageBase:     new_image,
+		ImageConfig:   ImageConfig{Env: []string{"A=new"}},
+		History:       []Snapshot{{Layer: "sha2", Layers: "rw:sha2:sha1", Parent: "rw:sha1", From: old_image, Image: new_image, Config: &old_config}},
+	}
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath, "Image": new_image},
+	}})
+
+	if cerr := Rollback("c1", 0, true); cerr != nil {
+		t.Fatal(cerr)
+	}
+	rolled, cerr := getContainer("c1")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if rolled.ImageBase != old_image || rolled.Layers != "rw:sha1" || len(rolled.ImageConfig.Env) != 1 || rolled.ImageConfig.Env[0] != "A=old" {
+		t.Errorf("container should be rolled back to %s with its config, got %s, %s, %v", old_image, rolled.ImageBase, rolled.Layers, rolled.ImageConfig)
+	}
+
+	if cerr := DockerDelete("ubuntu:pip"); cerr == nil || cerr.Err != ErrOperation {
+		t.Errorf("image keeping workspace of container should not be deleted, got %v", cerr)
+	}
+	if !FolderExist(con.RootPath) {
+		t.Error("rw layer of rolled back container is removed")
+	}
+}
+
+func TestSquashDelete(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	old_image, _ := normalizeImageName("ubuntu:18.04")
+	squashed, _ := normalizeImageName("ubuntu:18.04-squashed")
+	docker_dir := filepath.Join(dir, ".docker")
+	old_dir := filepath.Join(docker_dir, "ubuntu", "18.04")
+	writeInfo(t, docker_dir, Docker{RootDir: docker_dir, Images: map[string]interface{}{
+		old_image: map[string]interface{}{"rootdir": old_dir},
+		squashed:  map[string]interface{}{"rootdir": filepath.Join(docker_dir, "ubuntu", "18.04-squashed")},
+	}})
+
+	//container squashed in place is rebased onto the squashed image, its workspace stays with the old one
+	workspace := filepath.Join(old_dir, "workspace", "c1")
+	con := Container{
+		Id:         "c1",
+		RootPath:   filepath.Join(workspace, "rw"),
+		ConfigPath: filepath.Join(workspace, ".lpmx"),
+		DockerBase: true,
+		Layers:     "rw:sha3",
+		ImageBase:  squashed,
+	}
+	os.MkdirAll(con.RootPath, 0755)
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath, "Image": squashed},
+	}})
+
+	if cerr := DockerDelete("ubuntu:18.04"); cerr == nil || cerr.Err != ErrOperation {
+		t.Errorf("image keeping workspace of squashed container should not be deleted, got %v", cerr)
+	}
+	if !FolderExist(con.RootPath) || !FolderExist(con.ConfigPath) {
+		t.Error("workspace of squashed container is removed")
+	}
+}
+
+func TestMergedView(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	image, _ := normalizeImageName("ubuntu")
+	docker_dir := filepath.Join(dir, ".docker")
+	writeInfo(t, docker_dir, Docker{RootDir: docker_dir, Images: map[string]interface{}{
+		image: map[string]interface{}{"base": filepath.Join(docker_dir, ".base"), "layer_order": "/tarballs/sha1:/tarballs/sha2"},
+	}})
+
+	setting := filepath.Join(dir, "setting.yml")
+	if err := ioutil.WriteFile(setting, []byte("add_map:\n  - /usr/bin/python: /opt/python/bin\n  - usr/bin/gcc:\n      - /opt/gcc/bin\n      - /opt/gcc/lib\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	workspace := filepath.Join(dir, "workspace", "c1")
+	con := Container{
+		Id:            "c1",
+		ContainerName: "ubuntu",
+		RootPath:      filepath.Join(workspace, "rw"),
+		ConfigPath:    filepath.Join(workspace, ".lpmx"),
+		SettingPath:   setting,
+		DockerBase:    true,
+		Layers:        "rw:sha2:sha1",
+		ImageBase:     image,
+	}
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath, "ContainerName": "ubuntu", "Image": image},
+	}})
+
+	if _, _, _, cerr := mergedView("ubuntu"); cerr == nil || cerr.Err != ErrAmbiguous {
+		t.Errorf("name shared by container and image should be ambiguous, got %v", cerr)
+	}
+	_, layers, _, cerr := mergedView(image)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if strings.Join(layers, ":") != "sha2:sha1" {
+		t.Errorf("image should be chosen by its name with tag, got layers %v", layers)
+	}
+	_, layers, maps, cerr := mergedView("c1")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if strings.Join(layers, ":") != "rw:sha2:sha1" {
+		t.Errorf("container should be chosen by its id, got layers %v", layers)
+	}
+	if name := mappedName(maps, "usr/bin/python", "/usr/bin/python"); name != "/usr/bin/python (mapped: /opt/python/bin)" {
+		t.Errorf("absolute path of add_map should be marked, got %s", name)
+	}
+	if value, ok := mappedPath(maps, "/usr/bin/gcc"); !ok || value != "/opt/gcc/bin;/opt/gcc/lib" {
+		t.Errorf("relative path of add_map should be marked with all its values, got %s", value)
+	}
+	if _, ok := mappedPath(maps, "usr/bin/perl"); ok {
+		t.Error("path without add_map should not be marked")
+	}
+}
+
+func TestRenameRunning(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	workspace := filepath.Join(dir, "workspace", "c1")
+	con := Container{
+		Id:            "c1",
+		ContainerName: "web",
+		RootPath:      filepath.Join(workspace, "rw"),
+		ConfigPath:    filepath.Join(workspace, ".lpmx"),
+	}
+	os.MkdirAll(con.RootPath, 0755)
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath, "ContainerName": "web"},
+	}})
+
+	//shell of running container carries its id inside environ
+	cmd := exec.Command("sleep", "10")
+	cmd.Env = []string{"ContainerId=c1"}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	//environ is replaced once exec of child finishes
+	for i := 0; i < 50; i++ {
+		if id, ok := PidEnv(cmd.Process.Pid, "ContainerId"); ok && id == "c1" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	pidfile := filepath.Join(workspace, "container.pid")
+	if err := ioutil.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cerr := RenameContainer("web", "api"); cerr == nil || cerr.Err != ErrExist {
+		t.Errorf("running container should not be renamed, got %v", cerr)
+	}
+	os.Remove(pidfile)
+
+	if cerr := RenameContainer("web", "api"); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if renamed, cerr := getContainer("api"); cerr != nil || renamed.ContainerName != "api" {
+		t.Errorf("stopped container should be renamed, got %v", cerr)
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	workspace := filepath.Join(dir, "workspace", "c1")
+	con := Container{
+		Id:         "c1",
+		RootPath:   filepath.Join(workspace, "rw"),
+		ConfigPath: filepath.Join(workspace, ".lpmx"),
+		Layers:     "rw",
+		UserShell:  "sh",
+	}
+	os.MkdirAll(con.RootPath, 0755)
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath},
+	}})
+
+	if cerr := Exec("c1", "true"); cerr == nil || cerr.Err != ErrNExist {
+		t.Errorf("command should not be executed inside stopped container, got %v", cerr)
+	}
+
+	//fake shell of running container carrying keys of its faked-sysv and memcached
+	cmd := exec.Command("sleep", "10")
+	cmd.Env = []string{"ContainerId=c1", "FAKEROOTKEY=1234", "MEMCACHED_PID=/shell/.memcached.pid"}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	for i := 0; i < 50; i++ {
+		if id, ok := PidEnv(cmd.Process.Pid, "ContainerId"); ok && id == "c1" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workspace, "container.pid"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if cerr := Exec("c1", `echo "$FAKEROOTKEY $MEMCACHED_PID" > env`); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(con.RootPath, "env")); err != nil || string(data) != "1234 /shell/.memcached.pid\n" {
+		t.Errorf("keys should be taken from environ of container shell, got %s, %v", data, err)
+	}
+}
+
+func TestDockerGC(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	docker_dir := filepath.Join(dir, ".docker")
+	writeInfo(t, docker_dir, Docker{RootDir: docker_dir, Images: map[string]interface{}{}})
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{}})
+
+	//old unreferenced tarball is garbage, the ones being downloaded are not
+	for _, file := range []string{".image/old", ".image/new", ".image/sha1.partial", ".base/old/etc/hosts"} {
+		path := filepath.Join(docker_dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-2 * GC_GRACE_PERIOD)
+	for _, file := range []string{".image/old", ".base/old"} {
+		os.Chtimes(filepath.Join(docker_dir, file), past, past)
+	}
+	if cerr := DockerGC(false); cerr != nil {
+		t.Fatal(cerr)
+	}
+	for _, file := range []string{".image/old", ".base/old"} {
+		if _, err := os.Lstat(filepath.Join(docker_dir, file)); err == nil {
+			t.Errorf("%s should be removed", file)
+		}
+	}
+	for _, file := range []string{".image/new", ".image/sha1.partial"} {
+		if _, err := os.Lstat(filepath.Join(docker_dir, file)); err != nil {
+			t.Errorf("%s modified recently should be kept: %v", file, err)
+		}
+	}
+}
+
+func TestCommitUnchanged(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	image, _ := normalizeImageName("ubuntu:18.04")
+	docker_dir := filepath.Join(dir, ".docker")
+	image_dir := filepath.Join(docker_dir, ".image")
+	base := filepath.Join(docker_dir, ".base")
+	image_root := filepath.Join(docker_dir, "ubuntu", "18.04")
+	for _, file := range []string{".image/sha1", ".base/sha1/etc/hosts"} {
+		path := filepath.Join(docker_dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeInfo(t, docker_dir, Docker{RootDir: docker_dir, Images: map[string]interface{}{
+		image: map[string]interface{}{
+			"rootdir":     image_root,
+			"image":       image_dir,
+			"base":        base,
+			"layer":       map[string]interface{}{filepath.Join(image_dir, "sha1"): int64(len(".image/sha1"))},
+			"layer_order": filepath.Join(image_dir, "sha1"),
+		},
+	}})
+	writeInfo(t, image_root, DockerInfo{Name: image, Layers: "sha1"})
+
+	//rw layer only contains paths excluded from commit
+	workspace := filepath.Join(image_root, "workspace", "c1")
+	con := Container{
+		Id:             "c1",
+		RootPath:       filepath.Join(workspace, "rw"),
+		ConfigPath:     filepath.Join(workspace, ".lpmx"),
+		SettingPath:    filepath.Join(image_root, "setting.yml"),
+		BaseLayerPath:  base,
+		DockerBase:     true,
+		Layers:         "rw:sha1",
+		ImageBase:      image,
+		DataSyncFolder: filepath.Join(dir, "sync"),
+	}
+	for _, path := range []string{filepath.Join(workspace, "rw/tmp/cache"), con.SettingPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(filepath.Base(path)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath},
+	}})
+
+	opts := CommitOptions{Compression: COMPRESSION_GZIP, Reproducible: true}
+	if cerr := DockerCommit("c1", "docker.io/library/ubuntu", "first", opts); cerr != nil {
+		t.Fatal(cerr)
+	}
+	committed, cerr := getContainer("c1")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	//committed image is registered under normalized name
+	first, _ := normalizeImageName("ubuntu:first")
+	var doc Docker
+	if cerr := unmarshalObj(docker_dir, &doc); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if _, ok := doc.Images[first]; !ok || committed.ImageBase != first {
+		t.Errorf("image should be registered as %s, got %s", first, committed.ImageBase)
+	}
+	if !FolderExist(filepath.Join(docker_dir, "ubuntu", "first", "workspace", "c1")) {
+		t.Error("workspace should be moved into folder named after normalized image name")
+	}
+	if cerr := DockerCommit("c1", "ubuntu", "second", opts); cerr == nil || cerr.Err != ErrExist {
+		t.Errorf("committing unchanged container again should be refused, got %v", cerr)
+	}
+	again, cerr := getContainer("c1")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if again.Layers != committed.Layers || len(again.History) != 1 || strings.Count(again.Layers, ":") != 2 {
+		t.Errorf("layers of container should not be duplicated, got %s", again.Layers)
+	}
+	if !FileExist(filepath.Join(again.RootPath, "tmp/cache")) {
+		t.Error("excluded paths should be kept inside rw layer")
+	}
+}
+
+func TestRegisterImageRollback(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	docker_dir := filepath.Join(dir, ".docker")
+	doc := Docker{RootDir: docker_dir, Images: map[string]interface{}{}}
+	//sha1 is shared with registered image while sha2 is broken
+	for _, file := range []string{".image/sha1", ".image/sha2", ".base/sha1/etc/hosts", "setting.yml"} {
+		path := filepath.Join(docker_dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image, _ := normalizeImageName("ubuntu:18.04")
+	docinfo := DockerInfo{Name: image, Layers: "sha2:sha1", LayersMap: map[string]int64{"sha1": 1, "sha2": 1}}
+	if cerr := registerImage(&doc, &docinfo, filepath.Join(docker_dir, "setting.yml")); cerr == nil {
+		t.Fatal("registering image having broken layer should fail")
+	}
+	if _, ok := doc.Images[image]; ok {
+		t.Error("image should not be added to Docker.Images")
+	}
+	for _, path := range []string{"ubuntu/18.04", ".base/sha2"} {
+		if _, err := os.Lstat(filepath.Join(docker_dir, path)); err == nil {
+			t.Errorf("%s should be removed", path)
+		}
+	}
+	if !FileExist(filepath.Join(docker_dir, ".base/sha1/etc/hosts")) {
+		t.Error("layer extracted before should be kept")
+	}
+}
+
+func TestCommitFailureKeepsExcluded(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	image, _ := normalizeImageName("ubuntu:18.04")
+	docker_dir := filepath.Join(dir, ".docker")
+	image_root := filepath.Join(docker_dir, "ubuntu", "18.04")
+	writeInfo(t, docker_dir, Docker{RootDir: docker_dir, Images: map[string]interface{}{}})
+	workspace := filepath.Join(image_root, "workspace", "c1")
+	con := Container{
+		Id:            "c1",
+		RootPath:      filepath.Join(workspace, "rw"),
+		ConfigPath:    filepath.Join(workspace, ".lpmx"),
+		SettingPath:   filepath.Join(image_root, "setting.yml"),
+		BaseLayerPath: filepath.Join(docker_dir, ".base"),
+		DockerBase:    true,
+		Layers:        "rw:sha1",
+		ImageBase:     image,
+	}
+	//.image folder is missing, so that moving layer tarball fails after excluded paths are moved out
+	for _, path := range []string{filepath.Join(docker_dir, ".base/sha1/etc/hosts"), filepath.Join(con.RootPath, "tmp/cache"), filepath.Join(con.RootPath, "etc/hosts"), con.SettingPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(filepath.Base(path)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath},
+	}})
+
+	if cerr := DockerCommit("c1", "ubuntu", "first", CommitOptions{Compression: COMPRESSION_GZIP}); cerr == nil {
+		t.Fatal("commit should fail without image folder")
+	}
+	if !FileExist(filepath.Join(con.RootPath, "tmp/cache")) {
+		t.Error("excluded paths should be moved back into rw layer after failed commit")
+	}
+	if FolderExist(filepath.Join(workspace, COMMIT_EXCLUDE_FOLDER)) {
+		t.Errorf("%s should be removed after excluded paths are moved back", COMMIT_EXCLUDE_FOLDER)
+	}
+}
+
+func TestStopDetached(t *testing.T) {
+	dir, cleanup := fakeLpmx(t)
+	defer cleanup()
+
+	workspace := filepath.Join(dir, "workspace", "c1")
+	con := Container{
+		Id:         "c1",
+		RootPath:   filepath.Join(workspace, "rw"),
+		ConfigPath: filepath.Join(workspace, ".lpmx"),
+		Layers:     "rw",
+	}
+	os.MkdirAll(con.RootPath, 0755)
+	writeInfo(t, con.ConfigPath, con)
+	sys_dir := filepath.Join(dir, ".lpmxsys")
+	writeInfo(t, sys_dir, Sys{RootDir: sys_dir, Containers: map[string]interface{}{
+		"c1": map[string]interface{}{"RootPath": con.RootPath, "ConfigPath": con.ConfigPath},
+	}})
+
+	//detached process of container without shell records the signal it receives
+	signal := filepath.Join(dir, "signal")
+	cmd := exec.Command("sh", "-c", `trap "echo hup > $0; exit" HUP; trap "echo term > $0; exit" TERM; : > $0.ready; while :; do sleep 0.1; done`, signal)
+	cmd.Env = []string{"ContainerId=c1", "PATH=" + os.Getenv("PATH")}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	//signals are sent once traps are set
+	for i := 0; i < 50 && !FileExist(signal+".ready"); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if cerr := Stop("c1", 5); cerr != nil {
+		t.Fatal(cerr)
+	}
+	<-exited
+	if data, err := ioutil.ReadFile(signal); err != nil || string(data) != "term\n" {
+		t.Errorf("process other than container shell should only receive SIGTERM, got %q, %v", data, err)
+	}
+}
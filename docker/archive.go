@@ -0,0 +1,228 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/docker/distribution/manifest/manifestlist"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	//annotation keys used by containerd/docker and OCI for recording image names inside index.json
+	ANNOTATION_IMAGE_NAME = "io.containerd.image.name"
+	ANNOTATION_REF_NAME   = "org.opencontainers.image.ref.name"
+)
+
+//ArchiveImage is one image found inside docker save archive or OCI image layout
+type ArchiveImage struct {
+	Name   string   //image name recorded inside archive, empty if the image is untagged
+	Digest string   //digest of manifest, only available for OCI image layout
+	Config []byte   //raw image config blob
+	Layers []string //absolute paths of layer tarballs, base layer first
+	//media types of layer tarballs, empty if the archive does not record them, e.g, docker save archive
+	MediaTypes []string
+	//expected digests of layer tarballs and their uncompressed content, empty if the archive does not record them
+	Digests []digest.Digest
+	DiffIDs []digest.Digest
+}
+
+//dockerSaveManifest is one entry of manifest.json written by 'docker save'
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+//IsDockerArchive checks whether dir is the extracted content of 'docker save'
+func IsDockerArchive(dir string) bool {
+	return FileExist(filepath.Join(dir, "manifest.json"))
+}
+
+//IsOCILayout checks whether dir is an OCI image layout
+func IsOCILayout(dir string) bool {
+	return FileExist(filepath.Join(dir, ocispec.ImageLayoutFile)) && FileExist(filepath.Join(dir, "index.json"))
+}
+
+//ReadDockerArchive parses manifest.json inside the extracted content of 'docker save'
+func ReadDockerArchive(dir string) ([]ArchiveImage, *Error) {
+	data, cerr := ReadFromFile(filepath.Join(dir, "manifest.json"))
+	if cerr != nil {
+		return nil, cerr
+	}
+	var manifests []dockerSaveManifest
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		cerr := ErrNew(err, "could not unmarshal manifest.json of docker archive")
+		return nil, cerr
+	}
+
+	var images []ArchiveImage
+	for _, man := range manifests {
+		config_path, cerr := archivePath(dir, man.Config)
+		if cerr != nil {
+			return nil, cerr
+		}
+		config, cerr := ReadFromFile(config_path)
+		if cerr != nil {
+			return nil, cerr
+		}
+		var layers []string
+		for _, layer := range man.Layers {
+			layer_path, cerr := archivePath(dir, layer)
+			if cerr != nil {
+				return nil, cerr
+			}
+			layers = append(layers, layer_path)
+		}
+		diff_ids := configDiffIDs(config, len(layers))
+		//images having multiple tags are recorded once for every tag
+		if len(man.RepoTags) == 0 {
+			images = append(images, ArchiveImage{Config: config, Layers: layers, DiffIDs: diff_ids})
+		}
+		for _, tag := range man.RepoTags {
+			images = append(images, ArchiveImage{Name: tag, Config: config, Layers: layers, DiffIDs: diff_ids})
+		}
+	}
+	return images, nil
+}
+
+//ReadOCILayout parses index.json of OCI image layout, nested image indexes are resolved by platform
+func ReadOCILayout(dir string, platform *Platform) ([]ArchiveImage, *Error) {
+	data, cerr := ReadFromFile(filepath.Join(dir, "index.json"))
+	if cerr != nil {
+		return nil, cerr
+	}
+	var index manifestlist.ManifestList
+	if err := json.Unmarshal(data, &index); err != nil {
+		cerr := ErrNew(err, "could not unmarshal index.json of OCI image layout")
+		return nil, cerr
+	}
+
+	var images []ArchiveImage
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[ANNOTATION_IMAGE_NAME]
+		//ref.name may only contain the tag, which can't be used as image name
+		if ref_name := desc.Annotations[ANNOTATION_REF_NAME]; name == "" && strings.ContainsAny(ref_name, ":/") {
+			name = ref_name
+		}
+
+		man_desc := desc.Descriptor
+		if desc.MediaType == manifestlist.MediaTypeManifestList || desc.MediaType == ocispec.MediaTypeImageIndex {
+			blob, cerr := readOCIBlob(dir, desc.Digest)
+			if cerr != nil {
+				return nil, cerr
+			}
+			var list manifestlist.DeserializedManifestList
+			if err := json.Unmarshal(blob, &list.ManifestList); err != nil {
+				cerr := ErrNew(err, fmt.Sprintf("could not unmarshal image index %s", desc.Digest))
+				return nil, cerr
+			}
+			selected, cerr := SelectManifest(&list, platform)
+			if cerr != nil {
+				return nil, cerr
+			}
+			man_desc = selected.Descriptor
+		}
+
+		blob, cerr := readOCIBlob(dir, man_desc.Digest)
+		if cerr != nil {
+			return nil, cerr
+		}
+		//docker schema2 manifest shares the same layout with OCI manifest
+		var man ocispec.Manifest
+		if err := json.Unmarshal(blob, &man); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not unmarshal manifest %s", man_desc.Digest))
+			return nil, cerr
+		}
+		config, cerr := readOCIBlob(dir, man.Config.Digest)
+		if cerr != nil {
+			return nil, cerr
+		}
+		var layers []string
+		var digests []digest.Digest
+		var media_types []string
+		for _, layer := range man.Layers {
+			if !isLayerMediaType(layer.MediaType) {
+				cerr := ErrNew(ErrType, fmt.Sprintf("layer %s has unsupported media type: %s", layer.Digest, layer.MediaType))
+				return nil, cerr
+			}
+			layer_path, cerr := archivePath(dir, blobPath(layer.Digest))
+			if cerr != nil {
+				return nil, cerr
+			}
+			layers = append(layers, layer_path)
+			digests = append(digests, layer.Digest)
+			media_types = append(media_types, layer.MediaType)
+		}
+		images = append(images, ArchiveImage{
+			Name:       name,
+			Digest:     man_desc.Digest.String(),
+			Config:     config,
+			Layers:     layers,
+			MediaTypes: media_types,
+			Digests:    digests,
+			DiffIDs:    configDiffIDs(config, len(layers)),
+		})
+	}
+	return images, nil
+}
+
+//configDiffIDs returns diff_ids recorded inside image config, nil is returned if they do not match layers
+func configDiffIDs(config []byte, count int) []digest.Digest {
+	var image ocispec.Image
+	if err := json.Unmarshal(config, &image); err != nil || len(image.RootFS.DiffIDs) != count {
+		return nil
+	}
+	return image.RootFS.DiffIDs
+}
+
+func blobPath(dig digest.Digest) string {
+	return filepath.Join("blobs", dig.Algorithm().String(), dig.Hex())
+}
+
+func readOCIBlob(dir string, dig digest.Digest) ([]byte, *Error) {
+	if err := dig.Validate(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("invalid digest %s inside OCI image layout", dig))
+		return nil, cerr
+	}
+	blob_path, cerr := archivePath(dir, blobPath(dig))
+	if cerr != nil {
+		return nil, cerr
+	}
+	data, err := ioutil.ReadFile(blob_path)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read blob %s", dig))
+		return nil, cerr
+	}
+	if dig.Algorithm().FromBytes(data) != dig {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("blob %s does not match its digest", dig))
+		return nil, cerr
+	}
+	return data, nil
+}
+
+//archivePath joins the path recorded inside archive with dir, paths pointing outside of dir are rejected
+func archivePath(dir string, name string) (string, *Error) {
+	target := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		cerr := ErrNew(ErrType, fmt.Sprintf("path %s inside archive is invalid", name))
+		return "", cerr
+	}
+	if !FileExist(target) {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist inside archive", name))
+		return "", cerr
+	}
+	//'docker save' links layers shared by several images
+	real_target, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not resolve %s inside archive", name))
+		return "", cerr
+	}
+	return real_target, nil
+}
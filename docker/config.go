@@ -0,0 +1,70 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+)
+
+//ImageConfig is the part of image config blob used for running containers
+type ImageConfig struct {
+	Env        []string
+	Entrypoint []string
+	Cmd        []string
+	WorkingDir string
+	User       string
+}
+
+func ParseImageConfig(data []byte) (*ImageConfig, *Error) {
+	var image ocispec.Image
+	if err := json.Unmarshal(data, &image); err != nil {
+		cerr := ErrNew(err, "could not unmarshal image config")
+		return nil, cerr
+	}
+	return &ImageConfig{
+		Env:        image.Config.Env,
+		Entrypoint: image.Config.Entrypoint,
+		Cmd:        image.Config.Cmd,
+		WorkingDir: image.Config.WorkingDir,
+		User:       image.Config.User,
+	}, nil
+}
+
+//UserName returns the user name declared by image config, group and numeric uid are dropped as they can't be resolved without /etc/passwd of image
+func (ic *ImageConfig) UserName() string {
+	user := strings.SplitN(ic.User, ":", 2)[0]
+	if _, err := strconv.Atoi(user); err == nil {
+		return ""
+	}
+	return user
+}
+
+//DefaultCommand joins Entrypoint and Cmd into one shell command line, nil is returned if neither is defined
+func (ic *ImageConfig) DefaultCommand() []string {
+	var args []string
+	args = append(args, ic.Entrypoint...)
+	args = append(args, ic.Cmd...)
+	if len(args) == 0 {
+		return nil
+	}
+	for idx, arg := range args {
+		args[idx] = shellQuote(arg)
+	}
+	return []string{strings.Join(args, " ")}
+}
+
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return fmt.Sprintf("'%s'", strings.Replace(arg, "'", `'\''`, -1))
+}
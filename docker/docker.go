@@ -2,7 +2,6 @@ package docker
 
 import (
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -17,15 +16,37 @@ import (
 	. "github.com/JasonYangShadow/lpmx/error"
 	registry "github.com/JasonYangShadow/lpmx/registry"
 	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/docker/distribution"
 	. "github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/ocischema"
 	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/libtrust"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
 	DOCKER_URL  = "https://registry-1.docker.io"
 	SETTING_URL = "https://raw.githubusercontent.com/JasonYangShadow/LPMXSettingRepository/master"
+
+	//zstd layer media types are defined by image-spec v1.1, which is newer than the vendored one
+	MEDIATYPE_LAYER_ZSTD                  = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MEDIATYPE_LAYER_NONDISTRIBUTABLE_ZSTD = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+var (
+	LAYER_MEDIATYPE = []string{
+		schema2.MediaTypeLayer,
+		schema2.MediaTypeForeignLayer,
+		ocispec.MediaTypeImageLayer,
+		ocispec.MediaTypeImageLayerGzip,
+		ocispec.MediaTypeImageLayerNonDistributable,
+		ocispec.MediaTypeImageLayerNonDistributableGzip,
+		MEDIATYPE_LAYER_ZSTD,
+		MEDIATYPE_LAYER_NONDISTRIBUTABLE_ZSTD,
+	}
 )
 
 func ListRepositories(username string, pass string) ([]string, *Error) {
@@ -45,15 +66,16 @@ func ListRepositories(username string, pass string) ([]string, *Error) {
 
 func ListTags(username string, pass string, name string) ([]string, *Error) {
 	log.SetOutput(ioutil.Discard)
-	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
-		name = "library/" + name
+	ref, cerr := ParseReference(name)
+	if cerr != nil {
+		return nil, cerr
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := registry.New(ref.URL(), username, pass)
 	if err != nil {
-		cerr := ErrNew(err, "create docker registry instance failure")
+		cerr := ErrNew(err, fmt.Sprintf("create registry instance of %s failure", ref.Registry))
 		return nil, cerr
 	}
-	tags, err := hub.Tags(name)
+	tags, err := hub.Tags(ref.Repository)
 	if err != nil {
 		cerr := ErrNew(err, "query docker tags failure")
 		return nil, cerr
@@ -61,17 +83,18 @@ func ListTags(username string, pass string, name string) ([]string, *Error) {
 	return tags, nil
 }
 
-func GetDigest(username string, pass string, name string, tag string) (string, *Error) {
+func GetDigest(username string, pass string, name string) (string, *Error) {
 	log.SetOutput(ioutil.Discard)
-	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
-		name = "library/" + name
+	ref, cerr := ParseReference(name)
+	if cerr != nil {
+		return "", cerr
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := registry.New(ref.URL(), username, pass)
 	if err != nil {
-		cerr := ErrNew(err, "create docker registry instance failure")
+		cerr := ErrNew(err, fmt.Sprintf("create registry instance of %s failure", ref.Registry))
 		return "", cerr
 	}
-	digest, err := hub.ManifestDigest(name, tag)
+	digest, err := hub.ManifestDigest(ref.Repository, ref.Reference())
 	if err != nil {
 		cerr := ErrNew(err, "query docker digest failure")
 		return "", cerr
@@ -79,14 +102,16 @@ func GetDigest(username string, pass string, name string, tag string) (string, *
 	return digest.String(), nil
 }
 
-func MakeManifestV1(registry *registry.Registry, name, tag, layer_sha, base_image string) (*schema1.SignedManifest, *Error) {
+//MakeManifestV1 creates manifest of new image, whose top layer is layer_sha and other layers are the ones of base_image
+//base_hub is the registry instance of the registry hosting base_image, which may differ from the one new image is pushed to
+func MakeManifestV1(base_hub *registry.Registry, name, tag, layer_sha, base_image string) (*schema1.SignedManifest, *Error) {
 	log.SetOutput(ioutil.Discard)
 
-	if !strings.Contains(base_image, "library/") && !strings.Contains(base_image, "/") {
-		base_image = "library/" + base_image
+	base_ref, cerr := ParseReference(base_image)
+	if cerr != nil {
+		return nil, cerr
 	}
-	base_info := strings.Split(base_image, ":")
-	man_base, man_err := registry.Manifest(base_info[0], base_info[1])
+	man_base, man_err := base_hub.Manifest(base_ref.Repository, base_ref.Reference())
 	if man_err != nil {
 		cerr := ErrNew(man_err, fmt.Sprintf("unable to parse base image manifest: %s", base_image))
 		return nil, cerr
@@ -251,18 +276,46 @@ func randomRead(num int) ([]byte, *Error) {
 
 func UploadManifests(username, pass, name, tag, layer_sha, base_image string) *Error {
 	log.SetOutput(ioutil.Discard)
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	ref, cerr := ParseReference(name)
+	if cerr != nil {
+		return cerr
+	}
+	hub, err := registry.New(ref.URL(), username, pass)
 	if err != nil {
-		cerr := ErrNew(err, "create docker registry instance failure")
+		cerr := ErrNew(err, fmt.Sprintf("create registry instance of %s failure", ref.Registry))
+		return cerr
+	}
+
+	//base manifest is fetched from the registry of base image, credentials are only used if it is the registry pushed to
+	base_ref, cerr := ParseReference(base_image)
+	if cerr != nil {
 		return cerr
 	}
+	base_hub := hub
+	if base_ref.Registry != ref.Registry {
+		base_hub, err = registry.New(base_ref.URL(), "", "")
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("create registry instance of %s failure", base_ref.Registry))
+			return cerr
+		}
+	}
 
-	signedManifest, serr := MakeManifestV1(hub, name, tag, layer_sha, base_image)
+	signedManifest, serr := MakeManifestV1(base_hub, ref.Repository, tag, layer_sha, base_image)
 	if serr != nil {
 		return serr
 	}
 
-	err = hub.PutManifest(name, tag, *signedManifest)
+	//layers of base image are referenced by the new manifest, they should exist inside the repository pushed to
+	token, cerr := GetToken(ref, username, pass, "pull,push")
+	if cerr != nil {
+		return cerr
+	}
+	cerr = copyBaseLayers(ref, token, base_hub, base_ref, signedManifest.FSLayers[1:])
+	if cerr != nil {
+		return cerr
+	}
+
+	err = hub.PutManifest(ref.Repository, tag, *signedManifest)
 	if err != nil {
 		cerr := ErrNew(err, "putting manifest error")
 		return cerr
@@ -270,11 +323,56 @@ func UploadManifests(username, pass, name, tag, layer_sha, base_image string) *E
 	return nil
 }
 
+//copyBaseLayers makes layers of base image available inside the repository of ref
+//layers inside the same registry are mounted from base repository, others are downloaded from base registry and uploaded
+func copyBaseLayers(ref *Reference, token string, base_hub *registry.Registry, base_ref *Reference, layers []schema1.FSLayer) *Error {
+	copied := make(map[digest.Digest]bool)
+	for _, layer := range layers {
+		if copied[layer.BlobSum] {
+			continue
+		}
+		copied[layer.BlobSum] = true
+		hok, herr := HasBlob(ref, token, layer.BlobSum.Hex())
+		if herr != nil && herr.Err != ErrHttpNotFound {
+			return herr
+		}
+		if hok {
+			continue
+		}
+		if base_ref.Registry == ref.Registry {
+			mounted, cerr := MountBlob(ref, token, base_ref.Repository, layer.BlobSum.Hex())
+			if cerr != nil {
+				return cerr
+			}
+			if mounted {
+				continue
+			}
+		}
+
+		temp_dir, err := ioutil.TempDir("", "lpmx")
+		if err != nil {
+			cerr := ErrNew(err, "could not create temp dir")
+			return cerr
+		}
+		var progress int64
+		file, cerr := downloadBlob(base_hub, base_ref.Repository, distribution.Descriptor{Digest: layer.BlobSum}, temp_dir, &progress)
+		if cerr == nil {
+			_, cerr = UploadBlob(ref, token, file)
+		}
+		os.RemoveAll(temp_dir)
+		if cerr != nil {
+			return cerr
+		}
+	}
+	return nil
+}
+
 func UploadLayers(username, pass, name, tag, file, base_image string) (string, *Error) {
 	log.SetOutput(ioutil.Discard)
 
-	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
-		name = "library/" + name
+	ref, err := ParseReference(name)
+	if err != nil {
+		return "", err
 	}
 
 	sha256, err := Sha256file(file)
@@ -282,18 +380,18 @@ func UploadLayers(username, pass, name, tag, file, base_image string) (string, *
 		return "", err
 	}
 
-	token, err := GetToken(name, username, pass, "pull,push")
+	token, err := GetToken(ref, username, pass, "pull,push")
 	if err != nil {
 		return "", err
 	}
 
-	hok, herr := HasBlob(name, token, sha256)
-	if herr != nil {
+	hok, herr := HasBlob(ref, token, sha256)
+	if herr != nil && herr.Err != ErrHttpNotFound {
 		return "", herr
 	}
 	if !hok {
 		//step 1: uploading blob
-		_, err := UploadBlob(name, token, file)
+		_, err := UploadBlob(ref, token, file)
 		if err != nil {
 			return "", err
 		}
@@ -309,22 +407,23 @@ func UploadLayers(username, pass, name, tag, file, base_image string) (string, *
 	return sha256, nil
 }
 
-func DeleteManifest(username string, pass string, name string, tag string) *Error {
+func DeleteManifest(username string, pass string, name string) *Error {
 	log.SetOutput(ioutil.Discard)
-	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
-		name = "library/" + name
+	ref, cerr := ParseReference(name)
+	if cerr != nil {
+		return cerr
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := registry.New(ref.URL(), username, pass)
 	if err != nil {
-		cerr := ErrNew(err, "create docker registry instance failure")
+		cerr := ErrNew(err, fmt.Sprintf("create registry instance of %s failure", ref.Registry))
 		return cerr
 	}
-	digest, err := hub.ManifestDigest(name, tag)
+	digest, err := hub.ManifestDigest(ref.Repository, ref.Reference())
 	if err != nil {
 		cerr := ErrNew(err, "query docker digest failure")
 		return cerr
 	}
-	err = hub.DeleteManifest(name, digest)
+	err = hub.DeleteManifest(ref.Repository, digest)
 	if err != nil {
 		cerr := ErrNew(err, "delete docker manifest failure")
 		return cerr
@@ -332,81 +431,118 @@ func DeleteManifest(username string, pass string, name string, tag string) *Erro
 	return nil
 }
 
-func DownloadLayers(username string, pass string, name string, tag string, folder string) (map[string]int64, []string, *Error) {
-	log.SetOutput(ioutil.Discard)
-	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
-		name = "library/" + name
+//ResolveManifest fetches the manifest of reference, manifest list or OCI image index is resolved to the manifest matching platform
+func ResolveManifest(hub *registry.Registry, ref *Reference, platform *Platform) (distribution.Descriptor, []distribution.Descriptor, string, *Error) {
+	man, desc, err := fetchManifest(hub, ref.Repository, ref.Reference())
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("query manifest of %s failure", ref))
+		return distribution.Descriptor{}, nil, "", cerr
+	}
+
+	if list, ok := man.(*manifestlist.DeserializedManifestList); ok {
+		selected, cerr := SelectManifest(list, platform)
+		if cerr != nil {
+			return distribution.Descriptor{}, nil, "", cerr
+		}
+		man, desc, err = fetchManifest(hub, ref.Repository, selected.Digest.String())
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("query manifest of %s with platform %s failure", ref, platform))
+			return distribution.Descriptor{}, nil, "", cerr
+		}
+	}
+
+	switch m := man.(type) {
+	case *schema2.DeserializedManifest:
+		return m.Config, m.Layers, desc.Digest.String(), nil
+	case *ocischema.DeserializedManifest:
+		return m.Config, m.Layers, desc.Digest.String(), nil
+	default:
+		cerr := ErrNew(ErrType, fmt.Sprintf("manifest type %T of %s is not supported", man, ref))
+		return distribution.Descriptor{}, nil, "", cerr
+	}
+}
+
+func isLayerMediaType(mediaType string) bool {
+	for _, t := range LAYER_MEDIATYPE {
+		if t == mediaType {
+			return true
+		}
 	}
+	return false
+}
+
+//LayerCompression returns the compression of layer declared by its media type
+func LayerCompression(mediaType string) string {
+	if comp := MediaTypeCompression(mediaType); comp != "" {
+		return comp
+	}
+	return COMPRESSION_NONE
+}
+
+//LayerMediaType returns the OCI media type of layer compressed by compression
+func LayerMediaType(compression string) string {
+	switch compression {
+	case COMPRESSION_ZSTD:
+		return MEDIATYPE_LAYER_ZSTD
+	case COMPRESSION_NONE:
+		return ocispec.MediaTypeImageLayer
+	}
+	return ocispec.MediaTypeImageLayerGzip
+}
+
+//DownloadLayers downloads layers of image into folder and returns layer sizes, layer media types, layer order, the resolved manifest digest and the raw image config
+//at most parallel layers are downloaded at the same time, interrupted downloads are resumed by the next call
+func DownloadLayers(username string, pass string, ref *Reference, platform *Platform, folder string, parallel int) (map[string]int64, map[string]string, []string, string, []byte, *Error) {
+	log.SetOutput(ioutil.Discard)
 	if !FolderExist(folder) {
 		_, err := MakeDir(folder)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, "", nil, err
 		}
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := registry.New(ref.URL(), username, pass)
 	if err != nil {
-		cerr := ErrNew(err, "create docker registry instance failure")
-		return nil, nil, cerr
+		cerr := ErrNew(err, fmt.Sprintf("create registry instance of %s failure", ref.Registry))
+		return nil, nil, nil, "", nil, cerr
 	}
-	man, err := hub.ManifestV2(name, tag)
-	if err != nil {
-		cerr := ErrNew(err, "query docker manifest failure")
-		return nil, nil, cerr
+	config_desc, layers, man_digest, cerr := ResolveManifest(hub, ref, platform)
+	if cerr != nil {
+		return nil, nil, nil, "", nil, cerr
 	}
-	data := make(map[string]int64)
-	var layer_order []string
-	for _, element := range man.Layers {
-		dig := element.Digest
-		//reader, err := hub.DownloadLayer(name, dig)
-		//function name is changed
-		reader, err := hub.DownloadBlob(name, dig)
-		if err != nil {
-			cerr := ErrNew(err, "download docker layers failure")
-			return nil, nil, cerr
-		}
-		defer reader.Close()
-		if strings.HasSuffix(folder, "/") {
-			folder = strings.TrimSuffix(folder, "/")
+	for _, element := range layers {
+		if !isLayerMediaType(element.MediaType) {
+			cerr := ErrNew(ErrType, fmt.Sprintf("layer %s has unsupported media type: %s", element.Digest, element.MediaType))
+			return nil, nil, nil, "", nil, cerr
 		}
-		filename := folder + "/" + strings.TrimPrefix(dig.String(), "sha256:")
-		to, err := os.Create(filename)
-		if err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("create file %s failure", filename))
-			return nil, nil, cerr
+		if err := element.Digest.Validate(); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("layer has invalid digest %s", element.Digest))
+			return nil, nil, nil, "", nil, cerr
 		}
-		defer to.Close()
-		fmt.Println(fmt.Sprintf("Downloading file with type: %s, size: %d", element.MediaType, element.Size))
-
-		//printing download percentage using anonymous functions
-		go func(filename string, size int64) {
-			f, err := os.Open(filename)
-			if err != nil {
-				return
-			}
-			defer f.Close()
-			fi, err := f.Stat()
-			if err != nil {
-				return
-			}
-			curr_size := fi.Size()
-			for curr_size < size {
-				percentage := int(float64(curr_size) / float64(size) * 100)
-				fmt.Printf("Downloading... %d/%d [%d/100 complete]", curr_size, size, percentage)
-				time.Sleep(time.Second)
-				fi, err = f.Stat()
-				curr_size = fi.Size()
-				fmt.Printf("\r")
-			}
-		}(filename, element.Size)
+	}
+
+	//image config contains env, entrypoint and cmd
+	config, cerr := downloadConfig(hub, ref.Repository, config_desc)
+	if cerr != nil {
+		return nil, nil, nil, "", nil, cerr
+	}
 
-		if _, err := io.Copy(to, reader); err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("copy file %s content failure", filename))
-			return nil, nil, cerr
+	folder = strings.TrimSuffix(folder, "/")
+	fmt.Println(fmt.Sprintf("Downloading %d layers of %s", len(layers), ref))
+	layer_order, cerr := downloadBlobs(hub, ref.Repository, layers, folder, parallel)
+	if cerr != nil {
+		return nil, nil, nil, "", nil, cerr
+	}
+	data := make(map[string]int64)
+	media_types := make(map[string]string)
+	for idx, element := range layers {
+		data[layer_order[idx]] = element.Size
+		//layers are decompressed according to their media types, magic bytes are only used for reporting mismatch
+		media_types[layer_order[idx]] = element.MediaType
+		if comp, cerr := DetectCompression(layer_order[idx]); cerr == nil && comp != LayerCompression(element.MediaType) {
+			fmt.Println(fmt.Sprintf("warning: layer %s is %s compressed while its media type is %s", element.Digest, comp, element.MediaType))
 		}
-		data[filename] = element.Size
-		layer_order = append(layer_order, filename)
 	}
-	return data, layer_order, nil
+	return data, media_types, layer_order, man_digest, config, nil
 }
 
 func DownloadSetting(name string, tag string, folder string) *Error {
@@ -520,53 +656,32 @@ func DownloadFilefromGithub(name string, tag string, filename string, url string
 
 }
 
-type DockerHubToken struct {
-	Token        string `json:"token"`
-	Access_token string `json:"access_token"`
-	Expire       int    `json:"expires_in"`
-	Time         string `json:"issued_at"`
-}
-
-func GetToken(repository, username, password, action string) (string, *Error) {
-	token_url := fmt.Sprintf("https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:%s", repository, action)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", token_url, nil)
-	if err != nil {
-		cerr := ErrNew(err, "could not create new http request")
-		return "", cerr
-	}
-	if username != "" && password != "" {
-		encoded := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
-		req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encoded))
-	}
-	rep, err := client.Do(req)
-	if err != nil {
-		cerr := ErrNew(err, "could not execute http client")
-		return "", cerr
-	}
-	defer rep.Body.Close()
-	body, err := ioutil.ReadAll(rep.Body)
+func GetToken(ref *Reference, username, password, action string) (string, *Error) {
+	scope := fmt.Sprintf("repository:%s:%s", ref.Repository, action)
+	token, err := registry.Token(ref.URL(), username, password, scope)
 	if err != nil {
-		cerr := ErrNew(err, "could not read http response body")
+		cerr := ErrNew(err, fmt.Sprintf("could not get token from registry %s", ref.Registry))
 		return "", cerr
 	}
-	var token DockerHubToken
-	if err := json.Unmarshal(body, &token); err != nil {
-		cerr := ErrNew(err, "could not UnmarshalJSON http response body")
-		return "", cerr
+	return token, nil
+}
+
+//registries without token auth (e.g, local registries) do not need Authorization header
+func setAuthorization(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	}
-	return token.Token, nil
 }
 
-func UploadBlob(repository, token, file string) (bool, *Error) {
-	initial_url := fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/uploads/", repository)
+func UploadBlob(ref *Reference, token, file string) (bool, *Error) {
+	initial_url := fmt.Sprintf("%s/v2/%s/blobs/uploads/", ref.URL(), ref.Repository)
 	client := &http.Client{}
 	req, err := http.NewRequest("POST", initial_url, nil)
 	if err != nil {
 		cerr := ErrNew(err, "could not create http request")
 		return false, cerr
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAuthorization(req, token)
 	req.Header.Set("Content-Type", "application/octet-stream")
 
 	resp, err := client.Do(req)
@@ -581,6 +696,11 @@ func UploadBlob(repository, token, file string) (bool, *Error) {
 		cerr := ErrNew(err, "could not parse location")
 		return false, cerr
 	}
+	//location may be relative to the registry
+	if !locationUrl.IsAbs() {
+		base, _ := url.Parse(ref.URL())
+		locationUrl = base.ResolveReference(locationUrl)
+	}
 	sha256, cerr := Sha256file(file)
 	if cerr != nil {
 		return false, cerr
@@ -590,14 +710,17 @@ func UploadBlob(repository, token, file string) (bool, *Error) {
 		cerr := ErrNew(err, fmt.Sprintf("could not open file:%s", file))
 		return false, cerr
 	}
+	defer data.Close()
 
-	upload_url := fmt.Sprintf("%s&digest=sha256:%s", locationUrl, sha256)
-	req, err = http.NewRequest("PUT", upload_url, data)
+	q := locationUrl.Query()
+	q.Set("digest", fmt.Sprintf("sha256:%s", sha256))
+	locationUrl.RawQuery = q.Encode()
+	req, err = http.NewRequest("PUT", locationUrl.String(), data)
 	if err != nil {
 		cerr := ErrNew(err, "could not create http request")
 		return false, cerr
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAuthorization(req, token)
 	req.Header.Set("Content-Type", "application/octet-stream")
 
 	uresp, err := client.Do(req)
@@ -606,28 +729,50 @@ func UploadBlob(repository, token, file string) (bool, *Error) {
 		return false, cerr
 	}
 	defer uresp.Body.Close()
+	if uresp.StatusCode != http.StatusCreated {
+		data, _ := ioutil.ReadAll(uresp.Body)
+		cerr := ErrNew(ErrHttpNotFound, fmt.Sprintf("uploading blob sha256:%s failure, status: %s, %s", sha256, uresp.Status, string(data)))
+		return false, cerr
+	}
 	return true, nil
 }
 
-func HasBlob(repository, token, sha256 string) (bool, *Error) {
-	checkUrl := fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/sha256:%s", repository, sha256)
+//MountBlob mounts blob of repository from into the repository of ref, which is only possible inside the same registry
+//registry starts an ordinary upload instead if it could not mount the blob, in which case false is returned
+func MountBlob(ref *Reference, token, from, sha256 string) (bool, *Error) {
+	mount_url := fmt.Sprintf("%s/v2/%s/blobs/uploads/?mount=sha256:%s&from=%s", ref.URL(), ref.Repository, sha256, url.QueryEscape(from))
 	client := &http.Client{}
-	req, err := http.NewRequest("HEAD", checkUrl, nil)
+	req, err := http.NewRequest("POST", mount_url, nil)
 	if err != nil {
 		cerr := ErrNew(err, "could not create http request")
 		return false, cerr
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAuthorization(req, token)
 	resp, err := client.Do(req)
 	if err != nil {
 		cerr := ErrNew(err, "could not execute http request")
 		return false, cerr
 	}
-	if resp != nil {
-		defer resp.Body.Close()
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+func HasBlob(ref *Reference, token, sha256 string) (bool, *Error) {
+	checkUrl := fmt.Sprintf("%s/v2/%s/blobs/sha256:%s", ref.URL(), ref.Repository, sha256)
+	client := &http.Client{}
+	req, err := http.NewRequest("HEAD", checkUrl, nil)
+	if err != nil {
+		cerr := ErrNew(err, "could not create http request")
+		return false, cerr
+	}
+	setAuthorization(req, token)
+	resp, err := client.Do(req)
+	if err != nil {
+		cerr := ErrNew(err, "could not execute http request")
+		return false, cerr
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 200 {
-		fmt.Println(resp)
 		return true, nil
 	}
 	data, _ := ioutil.ReadAll(resp.Body)
@@ -635,17 +780,16 @@ func HasBlob(repository, token, sha256 string) (bool, *Error) {
 	return false, cerr
 }
 
-func DownloadBlob(repository, token, sha256 string) (io.ReadCloser, *Error) {
-	download_url := fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/sha256:%s", repository, sha256)
+func DownloadBlob(ref *Reference, token, sha256 string) (io.ReadCloser, *Error) {
+	download_url := fmt.Sprintf("%s/v2/%s/blobs/sha256:%s", ref.URL(), ref.Repository, sha256)
 	req, err := http.NewRequest("GET", download_url, nil)
 	if err != nil {
 		cerr := ErrNew(err, "could not create http request")
 		return nil, cerr
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	setAuthorization(req, token)
 	client := &http.Client{}
 	resp, err := client.Do(req)
-	fmt.Println(resp)
 	if err != nil {
 		cerr := ErrNew(err, "could not execute http request")
 		return nil, cerr
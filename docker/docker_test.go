@@ -1,18 +1,41 @@
 package docker
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	registry "github.com/JasonYangShadow/lpmx/registry"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestGetToken(t *testing.T) {
 	t.Skip("skip test")
-	token, err := GetToken("JasonYangShadow/ubuntu", "JasonYangShadow", "", "push,pull")
+	ref, _ := ParseReference("JasonYangShadow/ubuntu")
+	token, err := GetToken(ref, "JasonYangShadow", "", "push,pull")
 	if err != nil {
 		t.Error(err)
 	} else {
-		b, err := UploadBlob("JasonYangShadow/ubuntu", token, "/tmp/jRAT9GNac5.tar.gz")
+		b, err := UploadBlob(ref, token, "/tmp/jRAT9GNac5.tar.gz")
 		if err != nil {
 			t.Error(err)
 		} else {
@@ -23,8 +46,9 @@ func TestGetToken(t *testing.T) {
 
 func TestHasBlob(t *testing.T) {
 	t.Skip("skip test")
-	token, _ := GetToken("JasonYangShadow/ubuntu", "JasonYangShadow", "", "push,pull")
-	b, berr := HasBlob("JasonYangShadow/ubuntu", token, "45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0")
+	ref, _ := ParseReference("JasonYangShadow/ubuntu")
+	token, _ := GetToken(ref, "JasonYangShadow", "", "push,pull")
+	b, berr := HasBlob(ref, token, "45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0")
 	if berr != nil {
 		t.Errorf("**** error %s", berr)
 	} else {
@@ -34,8 +58,9 @@ func TestHasBlob(t *testing.T) {
 
 func TestDownloadBlob(t *testing.T) {
 	t.Skip("skip test")
-	token, _ := GetToken("JasonYangShadow/ubuntu", "JasonYangShadow", "", "push,pull")
-	b, berr := DownloadBlob("JasonYangShadow/ubuntu", token, "45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0")
+	ref, _ := ParseReference("JasonYangShadow/ubuntu")
+	token, _ := GetToken(ref, "JasonYangShadow", "", "push,pull")
+	b, berr := DownloadBlob(ref, token, "45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0")
 	if berr != nil {
 		t.Errorf("**** error %s", berr)
 	} else {
@@ -58,3 +83,494 @@ func TestUploadManifest(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestParseReference(t *testing.T) {
+	cases := []struct {
+		in         string
+		registry   string
+		repository string
+		tag        string
+		digest     string
+		str        string
+	}{
+		{"ubuntu", DOCKER_HUB, "library/ubuntu", "latest", "", "ubuntu:latest"},
+		{"ubuntu:16.04", DOCKER_HUB, "library/ubuntu", "16.04", "", "ubuntu:16.04"},
+		{"docker.io/jasonyangshadow/ubuntu:test", DOCKER_HUB, "jasonyangshadow/ubuntu", "test", "", "jasonyangshadow/ubuntu:test"},
+		{"ghcr.io/org/tool:1.2", "ghcr.io", "org/tool", "1.2", "", "ghcr.io/org/tool:1.2"},
+		{"localhost:5000/foo", "localhost:5000", "foo", "latest", "", "localhost:5000/foo:latest"},
+		{"quay.io/x/y@sha256:45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0", "quay.io", "x/y", "", "sha256:45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0", "quay.io/x/y@sha256:45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0"},
+	}
+	for _, c := range cases {
+		ref, err := ParseReference(c.in)
+		if err != nil {
+			t.Errorf("%s: %s", c.in, err)
+			continue
+		}
+		if ref.Registry != c.registry || ref.Repository != c.repository || ref.Tag != c.tag || ref.Digest != c.digest || ref.String() != c.str {
+			t.Errorf("%s: parsed as %+v (%s)", c.in, ref, ref.String())
+		}
+	}
+
+	if ref, _ := ParseReference("localhost:5000/foo"); ref.URL() != "http://localhost:5000" {
+		t.Errorf("local registry should use plain http, got %s", ref.URL())
+	}
+	if _, err := ParseReference("quay.io/x/y@sha256:xyz"); err == nil {
+		t.Error("invalid digest should be rejected")
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	list := &manifestlist.DeserializedManifestList{
+		ManifestList: manifestlist.ManifestList{
+			Manifests: []manifestlist.ManifestDescriptor{
+				{Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"}},
+				{Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v7"}},
+				{Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+			},
+		},
+	}
+
+	plat, err := ParsePlatform("linux/aarch64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	man, err := SelectManifest(list, plat)
+	if err != nil || man.Platform.Architecture != "arm64" {
+		t.Errorf("linux/aarch64 should select arm64 manifest, got %v, %v", man, err)
+	}
+
+	plat, _ = ParsePlatform("linux/arm/v6")
+	if _, err := SelectManifest(list, plat); err == nil {
+		t.Error("linux/arm/v6 should not match any manifest")
+	}
+
+	if _, err := ParsePlatform("linux"); err == nil {
+		t.Error("platform without architecture should be rejected")
+	}
+}
+
+func TestParseImageConfig(t *testing.T) {
+	data := []byte(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/opt/bin:/usr/bin"],"Entrypoint":["python3","-c"],"Cmd":["print('hi')"],"WorkingDir":"/app","User":"nobody"}}`)
+	ic, err := ParseImageConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ic.WorkingDir != "/app" || ic.User != "nobody" || len(ic.Env) != 1 {
+		t.Errorf("image config is not parsed correctly, got %+v", ic)
+	}
+	cmd := ic.DefaultCommand()
+	if len(cmd) != 1 || cmd[0] != `python3 -c 'print('\''hi'\'')'` {
+		t.Errorf("default command is not quoted correctly, got %v", cmd)
+	}
+
+	for user, name := range map[string]string{"nobody": "nobody", "app:staff": "app", "1000": "", "1000:1000": "", "": ""} {
+		if got := (&ImageConfig{User: user}).UserName(); got != name {
+			t.Errorf("user name of %q should be %q, got %q", user, name, got)
+		}
+	}
+
+	if cmd := (&ImageConfig{}).DefaultCommand(); cmd != nil {
+		t.Errorf("empty image config should not have default command, got %v", cmd)
+	}
+	if _, err := ParseImageConfig([]byte("not json")); err == nil {
+		t.Error("invalid image config should be rejected")
+	}
+}
+
+func TestReadDockerArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "abc"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "abc/layer.tar"), []byte("layer"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"config":{"Cmd":["sh"]}}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "manifest.json"), []byte(`[{"Config":"config.json","RepoTags":["busybox:latest","busybox:1"],"Layers":["abc/layer.tar"]}]`), 0644)
+
+	if !IsDockerArchive(dir) || IsOCILayout(dir) {
+		t.Fatal("docker archive is not detected")
+	}
+	images, cerr := ReadDockerArchive(dir)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(images) != 2 || images[0].Name != "busybox:latest" || len(images[0].Layers) != 1 {
+		t.Errorf("docker archive is not parsed correctly, got %+v", images)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "manifest.json"), []byte(`[{"Config":"../config.json","Layers":[]}]`), 0644)
+	if _, cerr := ReadDockerArchive(dir); cerr == nil {
+		t.Error("path outside of archive should be rejected")
+	}
+}
+
+func TestExportImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//layer is an empty tarball compressed with gzip
+	plain := filepath.Join(dir, "layer.tar")
+	ioutil.WriteFile(plain, make([]byte, 1024), 0644)
+	layer := filepath.Join(dir, "layer.tar.gz")
+	if cerr := GzipFile(plain, layer); cerr != nil {
+		t.Fatal(cerr)
+	}
+	config := []byte(`{"config":{"Cmd":["sh"]},"history":[{"created_by":"ADD file"}]}`)
+
+	for _, format := range []string{EXPORT_DOCKER, EXPORT_OCI} {
+		target := filepath.Join(dir, format+".tar")
+		if cerr := ExportImage(target, format, "busybox:1", config, "linux/amd64", []string{layer, layer}); cerr != nil {
+			t.Fatal(cerr)
+		}
+		out := filepath.Join(dir, format)
+		os.MkdirAll(out, 0755)
+		if cerr := Untar(target, out); cerr != nil {
+			t.Fatal(cerr)
+		}
+
+		var images []ArchiveImage
+		var cerr *Error
+		if format == EXPORT_DOCKER {
+			images, cerr = ReadDockerArchive(out)
+		} else {
+			images, cerr = ReadOCILayout(out, HostPlatform())
+		}
+		if cerr != nil {
+			t.Fatal(cerr)
+		}
+		if len(images) != 1 || len(images[0].Layers) != 2 {
+			t.Fatalf("%s archive is not exported correctly, got %+v", format, images)
+		}
+		if ref, _ := ParseReference(images[0].Name); ref.String() != "busybox:1" {
+			t.Errorf("%s archive has wrong image name %s", format, images[0].Name)
+		}
+
+		var image ocispec.Image
+		json.Unmarshal(images[0].Config, &image)
+		diff_id, _ := Sha256file(plain)
+		if len(image.RootFS.DiffIDs) != 2 || image.RootFS.DiffIDs[0].Hex() != diff_id {
+			t.Errorf("%s archive has wrong diff_ids %v", format, image.RootFS.DiffIDs)
+		}
+		if len(image.History) != 2 || image.History[0].CreatedBy != "ADD file" || image.Architecture != "amd64" {
+			t.Errorf("%s archive has wrong history or platform %+v", format, image)
+		}
+	}
+}
+
+func TestVerifyLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "layer.tar")
+	ioutil.WriteFile(plain, []byte("layer content"), 0644)
+	layer := filepath.Join(dir, "layer.tar.gz")
+	if cerr := GzipFile(plain, layer); cerr != nil {
+		t.Fatal(cerr)
+	}
+	data, _ := ioutil.ReadFile(layer)
+	dig := digest.FromBytes(data)
+	diff_id := digest.FromString("layer content")
+
+	if cerr := VerifyLayer(layer, dig, diff_id); cerr != nil {
+		t.Errorf("layer should pass verification, got %v", cerr)
+	}
+	if cerr := VerifyLayer(layer, diff_id, ""); cerr == nil {
+		t.Error("layer with wrong digest should be rejected")
+	}
+	if cerr := VerifyLayer(layer, "", dig); cerr == nil {
+		t.Error("layer with wrong diff_id should be rejected")
+	}
+}
+
+func TestDownloadBlobResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte(strings.Repeat("layer content ", 1000))
+	dig := digest.FromBytes(content)
+	half := len(content) / 2
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		requests++
+		switch requests {
+		case 1:
+			//rate limited
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			//connection is broken after sending half of content
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:half])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		default:
+			if r.Header.Get("Range") != fmt.Sprintf("bytes=%d-", half) {
+				t.Errorf("interrupted download should be resumed, got range: %s", r.Header.Get("Range"))
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[half:])
+		}
+	}))
+	defer server.Close()
+
+	backoff := DOWNLOAD_BACKOFF
+	DOWNLOAD_BACKOFF = time.Millisecond
+	defer func() { DOWNLOAD_BACKOFF = backoff }()
+
+	hub, err := registry.New(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Logf = registry.Quiet
+	var progress int64
+	desc := distribution.Descriptor{Digest: dig, Size: int64(len(content))}
+	filename, cerr := downloadBlob(hub, "library/busybox", desc, dir, &progress)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if data, _ := ioutil.ReadFile(filename); digest.FromBytes(data) != dig || requests != 3 {
+		t.Errorf("blob is not downloaded correctly after %d requests", requests)
+	}
+	if FileExist(filename + PARTIAL_SUFFIX) {
+		t.Error("partial file should be removed after downloading")
+	}
+
+	if d := parseRetryAfter("120", time.Now()); d != 2*time.Minute {
+		t.Errorf("Retry-After in seconds is not parsed correctly, got %s", d)
+	}
+}
+
+func TestDownloadBlobsDedupe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blobs := make(map[string][]byte)
+	var descs []distribution.Descriptor
+	for _, layer := range []string{"base", "empty", "app", "empty"} {
+		content := []byte(strings.Repeat(layer, 100))
+		dig := digest.FromBytes(content)
+		blobs[dig.String()] = content
+		descs = append(descs, distribution.Descriptor{Digest: dig, Size: int64(len(content))})
+	}
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		dig := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		mu.Lock()
+		requests[dig]++
+		mu.Unlock()
+		w.Write(blobs[dig])
+	}))
+	defer server.Close()
+
+	hub, err := registry.New(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Logf = registry.Quiet
+	paths, cerr := downloadBlobs(hub, "library/busybox", descs, dir, 4)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(paths) != len(descs) || paths[1] != paths[3] || paths[0] == paths[1] || paths[2] != dir+"/"+descs[2].Digest.Hex() {
+		t.Errorf("paths should be returned in order of descs, got %v", paths)
+	}
+	for dig, count := range requests {
+		if count != 1 {
+			t.Errorf("blob %s should be downloaded once, got %d", dig, count)
+		}
+	}
+}
+
+func TestResolveManifestStatus(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`))
+	}))
+	defer server.Close()
+
+	backoff := DOWNLOAD_BACKOFF
+	DOWNLOAD_BACKOFF = time.Millisecond
+	defer func() { DOWNLOAD_BACKOFF = backoff }()
+
+	//client without error transport, status of response is checked by registry itself
+	hub := &registry.Registry{URL: server.URL, Client: server.Client(), Logf: registry.Quiet}
+	ref, cerr := ParseReference("busybox:latest")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	_, _, _, cerr = ResolveManifest(hub, ref, HostPlatform())
+	if cerr == nil {
+		t.Fatal("missing manifest should be reported")
+	}
+	if status, _ := httpStatus(cerr.Err); status != http.StatusNotFound || requests != 2 {
+		t.Errorf("429 should be retried and 404 should be returned as status error, got status %d after %d requests: %v", status, requests, cerr)
+	}
+}
+
+func TestResolveManifestDecodeError(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Write([]byte(`{"schemaVersion":`))
+	}))
+	defer server.Close()
+
+	backoff := DOWNLOAD_BACKOFF
+	DOWNLOAD_BACKOFF = time.Millisecond
+	defer func() { DOWNLOAD_BACKOFF = backoff }()
+
+	hub := &registry.Registry{URL: server.URL, Client: server.Client(), Logf: registry.Quiet}
+	ref, cerr := ParseReference("busybox:latest")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	_, _, _, cerr = ResolveManifest(hub, ref, HostPlatform())
+	if cerr == nil {
+		t.Fatal("malformed manifest should be reported")
+	}
+	if requests != 1 {
+		t.Errorf("malformed manifest should not be retried, got %d requests", requests)
+	}
+
+	for _, tc := range []struct {
+		err   error
+		retry bool
+	}{
+		{&url.Error{Op: "Get", URL: server.URL, Err: io.ErrUnexpectedEOF}, true},
+		{&url.Error{Op: "Get", URL: server.URL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, true},
+		{&url.Error{Op: "Get", URL: server.URL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "registry.invalid"}}}, false},
+		{&os.PathError{Op: "write", Path: "/tmp/layer", Err: syscall.ENOSPC}, false},
+	} {
+		if retry, _ := retryable(tc.err); retry != tc.retry {
+			t.Errorf("retryable(%v) should be %v", tc.err, tc.retry)
+		}
+	}
+}
+
+func TestDownloadConfig(t *testing.T) {
+	config := []byte(`{"config":{"Cmd":["sh"]}}`)
+	dig := digest.FromBytes(config)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(config)
+	}))
+	defer server.Close()
+
+	backoff := DOWNLOAD_BACKOFF
+	DOWNLOAD_BACKOFF = time.Millisecond
+	defer func() { DOWNLOAD_BACKOFF = backoff }()
+
+	hub, err := registry.New(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Logf = registry.Quiet
+	data, cerr := downloadConfig(hub, "library/busybox", distribution.Descriptor{Digest: dig, Size: int64(len(config))})
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if string(data) != string(config) || requests != 2 {
+		t.Errorf("image config should be downloaded with retries, got %q after %d requests", data, requests)
+	}
+}
+
+func TestCopyBaseLayers(t *testing.T) {
+	blob := []byte("base layer")
+	dig := digest.FromBytes(blob)
+	base_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/library/ubuntu/blobs/"+dig.String() {
+			w.Write(blob)
+		}
+	}))
+	defer base_server.Close()
+
+	var mounted, uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "POST" && r.URL.Query().Get("mount") != "":
+			mounted = append(mounted, r.URL.Query().Get("mount")+" from "+r.URL.Query().Get("from"))
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "POST":
+			w.Header().Set("Location", "/v2/user/ubuntu/blobs/uploads/1")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			if digest.FromBytes(data).String() != r.URL.Query().Get("digest") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			uploaded = append(uploaded, r.URL.Query().Get("digest"))
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, _ := ParseReference(host + "/user/ubuntu:test")
+	layers := []schema1.FSLayer{{BlobSum: dig}, {BlobSum: dig}}
+
+	//base image inside the same registry is mounted
+	base_ref, _ := ParseReference(host + "/library/ubuntu:16.04")
+	if cerr := copyBaseLayers(ref, "", nil, base_ref, layers); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(mounted) != 1 || mounted[0] != dig.String()+" from library/ubuntu" || len(uploaded) != 0 {
+		t.Errorf("base layer should be mounted once, got mounts %v and uploads %v", mounted, uploaded)
+	}
+
+	//base image inside another registry is downloaded and uploaded
+	mounted = nil
+	base_ref, _ = ParseReference(strings.TrimPrefix(base_server.URL, "http://") + "/library/ubuntu:16.04")
+	base_hub, err := registry.New(base_server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base_hub.Logf = registry.Quiet
+	if cerr := copyBaseLayers(ref, "", base_hub, base_ref, layers); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(mounted) != 0 || len(uploaded) != 1 || uploaded[0] != dig.String() {
+		t.Errorf("base layer should be uploaded once, got mounts %v and uploads %v", mounted, uploaded)
+	}
+}
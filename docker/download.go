@@ -0,0 +1,338 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	registry "github.com/JasonYangShadow/lpmx/registry"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/docker/distribution"
+)
+
+var (
+	DOWNLOAD_PARALLELISM = 3               //number of layers downloaded concurrently by default
+	DOWNLOAD_RETRY       = 5               //number of retries after the first try fails
+	DOWNLOAD_BACKOFF     = 2 * time.Second //initial backoff between retries, doubled after each failure
+	DOWNLOAD_MAX_BACKOFF = 2 * time.Minute //upper limit of backoff, also applied to Retry-After
+	PARTIAL_SUFFIX       = ".partial"      //suffix of files containing partially downloaded blobs
+)
+
+//downloadBlobs downloads blobs into folder concurrently and returns their paths in the same order of descs
+func downloadBlobs(hub *registry.Registry, repository string, descs []distribution.Descriptor, folder string, parallel int) ([]string, *Error) {
+	if parallel < 1 {
+		parallel = DOWNLOAD_PARALLELISM
+	}
+	//the same layer may appear several times in manifest, each blob is downloaded only once
+	var blobs []distribution.Descriptor
+	blob_idx := make(map[string]int)
+	for _, desc := range descs {
+		if _, ok := blob_idx[desc.Digest.String()]; !ok {
+			blob_idx[desc.Digest.String()] = len(blobs)
+			blobs = append(blobs, desc)
+		}
+	}
+
+	var total int64
+	progress := make([]int64, len(blobs))
+	for _, desc := range blobs {
+		total += desc.Size
+	}
+
+	//printing download percentage of all layers
+	done := make(chan struct{})
+	var pwg sync.WaitGroup
+	pwg.Add(1)
+	go func() {
+		defer pwg.Done()
+		for {
+			var curr_size int64
+			for idx := range progress {
+				curr_size += atomic.LoadInt64(&progress[idx])
+			}
+			percentage := 100
+			if total > 0 {
+				percentage = int(float64(curr_size) / float64(total) * 100)
+			}
+			fmt.Printf("\rDownloading... %d/%d [%d/100 complete]", curr_size, total, percentage)
+			select {
+			case <-done:
+				fmt.Println()
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	blob_paths := make([]string, len(blobs))
+	errs := make([]*Error, len(blobs))
+	var failed int32
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for idx := range blobs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			//layers not started yet are skipped once one layer fails
+			if atomic.LoadInt32(&failed) > 0 {
+				return
+			}
+			blob_paths[idx], errs[idx] = downloadBlob(hub, repository, blobs[idx], folder, &progress[idx])
+			if errs[idx] != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}(idx)
+	}
+	wg.Wait()
+	close(done)
+	pwg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	paths := make([]string, len(descs))
+	for idx, desc := range descs {
+		paths[idx] = blob_paths[blob_idx[desc.Digest.String()]]
+	}
+	return paths, nil
+}
+
+//downloadBlob downloads one blob into folder/<hex> with retries, the content is kept in <hex>.partial until it is complete and verified
+func downloadBlob(hub *registry.Registry, repository string, desc distribution.Descriptor, folder string, progress *int64) (string, *Error) {
+	filename := fmt.Sprintf("%s/%s", folder, desc.Digest.Hex())
+	//blob downloaded before is reused if it is intact
+	if FileExist(filename) {
+		if VerifyLayer(filename, desc.Digest, "") == nil {
+			atomic.StoreInt64(progress, desc.Size)
+			return filename, nil
+		}
+		os.Remove(filename)
+	}
+
+	partial := filename + PARTIAL_SUFFIX
+	backoff := DOWNLOAD_BACKOFF
+	var cerr *Error
+	for attempt := 0; attempt <= DOWNLOAD_RETRY; attempt++ {
+		var retry bool
+		var retry_after time.Duration
+		retry, retry_after, cerr = fetchBlob(hub, repository, desc, partial, progress)
+		if cerr == nil {
+			if err := os.Rename(partial, filename); err != nil {
+				cerr := ErrNew(err, fmt.Sprintf("could not rename(move): %s to %s", partial, filename))
+				return "", cerr
+			}
+			return filename, nil
+		}
+		if !retry || attempt == DOWNLOAD_RETRY {
+			break
+		}
+
+		wait := backoff
+		if retry_after > wait {
+			wait = retry_after
+		}
+		if wait > DOWNLOAD_MAX_BACKOFF {
+			wait = DOWNLOAD_MAX_BACKOFF
+		}
+		fmt.Println(fmt.Sprintf("\ndownloading layer %s fails, retry in %s: %s", desc.Digest, wait, cerr.Error()))
+		time.Sleep(wait)
+		backoff *= 2
+	}
+	return "", cerr
+}
+
+//downloadConfig downloads config blob of image with the same retries as layers, the blob is not kept on disk
+func downloadConfig(hub *registry.Registry, repository string, desc distribution.Descriptor) ([]byte, *Error) {
+	if err := desc.Digest.Validate(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("image config has invalid digest %s", desc.Digest))
+		return nil, cerr
+	}
+	temp_dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		cerr := ErrNew(err, "could not create temp dir")
+		return nil, cerr
+	}
+	defer os.RemoveAll(temp_dir)
+
+	var progress int64
+	file, cerr := downloadBlob(hub, repository, desc, temp_dir, &progress)
+	if cerr != nil {
+		return nil, cerr
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("read image config %s failure", desc.Digest))
+		return nil, cerr
+	}
+	return data, nil
+}
+
+//fetchManifest fetches manifest or image index of reference with the same retries as downloading blobs
+func fetchManifest(hub *registry.Registry, repository string, reference string) (distribution.Manifest, distribution.Descriptor, error) {
+	backoff := DOWNLOAD_BACKOFF
+	for attempt := 0; ; attempt++ {
+		man, desc, err := hub.ManifestOrIndex(repository, reference)
+		if err == nil {
+			return man, desc, nil
+		}
+		retry, retry_after := retryable(err)
+		if !retry || attempt == DOWNLOAD_RETRY {
+			return nil, distribution.Descriptor{}, err
+		}
+
+		wait := backoff
+		if retry_after > wait {
+			wait = retry_after
+		}
+		if wait > DOWNLOAD_MAX_BACKOFF {
+			wait = DOWNLOAD_MAX_BACKOFF
+		}
+		fmt.Println(fmt.Sprintf("querying manifest %s fails, retry in %s: %s", reference, wait, err.Error()))
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+//fetchBlob downloads blob into partial file, resuming from the existing content with Range request
+//it returns whether the failure is worth retrying and the delay requested by registry
+func fetchBlob(hub *registry.Registry, repository string, desc distribution.Descriptor, partial string, progress *int64) (bool, time.Duration, *Error) {
+	var offset int64
+	if fi, err := os.Stat(partial); err == nil {
+		offset = fi.Size()
+	}
+	if desc.Size > 0 && offset >= desc.Size {
+		os.Remove(partial)
+		offset = 0
+	}
+
+	reader, start, err := hub.DownloadBlobRange(repository, desc.Digest, offset)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("download layer %s failure", desc.Digest))
+		//range of broken partial file could not be satisfied, start from zero in the next try
+		if status, _ := httpStatus(err); status == http.StatusRequestedRangeNotSatisfiable {
+			os.Remove(partial)
+			return true, 0, cerr
+		}
+		retry, retry_after := retryable(err)
+		return retry, retry_after, cerr
+	}
+	defer reader.Close()
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if start > 0 {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	to, err := os.OpenFile(partial, flag, 0644)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("create file %s failure", partial))
+		return false, 0, cerr
+	}
+	defer to.Close()
+
+	//hash content while downloading, the content downloaded before is hashed firstly
+	digester := desc.Digest.Algorithm().Digester()
+	if start > 0 {
+		from, err := os.Open(partial)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("open file %s failure", partial))
+			return false, 0, cerr
+		}
+		_, err = io.Copy(digester.Hash(), from)
+		from.Close()
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("read file %s failure", partial))
+			return false, 0, cerr
+		}
+	}
+	atomic.StoreInt64(progress, start)
+	counter := &progressWriter{progress: progress, written: start}
+	if _, err := io.Copy(io.MultiWriter(to, digester.Hash(), counter), reader); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("copy file %s content failure", partial))
+		//broken connection is retried while failure of writing local file is not
+		retry, _ := retryable(err)
+		return retry, 0, cerr
+	}
+	if digester.Digest() != desc.Digest {
+		os.Remove(partial)
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("layer %s is corrupted, digest of downloaded content: %s", desc.Digest, digester.Digest()))
+		return true, 0, cerr
+	}
+	return false, 0, nil
+}
+
+//progressWriter records the number of bytes downloaded
+type progressWriter struct {
+	progress *int64
+	written  int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	atomic.StoreInt64(w.progress, w.written)
+	return len(p), nil
+}
+
+//httpStatus extracts the status code and headers of the error returned by registry client
+func httpStatus(err error) (int, http.Header) {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	if herr, ok := err.(*registry.HttpStatusError); ok && herr.Response != nil {
+		return herr.Response.StatusCode, herr.Response.Header
+	}
+	return 0, nil
+}
+
+//retryable checks whether the request should be retried, only 5xx and 429 responses, network errors and truncated responses are retried
+func retryable(err error) (bool, time.Duration) {
+	status, header := httpStatus(err)
+	if status != 0 {
+		if status == http.StatusTooManyRequests || status >= http.StatusInternalServerError {
+			return true, parseRetryAfter(header.Get("Retry-After"), time.Now())
+		}
+		return false, 0
+	}
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	if oerr, ok := err.(*net.OpError); ok {
+		//hosts which could not be resolved are not retried unless the lookup is interrupted
+		if derr, ok := oerr.Err.(*net.DNSError); ok {
+			return derr.IsTimeout || derr.IsTemporary, 0
+		}
+	}
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return true, 0
+	}
+	if _, ok := err.(net.Error); ok {
+		return true, 0
+	}
+	return false, 0
+}
+
+//parseRetryAfter parses Retry-After header, which is either delay in seconds or http date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,405 @@
+package docker
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	EXPORT_DOCKER = "docker"
+	EXPORT_OCI    = "oci"
+)
+
+//exportLayer is one layer prepared for exporting
+type exportLayer struct {
+	Path   string        //path of layer tarball stored by lpmx
+	Digest digest.Digest //digest of layer tarball
+	Size   int64
+	DiffID digest.Digest //digest of uncompressed layer tarball
+}
+
+//ExportImage writes image as the archive loadable by 'docker load' or as the tarball of OCI image layout
+//config is the raw config blob recorded when the image is added, it is updated with the diff_ids and history of layers
+func ExportImage(target string, format string, name string, config []byte, platform string, layers []string) *Error {
+	if format != EXPORT_DOCKER && format != EXPORT_OCI {
+		cerr := ErrNew(ErrType, fmt.Sprintf("export format %s is not supported, should be either %s or %s", format, EXPORT_DOCKER, EXPORT_OCI))
+		return cerr
+	}
+	ref, cerr := ParseReference(name)
+	if cerr != nil {
+		return cerr
+	}
+
+	tmpdir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		cerr := ErrNew(err, "could not create temp dir")
+		return cerr
+	}
+	defer os.RemoveAll(tmpdir)
+
+	var elayers []exportLayer
+	for idx, layer := range layers {
+		fmt.Println(fmt.Sprintf("calculating diff_id of layer %s...", path.Base(layer)))
+		//only 'docker save' format stores uncompressed layers
+		uncompressed := ""
+		if format == EXPORT_DOCKER {
+			uncompressed = fmt.Sprintf("%s/%d.tar", tmpdir, idx)
+		}
+		el, cerr := prepareLayer(layer, uncompressed)
+		if cerr != nil {
+			return cerr
+		}
+		elayers = append(elayers, *el)
+	}
+
+	config, cerr = buildImageConfig(config, platform, elayers)
+	if cerr != nil {
+		return cerr
+	}
+
+	out, err := os.Create(target)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not create file %s", target))
+		return cerr
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+
+	if format == EXPORT_DOCKER {
+		cerr = writeDockerArchive(tw, ref, config, elayers, tmpdir)
+	} else {
+		cerr = writeOCILayout(tw, ref, config, elayers)
+	}
+	if cerr != nil {
+		return cerr
+	}
+	if err := tw.Close(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write file %s", target))
+		return cerr
+	}
+	return nil
+}
+
+//prepareLayer calculates digests of layer, the uncompressed content is kept at uncompressed if it is not empty
+func prepareLayer(layer string, uncompressed string) (*exportLayer, *Error) {
+	sha, cerr := Sha256file(layer)
+	if cerr != nil {
+		return nil, cerr
+	}
+	size, cerr := GetFileSize(layer)
+	if cerr != nil {
+		return nil, cerr
+	}
+	r, cerr := DecompressReader(layer)
+	if cerr != nil {
+		return nil, cerr
+	}
+	defer r.Close()
+	digester := digest.Canonical.Digester()
+	w := io.Writer(digester.Hash())
+	if uncompressed != "" {
+		f, err := os.Create(uncompressed)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not create file %s", uncompressed))
+			return nil, cerr
+		}
+		defer f.Close()
+		w = io.MultiWriter(f, digester.Hash())
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not decompress layer %s", layer))
+		return nil, cerr
+	}
+	return &exportLayer{
+		Path:   layer,
+		Digest: digest.NewDigestFromHex(string(digest.SHA256), sha),
+		Size:   size,
+		DiffID: digester.Digest(),
+	}, nil
+}
+
+//buildImageConfig updates rootfs and history of config so that they match layers, the other fields are kept untouched
+func buildImageConfig(config []byte, platform string, layers []exportLayer) ([]byte, *Error) {
+	image := make(map[string]interface{})
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &image); err != nil {
+			cerr := ErrNew(err, "could not unmarshal image config")
+			return nil, cerr
+		}
+	}
+	plat, cerr := ParsePlatform(platform)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if _, ok := image["architecture"]; !ok {
+		image["architecture"] = plat.Architecture
+	}
+	if _, ok := image["os"]; !ok {
+		image["os"] = plat.OS
+	}
+	if _, ok := image["config"]; !ok {
+		image["config"] = map[string]interface{}{}
+	}
+
+	var diff_ids []string
+	for _, layer := range layers {
+		diff_ids = append(diff_ids, layer.DiffID.String())
+	}
+	image["rootfs"] = map[string]interface{}{
+		"type":     "layers",
+		"diff_ids": diff_ids,
+	}
+
+	//layers committed by lpmx do not have history, entries are appended for them
+	var history []interface{}
+	non_empty := 0
+	if h, ok := image["history"].([]interface{}); ok {
+		for _, entry := range h {
+			if e, eok := entry.(map[string]interface{}); eok {
+				if empty, _ := e["empty_layer"].(bool); !empty {
+					non_empty++
+				}
+			}
+		}
+		history = h
+	}
+	if non_empty > len(layers) {
+		history = nil
+		non_empty = 0
+	}
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	for ; non_empty < len(layers); non_empty++ {
+		history = append(history, map[string]interface{}{
+			"created":    created,
+			"created_by": "lpmx docker commit",
+			"comment":    fmt.Sprintf("layer %s", layers[non_empty].DiffID),
+		})
+	}
+	image["history"] = history
+	if _, ok := image["created"]; !ok {
+		image["created"] = created
+	}
+
+	data, err := json.Marshal(image)
+	if err != nil {
+		cerr := ErrNew(err, "could not marshal image config")
+		return nil, cerr
+	}
+	return data, nil
+}
+
+func writeDockerArchive(tw *tar.Writer, ref *Reference, config []byte, layers []exportLayer, tmpdir string) *Error {
+	config_name := fmt.Sprintf("%s.json", digest.FromBytes(config).Hex())
+	cerr := writeTarEntry(tw, config_name, config)
+	if cerr != nil {
+		return cerr
+	}
+
+	var layer_names []string
+	var layer_id string
+	for idx, layer := range layers {
+		//layer id is chained with its parent, so that identical layers inside one image get different folders
+		layer_id = digest.FromString(fmt.Sprintf("%s %s", layer_id, layer.DiffID)).Hex()
+		cerr := writeTarDir(tw, layer_id)
+		if cerr != nil {
+			return cerr
+		}
+		layer_name := fmt.Sprintf("%s/layer.tar", layer_id)
+		cerr = writeTarFile(tw, layer_name, fmt.Sprintf("%s/%d.tar", tmpdir, idx))
+		if cerr != nil {
+			return cerr
+		}
+		cerr = writeTarEntry(tw, fmt.Sprintf("%s/VERSION", layer_id), []byte("1.0"))
+		if cerr != nil {
+			return cerr
+		}
+		layer_names = append(layer_names, layer_name)
+	}
+
+	repo_tag := ref.String()
+	if ref.Digest != "" {
+		repo_tag = fmt.Sprintf("%s:%s", ref.Name(), DEFAULT_TAG)
+		if ref.Tag != "" {
+			repo_tag = fmt.Sprintf("%s:%s", ref.Name(), ref.Tag)
+		}
+	}
+	manifest := []dockerSaveManifest{{Config: config_name, RepoTags: []string{repo_tag}, Layers: layer_names}}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		cerr := ErrNew(err, "could not marshal manifest.json")
+		return cerr
+	}
+	cerr = writeTarEntry(tw, "manifest.json", data)
+	if cerr != nil {
+		return cerr
+	}
+
+	//repositories is used by old versions of docker
+	tag := ref.Tag
+	if tag == "" {
+		tag = DEFAULT_TAG
+	}
+	repositories := map[string]map[string]string{ref.Name(): {tag: layer_id}}
+	data, err = json.Marshal(repositories)
+	if err != nil {
+		cerr := ErrNew(err, "could not marshal repositories")
+		return cerr
+	}
+	return writeTarEntry(tw, "repositories", data)
+}
+
+func writeOCILayout(tw *tar.Writer, ref *Reference, config []byte, layers []exportLayer) *Error {
+	layout, _ := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	cerr := writeTarEntry(tw, ocispec.ImageLayoutFile, layout)
+	if cerr != nil {
+		return cerr
+	}
+	for _, dir := range []string{"blobs", "blobs/sha256"} {
+		cerr := writeTarDir(tw, dir)
+		if cerr != nil {
+			return cerr
+		}
+	}
+
+	config_digest := digest.FromBytes(config)
+	cerr = writeTarEntry(tw, blobPath(config_digest), config)
+	if cerr != nil {
+		return cerr
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    config_digest,
+			Size:      int64(len(config)),
+		},
+	}
+	for _, layer := range layers {
+		comp, cerr := DetectCompression(layer.Path)
+		if cerr != nil {
+			return cerr
+		}
+		media_type := LayerMediaType(comp)
+		cerr = writeTarFile(tw, blobPath(layer.Digest), layer.Path)
+		if cerr != nil {
+			return cerr
+		}
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+			MediaType: media_type,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		})
+	}
+	man_data, err := json.Marshal(manifest)
+	if err != nil {
+		cerr := ErrNew(err, "could not marshal manifest")
+		return cerr
+	}
+	man_digest := digest.FromBytes(man_data)
+	cerr = writeTarEntry(tw, blobPath(man_digest), man_data)
+	if cerr != nil {
+		return cerr
+	}
+
+	ref_name := ref.Tag
+	if ref_name == "" {
+		ref_name = DEFAULT_TAG
+	}
+	registry := ref.Registry
+	if registry == DOCKER_HUB {
+		registry = DOCKER_HUB_ALIAS[0]
+	}
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    man_digest,
+			Size:      int64(len(man_data)),
+			Annotations: map[string]string{
+				ANNOTATION_IMAGE_NAME: fmt.Sprintf("%s/%s:%s", registry, ref.Repository, ref_name),
+				ANNOTATION_REF_NAME:   ref_name,
+			},
+		}},
+	}
+	index_data, err := json.Marshal(index)
+	if err != nil {
+		cerr := ErrNew(err, "could not marshal index.json")
+		return cerr
+	}
+	return writeTarEntry(tw, "index.json", index_data)
+}
+
+func writeTarDir(tw *tar.Writer, name string) *Error {
+	header := &tar.Header{
+		Name:     name + "/",
+		Mode:     0755,
+		Typeflag: tar.TypeDir,
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		cerr := ErrNew(err, "could not write tar file header")
+		return cerr
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) *Error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		cerr := ErrNew(err, "could not write tar file header")
+		return cerr
+	}
+	if _, err := tw.Write(data); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write %s into tar file", name))
+		return cerr
+	}
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, file string) *Error {
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open file %s", file))
+		return cerr
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		cerr := ErrNew(ErrFileStat, fmt.Sprintf("os.stat %s error: %s", file, err.Error()))
+		return cerr
+	}
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     fi.Size(),
+		Typeflag: tar.TypeReg,
+		ModTime:  fi.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		cerr := ErrNew(err, "could not write tar file header")
+		return cerr
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write %s into tar file", name))
+		return cerr
+	}
+	return nil
+}
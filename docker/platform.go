@@ -0,0 +1,85 @@
+package docker
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+var (
+	//architecture names reported by uname mapped to the names used in manifest lists
+	ARCH_ALIAS = map[string]string{"x86_64": "amd64", "x86-64": "amd64", "aarch64": "arm64", "i386": "386", "i686": "386"}
+)
+
+//Platform selects one manifest out of a manifest list or OCI image index, e.g, linux/arm64 or linux/arm/v7
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+func HostPlatform() *Platform {
+	return &Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+}
+
+//ParsePlatform parses os/arch[/variant], empty string means the platform of host
+func ParsePlatform(str string) (*Platform, *Error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if str == "" {
+		return HostPlatform(), nil
+	}
+	parts := strings.Split(str, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		cerr := ErrNew(ErrType, fmt.Sprintf("platform %s is invalid, the format should be os/arch[/variant], e.g, linux/arm64", str))
+		return nil, cerr
+	}
+	platform := &Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if alias, ok := ARCH_ALIAS[platform.Architecture]; ok {
+		platform.Architecture = alias
+	}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func (p *Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+//Match compares platform with the one declared in manifest list, variant is only compared when it is specified
+func (p *Platform) Match(spec manifestlist.PlatformSpec) bool {
+	if p.OS != spec.OS || p.Architecture != spec.Architecture {
+		return false
+	}
+	if p.Variant != "" && p.Variant != spec.Variant {
+		return false
+	}
+	return true
+}
+
+//SelectManifest returns the descriptor of manifest inside manifest list which matches the platform
+func SelectManifest(list *manifestlist.DeserializedManifestList, platform *Platform) (*manifestlist.ManifestDescriptor, *Error) {
+	var available []string
+	for idx, man := range list.Manifests {
+		if platform.Match(man.Platform) {
+			return &list.Manifests[idx], nil
+		}
+		spec := Platform{OS: man.Platform.OS, Architecture: man.Platform.Architecture, Variant: man.Platform.Variant}
+		available = append(available, spec.String())
+	}
+	cerr := ErrNew(ErrNExist, fmt.Sprintf("no manifest matches platform %s, available platforms: %s", platform, strings.Join(available, ", ")))
+	return nil, cerr
+}
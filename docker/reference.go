@@ -0,0 +1,119 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	DOCKER_HUB  = "registry-1.docker.io"
+	DEFAULT_TAG = "latest"
+)
+
+var (
+	//hostnames which all refer to docker hub
+	DOCKER_HUB_ALIAS = []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+)
+
+//Reference is the parsed form of image names like ghcr.io/org/tool:1.2, quay.io/x/y@sha256:... or ubuntu
+type Reference struct {
+	Registry   string //registry host, e.g, registry-1.docker.io, localhost:5000
+	Repository string //repository path on the registry, e.g, library/ubuntu
+	Tag        string
+	Digest     string
+}
+
+func ParseReference(name string) (*Reference, *Error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		cerr := ErrNew(ErrNil, "image reference is empty")
+		return nil, cerr
+	}
+
+	ref := new(Reference)
+	remainder := name
+	if idx := strings.Index(remainder, "@"); idx != -1 {
+		dig, err := digest.Parse(remainder[idx+1:])
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("image reference %s contains invalid digest", name))
+			return nil, cerr
+		}
+		ref.Digest = dig.String()
+		remainder = remainder[:idx]
+	}
+
+	//tag is separated by the last ':' which appears after the last '/', so that localhost:5000/foo is not treated as tag
+	if idx := strings.LastIndex(remainder, ":"); idx != -1 && idx > strings.LastIndex(remainder, "/") {
+		ref.Tag = remainder[idx+1:]
+		remainder = remainder[:idx]
+	}
+
+	//the first component is a registry host only if it looks like a hostname
+	ref.Registry = DOCKER_HUB
+	if idx := strings.Index(remainder, "/"); idx != -1 {
+		host := remainder[:idx]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			remainder = remainder[idx+1:]
+		}
+	}
+	for _, alias := range DOCKER_HUB_ALIAS {
+		if ref.Registry == alias {
+			ref.Registry = DOCKER_HUB
+		}
+	}
+
+	if remainder == "" || strings.HasPrefix(remainder, "/") || strings.HasSuffix(remainder, "/") || strings.Contains(remainder, "//") {
+		cerr := ErrNew(ErrType, fmt.Sprintf("image reference %s has invalid repository name", name))
+		return nil, cerr
+	}
+	if ref.Registry == DOCKER_HUB && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	ref.Repository = remainder
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DEFAULT_TAG
+	}
+	return ref, nil
+}
+
+//URL returns the base url of registry, plain http is only used for registries running on local host
+func (ref *Reference) URL() string {
+	host := strings.Split(ref.Registry, ":")[0]
+	if host == "localhost" || host == "127.0.0.1" {
+		return fmt.Sprintf("http://%s", ref.Registry)
+	}
+	return fmt.Sprintf("https://%s", ref.Registry)
+}
+
+//Reference returns the digest if exists, otherwise the tag, used for querying manifests
+func (ref *Reference) Reference() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	return ref.Tag
+}
+
+//Name returns the short repository name used by lpmx locally, docker hub images keep their familiar names, e.g, ubuntu
+func (ref *Reference) Name() string {
+	if ref.Registry == DOCKER_HUB {
+		return strings.TrimPrefix(ref.Repository, "library/")
+	}
+	return fmt.Sprintf("%s/%s", ref.Registry, ref.Repository)
+}
+
+//String returns the normalized image name, which is used as the key of Docker.Images
+func (ref *Reference) String() string {
+	name := ref.Name()
+	if ref.Tag != "" {
+		name = fmt.Sprintf("%s:%s", name, ref.Tag)
+	}
+	if ref.Digest != "" {
+		name = fmt.Sprintf("%s@%s", name, ref.Digest)
+	}
+	return name
+}
@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	digest "github.com/opencontainers/go-digest"
+)
+
+//VerifyLayer checks layer tarball against its digest and diff_id(digest of uncompressed content), empty digests are skipped
+func VerifyLayer(file string, dig digest.Digest, diff_id digest.Digest) *Error {
+	if dig != "" {
+		actual, cerr := digestFile(file, dig, false)
+		if cerr != nil {
+			return cerr
+		}
+		if actual != dig {
+			cerr := ErrNew(ErrMismatch, fmt.Sprintf("layer %s is corrupted, want digest: %s, actual: %s", file, dig, actual))
+			return cerr
+		}
+	}
+	if diff_id != "" {
+		actual, cerr := digestFile(file, diff_id, true)
+		if cerr != nil {
+			return cerr
+		}
+		if actual != diff_id {
+			cerr := ErrNew(ErrMismatch, fmt.Sprintf("layer %s is corrupted, want diff_id: %s, actual: %s", file, diff_id, actual))
+			return cerr
+		}
+	}
+	return nil
+}
+
+//digestFile calculates digest of file with the algorithm of dig, the decompressed content is used if decompress is true
+func digestFile(file string, dig digest.Digest, decompress bool) (digest.Digest, *Error) {
+	if err := dig.Validate(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("digest %s is invalid", dig))
+		return "", cerr
+	}
+	var r io.ReadCloser
+	if decompress {
+		dr, cerr := DecompressReader(file)
+		if cerr != nil {
+			return "", cerr
+		}
+		r = dr
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not open file %s", file))
+			return "", cerr
+		}
+		r = f
+	}
+	defer r.Close()
+	actual, err := dig.Algorithm().FromReader(r)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not calculate digest of %s", file))
+		return "", cerr
+	}
+	return actual, nil
+}
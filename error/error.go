@@ -27,6 +27,7 @@ var (
 	ErrZero             = errors.New("size 0 error")
 	ErrPidLive          = errors.New("pid file still lives")
 	ErrOperation        = errors.New("operations can not be done")
+	ErrAmbiguous        = errors.New("reference matches more than one target")
 )
 
 type Error struct {
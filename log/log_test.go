@@ -2,6 +2,10 @@ package log
 
 import (
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -9,3 +13,65 @@ func TestLog(t *testing.T) {
 	LOGGER.SetLevel(logrus.DebugLevel)
 	LOGGER.Debug("test logrus")
 }
+
+func TestRotateLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	max_size, backups := LOG_MAX_SIZE, LOG_BACKUPS
+	LOG_MAX_SIZE, LOG_BACKUPS = 100, 2
+	defer func() {
+		LOG_MAX_SIZE, LOG_BACKUPS = max_size, backups
+	}()
+
+	rlog, err := NewRotateLog(dir, "container.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := rlog.Writer("stdout")
+	stderr := rlog.Writer("stderr")
+	stdout.Write([]byte("first line\nsecond "))
+	stderr.Write([]byte("error line\n"))
+	stdout.Write([]byte("line\n"))
+	for i := 0; i < 10; i++ {
+		stdout.Write([]byte("filling the log file\n"))
+	}
+	stdout.Write([]byte("partial"))
+	stdout.Flush()
+	rlog.Close()
+
+	files := LogFiles(dir, "container.log")
+	if len(files) != 3 || files[2] != filepath.Join(dir, "container.log") {
+		t.Fatalf("log should be rotated into 2 backups, got %v", files)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "container.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	last := ParseLogLine(lines[len(lines)-1])
+	if last.Time.IsZero() || last.Stream != "stdout" || last.Text != "partial" {
+		t.Errorf("partial line should be flushed, got %v", last)
+	}
+
+	//the oldest lines are dropped with the oldest backup
+	var texts []string
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ReadLogLines(f, func(line LogLine) {
+			texts = append(texts, line.Stream+":"+line.Text)
+		})
+		f.Close()
+	}
+	if texts[len(texts)-1] != "stdout:partial" || len(texts) >= 14 {
+		t.Errorf("lines are not read in order, got %v", texts)
+	}
+	if line := ParseLogLine("plain text"); !line.Time.IsZero() || line.Text != "plain text" {
+		t.Errorf("line without timestamp should be kept, got %v", line)
+	}
+}
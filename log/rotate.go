@@ -0,0 +1,170 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	LOG_MAX_SIZE int64 = 10 * 1024 * 1024 //size of log file before it is rotated
+	LOG_BACKUPS        = 5                //number of rotated log files kept
+)
+
+//RotateLog writes lines of several streams into dir/name with timestamps, e.g, '2006-01-02T15:04:05.999999999Z stdout hello'
+//the file is rotated to name.1, name.2... once it exceeds LOG_MAX_SIZE
+type RotateLog struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+//LogLine is one line read from the log written by RotateLog
+type LogLine struct {
+	Time   time.Time
+	Stream string
+	Text   string
+}
+
+func NewRotateLog(dir string, name string) (*RotateLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &RotateLog{path: filepath.Join(dir, name)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *RotateLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = fi.Size()
+	return nil
+}
+
+func (l *RotateLog) rotate() error {
+	l.file.Close()
+	for idx := LOG_BACKUPS - 1; idx > 0; idx-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, idx), fmt.Sprintf("%s.%d", l.path, idx+1))
+	}
+	if LOG_BACKUPS > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *RotateLog) writeLine(stream string, text []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size >= LOG_MAX_SIZE {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	line := fmt.Sprintf("%s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), stream, text)
+	n, err := l.file.WriteString(line)
+	l.size += int64(n)
+	return err
+}
+
+//Writer returns writer of stream, its partial line is written by Flush
+func (l *RotateLog) Writer(stream string) *StreamWriter {
+	return &StreamWriter{log: l, stream: stream}
+}
+
+func (l *RotateLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+//StreamWriter splits the output of one stream into lines written into RotateLog
+type StreamWriter struct {
+	log    *RotateLog
+	stream string
+	buf    []byte
+}
+
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		if err := w.log.writeLine(w.stream, w.buf[:idx]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (w *StreamWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.log.writeLine(w.stream, w.buf)
+	w.buf = nil
+	return err
+}
+
+//LogFiles returns the log files of dir/name, the oldest first
+func LogFiles(dir string, name string) []string {
+	var files []string
+	base := filepath.Join(dir, name)
+	for idx := LOG_BACKUPS; idx > 0; idx-- {
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", base, idx)); err == nil {
+			files = append(files, fmt.Sprintf("%s.%d", base, idx))
+		}
+	}
+	if _, err := os.Stat(base); err == nil {
+		files = append(files, base)
+	}
+	return files
+}
+
+//ParseLogLine parses line written by RotateLog, lines in other formats are returned as they are with zero time
+func ParseLogLine(line string) LogLine {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) == 3 {
+		if t, err := time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+			return LogLine{Time: t, Stream: parts[1], Text: parts[2]}
+		}
+	}
+	return LogLine{Stream: "stdout", Text: line}
+}
+
+//ReadLogLines calls fn for each line of r, the remaining partial line is returned
+func ReadLogLines(r io.Reader, fn func(LogLine)) (string, error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return line, nil
+			}
+			return line, err
+		}
+		fn(ParseLogLine(strings.TrimSuffix(line, "\n")))
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -64,6 +65,7 @@ func main() {
 	initCmd.Flags().BoolVarP(&InitReset, "reset", "r", false, "initialize by force(optional)")
 	initCmd.Flags().StringVarP(&InitDep, "dependency", "d", "", "dependency tar ball(optional)")
 
+	var ListFormat string
 	var listCmd = &cobra.Command{
 		Use:   "list",
 		Short: "list the containers in lpmx system",
@@ -77,13 +79,30 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := List()
+			records, err := List()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+			table := Table{Header: []string{"ContainerID", "ContainerName", "Status", "PID", "RPC", "DockerBase", "Image"}}
+			for _, r := range records {
+				pid, rpc := "NA", "NA"
+				if r.Pid > 0 {
+					pid = strconv.Itoa(r.Pid)
+				}
+				if r.RPC > 0 {
+					rpc = strconv.Itoa(r.RPC)
+				}
+				table.Rows = append(table.Rows, []string{r.Id, r.Name, r.Status, pid, rpc, strconv.FormatBool(r.DockerBase), r.Image})
+			}
+			err = WriteFormat(os.Stdout, ListFormat, records, table)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
 			}
 		},
 	}
+	listCmd.Flags().StringVarP(&ListFormat, "format", "f", "table", "optional(table, json, yaml or go-template=TEMPLATE)")
 
 	var RunSource string
 	var RunConfig string
@@ -138,6 +157,7 @@ func main() {
 
 	var GetId string
 	var GetName string
+	var GetFormat string
 	var getCmd = &cobra.Command{
 		Use:   "get",
 		Short: "get settings from memcache server",
@@ -157,17 +177,25 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := Get(GetId, GetName)
+			record, err := Get(GetId, GetName)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+			table := Table{Header: []string{"ContainerID", "PROGRAM", "ALLOW_PRIVILEGES", "DENY_PRIVILEGES", "REMAP"}}
+			table.Rows = append(table.Rows, []string{record.Id, record.Program, strings.Join(record.Allow, ";"), strings.Join(record.Deny, ";"), strings.Join(record.Map, ";")})
+			err = WriteFormat(os.Stdout, GetFormat, record, table)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
 			}
 		},
 	}
-	getCmd.Flags().StringVarP(&GetId, "id", "i", "", "required")
+	getCmd.Flags().StringVarP(&GetId, "id", "i", "", "required(container id, name or unique id prefix)")
 	getCmd.MarkFlagRequired("id")
 	getCmd.Flags().StringVarP(&GetName, "name", "n", "", "required")
 	getCmd.MarkFlagRequired("name")
+	getCmd.Flags().StringVarP(&GetFormat, "format", "f", "table", "optional(table, json, yaml or go-template=TEMPLATE)")
 
 	var RExecIp string
 	var RExecPort string
@@ -213,6 +241,7 @@ func main() {
 
 	var RQueryIp string
 	var RQueryPort string
+	var RQueryFormat string
 	var rpcQueryCmd = &cobra.Command{
 		Use:   "query",
 		Short: "query the information of commands executed remotely",
@@ -227,15 +256,18 @@ func main() {
 		},
 
 		Run: func(cmd *cobra.Command, args []string) {
-			res, err := RPCQuery(RQueryIp, RQueryPort)
+			records, err := RPCQuery(RQueryIp, RQueryPort)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
-			} else {
-				fmt.Println("PID", "CMD")
-				for k, v := range res.RPCMap {
-					fmt.Println(k, v)
-				}
+			}
+			table := Table{Header: []string{"PID", "CMD"}}
+			for _, r := range records {
+				table.Rows = append(table.Rows, []string{strconv.Itoa(r.Pid), r.Cmd})
+			}
+			err = WriteFormat(os.Stdout, RQueryFormat, records, table)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
 				return
 			}
 		},
@@ -244,6 +276,7 @@ func main() {
 	rpcQueryCmd.MarkFlagRequired("ip")
 	rpcQueryCmd.Flags().StringVarP(&RQueryPort, "port", "p", "", "required")
 	rpcQueryCmd.MarkFlagRequired("port")
+	rpcQueryCmd.Flags().StringVarP(&RQueryFormat, "format", "f", "table", "optional(table, json, yaml or go-template=TEMPLATE)")
 
 	var RDeleteIp string
 	var RDeletePort string
@@ -294,10 +327,12 @@ func main() {
 	//docker cmd
 	var DockerDownloadUser string
 	var DockerDownloadPass string
+	var DockerDownloadPlatform string
+	var DockerDownloadParallel int
 	var dockerDownloadCmd = &cobra.Command{
 		Use:   "download",
-		Short: "download the docker images from docker hub",
-		Long:  "docker download sub-command is one advanced command of lpmx, which is used for downloading the images from docker hub",
+		Short: "download the docker images from docker hub or other registries",
+		Long:  "docker download sub-command is one advanced command of lpmx, which is used for downloading the images from docker hub or other registries, e.g, ubuntu:16.04, ghcr.io/org/tool:1.2 or localhost:5000/foo",
 		Args:  cobra.ExactArgs(1),
 		PreRun: func(cmd *cobra.Command, args []string) {
 			err := checkCompleteness()
@@ -307,7 +342,7 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerDownload(args[0], DockerDownloadUser, DockerDownloadPass)
+			err := DockerDownload(args[0], DockerDownloadUser, DockerDownloadPass, DockerDownloadPlatform, DockerDownloadParallel)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -319,11 +354,16 @@ func main() {
 	}
 	dockerDownloadCmd.Flags().StringVarP(&DockerDownloadUser, "user", "u", "", "optional")
 	dockerDownloadCmd.Flags().StringVarP(&DockerDownloadPass, "pass", "p", "", "optional")
+	dockerDownloadCmd.Flags().StringVarP(&DockerDownloadPlatform, "platform", "", "", "optional(platform used for multi-arch images, e.g, linux/arm64, default is the platform of host)")
+	dockerDownloadCmd.Flags().IntVarP(&DockerDownloadParallel, "parallel", "", 0, "optional(number of layers downloaded concurrently, default is 3)")
 
+	var DockerAddName string
+	var DockerAddPlatform string
+	var DockerAddSetting string
 	var dockerAddCmd = &cobra.Command{
 		Use:   "add",
 		Short: "add the local docker image to system",
-		Long:  "docker add sub-command is one advanced command of lpmx, which is used for adding packaged docker image to lpmx system",
+		Long:  "docker add sub-command is one advanced command of lpmx, which is used for adding docker image packaged by 'lpmx docker package', saved by 'docker save' or stored as OCI image layout(directory or tarball) to lpmx system",
 		Args:  cobra.ExactArgs(1),
 		PreRun: func(cmd *cobra.Command, args []string) {
 			err := checkCompleteness()
@@ -333,7 +373,7 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerAdd(args[0])
+			err := DockerAdd(args[0], DockerAddName, DockerAddPlatform, DockerAddSetting)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -344,8 +384,14 @@ func main() {
 		},
 	}
 
+	dockerAddCmd.Flags().StringVarP(&DockerAddName, "name", "n", "", "optional(name of image to add, required if the image inside archive is untagged)")
+	dockerAddCmd.Flags().StringVarP(&DockerAddPlatform, "platform", "", "", "optional(platform used for multi-arch OCI image layout, e.g, linux/arm64, default is the platform of host)")
+	dockerAddCmd.Flags().StringVarP(&DockerAddSetting, "setting", "s", "", "optional(path of local setting.yml of image, default is the one inside package or the one downloaded from setting repository)")
+
 	var DockerPackageUser string
 	var DockerPackagePass string
+	var DockerPackagePlatform string
+	var DockerPackageParallel int
 	var dockerPackageCmd = &cobra.Command{
 		Use:   "package",
 		Short: "package the docker images from docker hub for offline usage",
@@ -359,7 +405,7 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerPackage(args[0], DockerPackageUser, DockerPackagePass)
+			err := DockerPackage(args[0], DockerPackageUser, DockerPackagePass, DockerPackagePlatform, DockerPackageParallel)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -371,10 +417,17 @@ func main() {
 	}
 	dockerPackageCmd.Flags().StringVarP(&DockerPackageUser, "user", "u", "", "optional")
 	dockerPackageCmd.Flags().StringVarP(&DockerPackagePass, "pass", "p", "", "optional")
+	dockerPackageCmd.Flags().StringVarP(&DockerPackagePlatform, "platform", "", "", "optional(platform used for multi-arch images, e.g, linux/arm64, default is the platform of host)")
+	dockerPackageCmd.Flags().IntVarP(&DockerPackageParallel, "parallel", "", 0, "optional(number of layers downloaded concurrently, default is 3)")
 
 	var DockerCommitId string
 	var DockerCommitName string
 	var DockerCommitTag string
+	var DockerCommitCompression string
+	var DockerCommitReproducible bool
+	var DockerCommitDryRun bool
+	var DockerCommitMessage string
+	var DockerCommitAuthor string
 	var dockerCommitCmd = &cobra.Command{
 		Use:   "commit",
 		Short: "commit docker container",
@@ -388,7 +441,13 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerCommit(DockerCommitId, DockerCommitName, DockerCommitTag)
+			err := DockerCommit(DockerCommitId, DockerCommitName, DockerCommitTag, CommitOptions{
+				Compression:  DockerCommitCompression,
+				Reproducible: DockerCommitReproducible,
+				DryRun:       DockerCommitDryRun,
+				Message:      DockerCommitMessage,
+				Author:       DockerCommitAuthor,
+			})
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -398,12 +457,128 @@ func main() {
 			}
 		},
 	}
-	dockerCommitCmd.Flags().StringVarP(&DockerCommitId, "id", "i", "", "required")
+	dockerCommitCmd.Flags().StringVarP(&DockerCommitId, "id", "i", "", "required(container id, name or unique id prefix)")
 	dockerCommitCmd.MarkFlagRequired("id")
 	dockerCommitCmd.Flags().StringVarP(&DockerCommitName, "name", "n", "", "required")
 	dockerCommitCmd.MarkFlagRequired("name")
 	dockerCommitCmd.Flags().StringVarP(&DockerCommitTag, "tag", "t", "", "required")
 	dockerCommitCmd.MarkFlagRequired("tag")
+	dockerCommitCmd.Flags().StringVarP(&DockerCommitCompression, "compression", "c", "gzip", "optional(compression of committed layer, either gzip or zstd)")
+	dockerCommitCmd.Flags().BoolVarP(&DockerCommitReproducible, "reproducible", "", false, "optional(write layer with sorted entries, timestamps of SOURCE_DATE_EPOCH and no owners, so that identical content produces identical layer)")
+	dockerCommitCmd.Flags().BoolVarP(&DockerCommitDryRun, "dry-run", "", false, "optional(only list the paths excluded by commit_exclude of setting.yml and .lpmxignore)")
+	dockerCommitCmd.Flags().StringVarP(&DockerCommitMessage, "message", "m", "", "optional(message recorded inside container history)")
+	dockerCommitCmd.Flags().StringVarP(&DockerCommitAuthor, "author", "", "", "optional(author recorded inside container history, default is current user)")
+
+	var DockerExportOutput string
+	var DockerExportFormat string
+	var dockerExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "export the local docker image",
+		Long:  "docker export sub-command is the advanced command of lpmx, which is used for exporting images(including committed ones) as the archive loadable by 'docker load' or as OCI image layout",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := DockerExport(args[0], DockerExportOutput, DockerExportFormat)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+	dockerExportCmd.Flags().StringVarP(&DockerExportOutput, "output", "o", "", "required")
+	dockerExportCmd.MarkFlagRequired("output")
+	dockerExportCmd.Flags().StringVarP(&DockerExportFormat, "format", "f", "docker", "optional(archive format, either docker or oci)")
+
+	var DockerSquashName string
+	var DockerSquashTag string
+	var dockerSquashCmd = &cobra.Command{
+		Use:   "squash",
+		Short: "squash the layers of docker image or container",
+		Long:  "docker squash sub-command is the advanced command of lpmx, which is used for merging the layers of one image(or the committed layers of one container) into a single layer registered as new image, stopped container is rebased onto the new image",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := DockerSquash(args[0], DockerSquashName, DockerSquashTag)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+	dockerSquashCmd.Flags().StringVarP(&DockerSquashName, "name", "n", "", "optional(name of new image, default is the name of source image)")
+	dockerSquashCmd.Flags().StringVarP(&DockerSquashTag, "tag", "t", "", "optional(tag of new image, default is the tag of source image followed by '-squashed')")
+
+	var dockerVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "verify the layers of local docker images",
+		Long:  "docker verify sub-command is the advanced command of lpmx, which is used for re-hashing the layers of one image(or all images if no image is given) and reporting corrupted or missing ones",
+		Args:  cobra.MaximumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			name := ""
+			if len(args) > 0 {
+				name = args[0]
+			}
+			err := DockerVerify(name)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+
+	var DockerGCDryRun bool
+	var dockerGCCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "remove unused layers and workspaces",
+		Long:  "docker gc sub-command is the advanced command of lpmx, which is used for removing layer tarballs, extracted layers and workspaces not referenced by any image or container",
+		Args:  cobra.ExactArgs(0),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := DockerGC(DockerGCDryRun)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+	dockerGCCmd.Flags().BoolVarP(&DockerGCDryRun, "dry-run", "", false, "optional(only print what would be removed)")
 
 	var DockerCreateName string
 	var dockerCreateCmd = &cobra.Command{
@@ -464,7 +639,7 @@ func main() {
 
 	var dockerSearchCmd = &cobra.Command{
 		Use:   "search",
-		Short: "search the docker images from docker hub",
+		Short: "search the docker images from docker hub or other registries",
 		Long:  "docker search sub-command is the advanced command of lpmx, which is used for searching the images from docker hub",
 		Args:  cobra.ExactArgs(1),
 		PreRun: func(cmd *cobra.Command, args []string) {
@@ -484,6 +659,7 @@ func main() {
 		},
 	}
 
+	var DockerListFormat string
 	var dockerListCmd = &cobra.Command{
 		Use:   "list",
 		Short: "list local docker images",
@@ -497,13 +673,23 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerList()
+			records, err := DockerList()
+			if err != nil {
+				LOGGER.Error(err.Error())
+				return
+			}
+			table := Table{Header: []string{"Name", "Digest", "Platform", "Layers", "Size"}}
+			for _, r := range records {
+				table.Rows = append(table.Rows, []string{r.Name, r.Digest, r.Platform, strconv.Itoa(len(r.Layers)), strconv.FormatInt(r.Size, 10)})
+			}
+			err = WriteFormat(os.Stdout, DockerListFormat, records, table)
 			if err != nil {
 				LOGGER.Error(err.Error())
 				return
 			}
 		},
 	}
+	dockerListCmd.Flags().StringVarP(&DockerListFormat, "format", "f", "table", "optional(table, json, yaml or go-template=TEMPLATE)")
 
 	var dockerResetCmd = &cobra.Command{
 		Use:   "reset",
@@ -536,7 +722,7 @@ func main() {
 	var DockerPushId string
 	var dockerPushCmd = &cobra.Command{
 		Use:   "push",
-		Short: "push local fake unionfs layer to dockerhub",
+		Short: "push local fake unionfs layer to dockerhub or other registries",
 		Long:  "docker push sub-command is the advanced command of lpmx, which is used for pacaking and pushing current rw layer to dockerhub.",
 		Args:  cobra.ExactArgs(0),
 		PreRun: func(cmd *cobra.Command, args []string) {
@@ -547,7 +733,7 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerPush(DockerPushUser, DockerPushPass, DockerPushName, DockerPushPass, DockerPushId)
+			err := DockerPush(DockerPushUser, DockerPushPass, DockerPushName, DockerPushTag, DockerPushId)
 			if err != nil {
 				LOGGER.Error(err.Error())
 				return
@@ -563,7 +749,7 @@ func main() {
 	dockerPushCmd.MarkFlagRequired("name")
 	dockerPushCmd.Flags().StringVarP(&DockerPushTag, "tag", "t", "", "required")
 	dockerPushCmd.MarkFlagRequired("tag")
-	dockerPushCmd.Flags().StringVarP(&DockerPushId, "id", "i", "", "required")
+	dockerPushCmd.Flags().StringVarP(&DockerPushId, "id", "i", "", "required(container id, name or unique id prefix)")
 	dockerPushCmd.MarkFlagRequired("id")
 
 	var dockerCmd = &cobra.Command{
@@ -571,7 +757,7 @@ func main() {
 		Short: "docker command",
 		Long:  "docker command is the advanced comand of lpmx, which is used for executing docker related commands",
 	}
-	dockerCmd.AddCommand(dockerCreateCmd, dockerSearchCmd, dockerListCmd, dockerDeleteCmd, dockerDownloadCmd, dockerResetCmd, dockerPackageCmd, dockerAddCmd, dockerCommitCmd)
+	dockerCmd.AddCommand(dockerCreateCmd, dockerSearchCmd, dockerListCmd, dockerDeleteCmd, dockerDownloadCmd, dockerResetCmd, dockerPackageCmd, dockerAddCmd, dockerCommitCmd, dockerPushCmd, dockerExportCmd, dockerVerifyCmd, dockerGCCmd, dockerSquashCmd)
 
 	var ExposeId string
 	var ExposeName string
@@ -598,11 +784,12 @@ func main() {
 			}
 		},
 	}
-	exposeCmd.Flags().StringVarP(&ExposeId, "id", "i", "", "required")
+	exposeCmd.Flags().StringVarP(&ExposeId, "id", "i", "", "required(container id, name or unique id prefix)")
 	exposeCmd.MarkFlagRequired("id")
 	exposeCmd.Flags().StringVarP(&ExposeName, "name", "n", "", "required")
 	exposeCmd.MarkFlagRequired("name")
 
+	var ResumeDetach bool
 	var resumeCmd = &cobra.Command{
 		Use:   "resume",
 		Short: "resume the registered container",
@@ -626,7 +813,256 @@ func main() {
 		},
 
 		Run: func(cmd *cobra.Command, args []string) {
-			err := Resume(args[0], args[1:]...)
+			err := Resume(args[0], ResumeDetach, args[1:]...)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+
+	var DiffJson bool
+	var DiffSize bool
+	var diffCmd = &cobra.Command{
+		Use:   "diff",
+		Short: "show the filesystem changes of container",
+		Long:  "diff command is the basic command of lpmx, which is used for listing paths added(A), changed(C) and deleted(D) inside the rw layer of container via id, relative to its image layers",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Diff(args[0], DiffJson, DiffSize)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+	diffCmd.Flags().BoolVarP(&DiffJson, "json", "j", false, "optional(print changes in json format)")
+	diffCmd.Flags().BoolVarP(&DiffSize, "size", "s", false, "optional(print file sizes and the summary of changes)")
+
+	var cpCmd = &cobra.Command{
+		Use:   "cp",
+		Short: "copy files between container and host",
+		Long:  "cp command is the basic command of lpmx, which is used for copying files out of container(lpmx cp <id>:<path> <host path>) or into container(lpmx cp <host path> <id>:<path>), container does not need to be running",
+		Args:  cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Cp(args[0], args[1])
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+
+	var lsCmd = &cobra.Command{
+		Use:   "ls",
+		Short: "list folder inside container or image",
+		Long:  "ls command is the basic command of lpmx, which is used for listing folder(root folder by default) inside the merged layers of container via id or image via name, together with the layer providing each entry, entries mapped by add_map of setting.yml are marked, container does not need to be running",
+		Args:  cobra.RangeArgs(1, 2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			in := "/"
+			if len(args) > 1 {
+				in = args[1]
+			}
+			err := Ls(args[0], in)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+
+	var catCmd = &cobra.Command{
+		Use:   "cat",
+		Short: "print file inside container or image",
+		Long:  "cat command is the basic command of lpmx, which is used for printing file inside the merged layers of container via id or image via name, container does not need to be running",
+		Args:  cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Cat(args[0], args[1])
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+
+	var FindName string
+	var FindType string
+	var findCmd = &cobra.Command{
+		Use:   "find",
+		Short: "search files inside container or image",
+		Long:  "find command is the basic command of lpmx, which is used for searching folder(root folder by default) inside the merged layers of container via id or image via name, together with the layer providing each entry, entries mapped by add_map of setting.yml are marked, container does not need to be running",
+		Args:  cobra.RangeArgs(1, 2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			in := "/"
+			if len(args) > 1 {
+				in = args[1]
+			}
+			err := Find(args[0], in, FindName, FindType)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+	findCmd.Flags().StringVarP(&FindName, "name", "n", "", "optional(shell pattern matching the names of entries, e.g, 'libc.so*')")
+	findCmd.Flags().StringVarP(&FindType, "type", "t", "", "optional(type of entries, f for regular files, d for folders and l for symlinks)")
+
+	var StopTimeout int
+	var stopCmd = &cobra.Command{
+		Use:   "stop",
+		Short: "stop the running container",
+		Long:  "stop command is the basic command of lpmx, which is used for terminating all the processes of container via id, the ones still alive after timeout are killed, faked-sysv and rpc service of container are cleaned up as well",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Stop(args[0], StopTimeout)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+	stopCmd.Flags().IntVarP(&StopTimeout, "timeout", "t", 10, "optional(seconds to wait before killing processes)")
+
+	var KillSignal string
+	var killCmd = &cobra.Command{
+		Use:   "kill",
+		Short: "send signal to the running container",
+		Long:  "kill command is the basic command of lpmx, which is used for sending signal to all the processes of container via id, container is cleaned up if they all exit",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Kill(args[0], KillSignal)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+	killCmd.Flags().StringVarP(&KillSignal, "signal", "s", "KILL", "optional(signal sent to processes, e.g, TERM, HUP or 9)")
+
+	var execCmd = &cobra.Command{
+		Use:   "exec",
+		Short: "execute command inside the running container",
+		Long:  "exec command is the basic command of lpmx, which is used for running command(or interactive shell if no command is given) inside the running container via id, sharing the environment of the shell started by resume",
+		Args:  cobra.MinimumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Exec(args[0], args[1:]...)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+
+	var LogsFollow bool
+	var LogsSince string
+	var logsCmd = &cobra.Command{
+		Use:   "logs",
+		Short: "print the output of container running in background",
+		Long:  "logs command is the basic command of lpmx, which is used for printing the output of container via id started by 'lpmx resume -d'",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Logs(args[0], LogsFollow, LogsSince)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+	logsCmd.Flags().BoolVarP(&LogsFollow, "follow", "f", false, "optional(keep printing new output until container stops)")
+	logsCmd.Flags().StringVarP(&LogsSince, "since", "", "", "optional(only print output after the time, either duration like 10m or RFC3339 time like 2006-01-02T15:04:05Z)")
+
+	var inspectCmd = &cobra.Command{
+		Use:   "inspect",
+		Short: "print the information of container or image in json",
+		Long:  "inspect command is the basic command of lpmx, which is used for printing everything lpmx keeps about container via id or image via name, including layers, env, privileges and running state",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+			err = CheckAndStartMemcache()
+			if err != nil {
+				LOGGER.Warn("memcached is not available, privileges of container may be missing")
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			info, err := Inspect(args[0])
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+			err = WriteFormat(os.Stdout, FORMAT_JSON, info, Table{})
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -634,6 +1070,61 @@ func main() {
 		},
 	}
 
+	var historyCmd = &cobra.Command{
+		Use:   "history",
+		Short: "show the commit history of container",
+		Long:  "history command is the basic command of lpmx, which is used for showing the snapshots committed from container via id",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := History(args[0])
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+
+	var RollbackKeep bool
+	var rollbackCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "rollback container to one snapshot of its history",
+		Long:  "rollback command is the basic command of lpmx, which is used for restoring layers of stopped container to the snapshot at the step shown by history command",
+		Args:  cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			step, serr := strconv.Atoi(args[1])
+			if serr != nil {
+				LOGGER.Fatal(fmt.Sprintf("step %s should be an integer", args[1]))
+				return
+			}
+			err := Rollback(args[0], step, RollbackKeep)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+	rollbackCmd.Flags().BoolVarP(&RollbackKeep, "keep", "k", false, "optional(keep current contents of rw layer, by default they are discarded)")
+
+	resumeCmd.Flags().BoolVarP(&ResumeDetach, "detach", "d", false, "optional(run container in background, its output is written into log files read by 'lpmx logs')")
+
+	var DestroyForce bool
 	var destroyCmd = &cobra.Command{
 		Use:   "destroy",
 		Short: "destroy the registered container",
@@ -647,7 +1138,7 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := Destroy(args[0])
+			err := Destroy(args[0], DestroyForce)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -659,6 +1150,29 @@ func main() {
 			}
 		},
 	}
+	destroyCmd.Flags().BoolVarP(&DestroyForce, "force", "f", false, "optional(stop the running container firstly)")
+
+	var renameCmd = &cobra.Command{
+		Use:   "rename",
+		Short: "rename the registered container",
+		Long:  "rename command is the basic command of lpmx, which is used for changing the name of container via id, the name should be unique and can be used in place of id by other commands",
+		Args:  cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := RenameContainer(args[0], args[1])
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+			LOGGER.Info("DONE")
+		},
+	}
 
 	var SetId string
 	var SetType string
@@ -701,7 +1215,7 @@ func main() {
 			}
 		},
 	}
-	setCmd.Flags().StringVarP(&SetId, "id", "i", "", "required(container id, you can get the id by command 'lpmx list')")
+	setCmd.Flags().StringVarP(&SetId, "id", "i", "", "required(container id, name or unique id prefix, you can get them by command 'lpmx list')")
 	setCmd.MarkFlagRequired("id")
 	setCmd.Flags().StringVarP(&SetType, "type", "t", "", "required('add_map','remove_map')")
 	setCmd.MarkFlagRequired("type")
@@ -738,6 +1252,6 @@ func main() {
 		Use:   "lpmx",
 		Short: "lpmx rootless container",
 	}
-	rootCmd.AddCommand(initCmd, destroyCmd, listCmd, setCmd, resumeCmd, getCmd, dockerCmd, exposeCmd, uninstallCmd, versionCmd)
+	rootCmd.AddCommand(initCmd, destroyCmd, listCmd, setCmd, resumeCmd, getCmd, dockerCmd, exposeCmd, uninstallCmd, versionCmd, historyCmd, rollbackCmd, diffCmd, cpCmd, lsCmd, catCmd, findCmd, stopCmd, killCmd, execCmd, logsCmd, inspectCmd, renameCmd)
 	rootCmd.Execute()
 }
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -28,6 +28,20 @@ func Command(cmdStr string, arg ...string) (string, *Error) {
 	return out.String(), nil
 }
 
+//CommandInput runs command with input fed into its stdin
+func CommandInput(input []byte, cmdStr string, arg ...string) (string, *Error) {
+	cmd := exec.Command(cmdStr, arg...)
+	var out bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		cerr := ErrNew(err, "cmd running error")
+		return "", cerr
+	}
+	return out.String(), nil
+}
+
 func CommandBash(cmdStr string) (string, *Error) {
 	cmd := exec.Command("sh", "-c", cmdStr)
 	out, err := cmd.CombinedOutput()
@@ -68,7 +82,12 @@ func CommandEnv(cmdStr string, env map[string]string, dir string, arg ...string)
 	}
 }
 
-func ShellEnvPid(sh string, env map[string]string, dir string, arg ...string) *Error {
+func ShellEnvPid(sh string, env map[string]string, dir string, pid_file string, arg ...string) *Error {
+	return ShellEnvPidOutput(sh, env, dir, pid_file, os.Stdin, os.Stdout, os.Stderr, arg...)
+}
+
+//ShellEnvPidOutput is ShellEnvPid with given stdin, stdout and stderr, stdin could be nil for detached shell
+func ShellEnvPidOutput(sh string, env map[string]string, dir string, pid_file string, stdin io.Reader, stdout io.Writer, stderr io.Writer, arg ...string) *Error {
 	shpath, err := exec.LookPath(sh)
 	if err != nil {
 		cerr := ErrNew(ErrNil, fmt.Sprintf("shell: %s doesn't exist", sh))
@@ -95,9 +114,9 @@ func ShellEnvPid(sh string, env map[string]string, dir string, arg ...string) *E
 	}
 	cmd.Env = envstrs
 	cmd.Dir = dir
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
+	cmd.Stderr = stderr
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
 
 	LOGGER.WithFields(logrus.Fields{
 		"env": envstrs,
@@ -109,11 +128,12 @@ func ShellEnvPid(sh string, env map[string]string, dir string, arg ...string) *E
 	}
 
 	//starting craeting pid file
-	pid_file := fmt.Sprintf("%s/container.pid", filepath.Dir(dir))
 	cerr := PidCreateByPid(pid_file, cmd.Process.Pid)
 	if cerr != nil {
 		return cerr
 	}
+	//pid file is removed once shell exits, so that it never points to the process reusing the pid
+	defer os.Remove(pid_file)
 	err = cmd.Wait()
 	if err != nil {
 		cerr := ErrNew(err, "cmd wait error")
@@ -1,14 +1,32 @@
 package pid
 
 import (
+	"bytes"
 	"fmt"
 	. "github.com/JasonYangShadow/lpmx/error"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 )
 
+var (
+	//signals accepted by PidSignal, names could also be given with SIG prefix
+	SIGNALS = map[string]syscall.Signal{
+		"HUP":  syscall.SIGHUP,
+		"INT":  syscall.SIGINT,
+		"QUIT": syscall.SIGQUIT,
+		"KILL": syscall.SIGKILL,
+		"USR1": syscall.SIGUSR1,
+		"USR2": syscall.SIGUSR2,
+		"TERM": syscall.SIGTERM,
+		"CONT": syscall.SIGCONT,
+		"STOP": syscall.SIGSTOP,
+	}
+)
+
 func PidValue(pidfile string) (int, *Error) {
 	value, err := ioutil.ReadFile(pidfile)
 	if err != nil {
@@ -97,3 +115,115 @@ func PidCreateByPid(pidfile string, pid int) *Error {
 		return nil
 	}
 }
+
+//PidSignal parses signal given as number or name, e.g, 9, KILL or SIGKILL
+func PidSignal(sig string) (syscall.Signal, *Error) {
+	sig = strings.ToUpper(strings.TrimSpace(sig))
+	if num, err := strconv.Atoi(sig); err == nil && num > 0 && num < 65 {
+		return syscall.Signal(num), nil
+	}
+	if s, ok := SIGNALS[strings.TrimPrefix(sig, "SIG")]; ok {
+		return s, nil
+	}
+	cerr := ErrNew(ErrType, fmt.Sprintf("signal %s is not supported", sig))
+	return 0, cerr
+}
+
+//PidParent returns the parent pid of pid read from /proc
+func PidParent(pid int) (int, *Error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read stat of pid %d", pid))
+		return -1, cerr
+	}
+	//command name inside parentheses may contain spaces, fields after it are separated by spaces
+	var fields []string
+	if idx := bytes.LastIndexByte(data, ')'); idx >= 0 {
+		fields = strings.Fields(string(data[idx+1:]))
+	}
+	if len(fields) < 2 {
+		cerr := ErrNew(ErrType, fmt.Sprintf("stat of pid %d is malformed", pid))
+		return -1, cerr
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not strconv value: %s", fields[1]))
+		return -1, cerr
+	}
+	return ppid, nil
+}
+
+//PidEnv returns the value of env variable key of process pid, processes of other users are not readable
+func PidEnv(pid int, key string) (string, bool) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return "", false
+	}
+	for _, env := range bytes.Split(data, []byte{0}) {
+		if bytes.HasPrefix(env, []byte(key+"=")) {
+			return string(env[len(key)+1:]), true
+		}
+	}
+	return "", false
+}
+
+//PidComm returns the command name of process pid, which is truncated to 15 characters by kernel
+func PidComm(pid int) (string, bool) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+//PidCmdline returns the arguments of process pid, relative paths among them are resolved against its working dir
+func PidCmdline(pid int) ([]string, bool) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	cwd, _ := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	var args []string
+	for _, arg := range strings.Split(strings.TrimRight(string(data), "\x00"), "\x00") {
+		if cwd != "" && arg != "" && !filepath.IsAbs(arg) && !strings.HasPrefix(arg, "-") {
+			if _, err := os.Stat(filepath.Join(cwd, arg)); err == nil {
+				arg = filepath.Join(cwd, arg)
+			}
+		}
+		args = append(args, arg)
+	}
+	return args, true
+}
+
+//PidList returns pids of all the processes found in /proc
+func PidList() []int {
+	var pids []int
+	entries, _ := ioutil.ReadDir("/proc")
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+//PidDescendants returns all the descendants of pid, children before grandchildren
+func PidDescendants(pid int) []int {
+	children := make(map[int][]int)
+	for _, p := range PidList() {
+		if ppid, err := PidParent(p); err == nil {
+			children[ppid] = append(children[ppid], p)
+		}
+	}
+	var ret []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		curr := queue[0]
+		queue = queue[1:]
+		for _, child := range children[curr] {
+			ret = append(ret, child)
+			queue = append(queue, child)
+		}
+	}
+	return ret
+}
@@ -1,7 +1,12 @@
 package pid
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestPid(t *testing.T) {
@@ -12,3 +17,79 @@ func TestPid(t *testing.T) {
 		t.Log(pid)
 	}
 }
+
+func TestPidSignal(t *testing.T) {
+	for _, sig := range []string{"9", "KILL", "sigkill", " SIGKILL "} {
+		if s, err := PidSignal(sig); err != nil || s != syscall.SIGKILL {
+			t.Errorf("%s should be parsed as SIGKILL, got %v, %v", sig, s, err)
+		}
+	}
+	if _, err := PidSignal("UNKNOWN"); err == nil {
+		t.Error("unknown signal should not be parsed")
+	}
+}
+
+func TestPidDescendants(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 10; true")
+	cmd.Env = []string{"ContainerId=test"}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	//sleep is forked by shell asynchronously
+	var children []int
+	for i := 0; i < 50 && len(children) < 1; i++ {
+		time.Sleep(20 * time.Millisecond)
+		children = PidDescendants(cmd.Process.Pid)
+	}
+	if len(children) != 1 {
+		t.Fatalf("shell should have one child, got %v", children)
+	}
+	defer syscall.Kill(children[0], syscall.SIGKILL)
+	if ppid, err := PidParent(children[0]); err != nil || ppid != cmd.Process.Pid {
+		t.Errorf("parent of sleep should be %d, got %d, %v", cmd.Process.Pid, ppid, err)
+	}
+	if id, ok := PidEnv(children[0], "ContainerId"); !ok || id != "test" {
+		t.Errorf("env of shell should be inherited by sleep, got %s", id)
+	}
+}
+
+func TestPidCmdline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/arg", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	//tail keeps running with relative path among its arguments
+	cmd := exec.Command("tail", "-f", "arg")
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	//comm is changed once exec of child finishes
+	comm, ok := PidComm(cmd.Process.Pid)
+	for i := 0; i < 50 && comm != "tail"; i++ {
+		time.Sleep(20 * time.Millisecond)
+		comm, ok = PidComm(cmd.Process.Pid)
+	}
+	if !ok || comm != "tail" {
+		t.Errorf("comm should be tail, got %s", comm)
+	}
+	//relative path existing inside working dir is resolved, others are kept
+	args, ok := PidCmdline(cmd.Process.Pid)
+	if !ok || len(args) != 3 || args[0] != "tail" || args[1] != "-f" || args[2] != dir+"/arg" {
+		t.Errorf("cmdline should be [tail -f %s/arg], got %v", dir, args)
+	}
+	if _, ok := PidComm(-1); ok {
+		t.Error("comm of invalid pid should not be found")
+	}
+}
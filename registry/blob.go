@@ -21,6 +21,32 @@ func (registry *Registry) DownloadBlob(repository string, digest digest.Digest)
 	return resp.Body, nil
 }
 
+/*
+ * Download blob starting from offset with HTTP Range request. The offset the
+ * returned content actually starts from is returned as well, which is 0 if the
+ * registry ignores the Range header and sends the whole blob.
+ */
+func (registry *Registry) DownloadBlobRange(repository string, digest digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	url := registry.url("/v2/%s/blobs/%s", repository, digest)
+	registry.Logf("registry.blob.download url=%s repository=%s digest=%s offset=%d", url, repository, digest, offset)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, offset, nil
+	}
+	return resp.Body, 0, nil
+}
+
 func (registry *Registry) UploadBlob(repository string, digest digest.Digest, content io.Reader) error {
 	uploadUrl, err := registry.initiateUpload(repository)
 	if err != nil {
@@ -4,11 +4,26 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	_ "github.com/docker/distribution/manifest/ocischema"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	// Media types accepted when the reference may point to either a single
+	// platform manifest or a manifest list(OCI image index).
+	ManifestMediaTypes = []string{
+		schema2.MediaTypeManifest,
+		ocispec.MediaTypeImageManifest,
+		manifestlist.MediaTypeManifestList,
+		ocispec.MediaTypeImageIndex,
+	}
 )
 
 func (registry *Registry) Manifest(repository, reference string) (*schema1.SignedManifest, error) {
@@ -70,6 +85,42 @@ func (registry *Registry) ManifestV2(repository, reference string) (*schema2.Des
 	return deserialized, nil
 }
 
+/*
+ * Fetch a manifest of any type listed in ManifestMediaTypes. The returned
+ * manifest is one of *schema2.DeserializedManifest,
+ * *ocischema.DeserializedManifest or *manifestlist.DeserializedManifestList,
+ * and the descriptor carries the digest of the payload.
+ */
+func (registry *Registry) ManifestOrIndex(repository, reference string) (distribution.Manifest, distribution.Descriptor, error) {
+	url := registry.url("/v2/%s/manifests/%s", repository, reference)
+	registry.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repository, reference)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+
+	req.Header.Set("Accept", strings.Join(ManifestMediaTypes, ", "))
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, distribution.Descriptor{}, &HttpStatusError{
+			Response: resp,
+			Body:     body,
+		}
+	}
+
+	return distribution.UnmarshalManifest(resp.Header.Get("Content-Type"), body)
+}
+
 func (registry *Registry) ManifestDigest(repository, reference string) (digest.Digest, error) {
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
 	registry.Logf("registry.manifest.head url=%s repository=%s reference=%s", url, repository, reference)
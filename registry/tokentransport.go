@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 type TokenTransport struct {
@@ -25,7 +26,8 @@ func (t *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 type authToken struct {
-	Token string `json:"token"`
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
 }
 
 func (t *TokenTransport) authAndRetry(authService *authService, req *http.Request) (*http.Response, error) {
@@ -65,6 +67,9 @@ func (t *TokenTransport) auth(authService *authService) (string, *http.Response,
 		return "", nil, err
 	}
 
+	if authToken.Token == "" {
+		authToken.Token = authToken.AccessToken
+	}
 	return authToken.Token, nil, nil
 }
 
@@ -125,3 +130,40 @@ func parseOauthHeader(resp *http.Response) *authService {
 	}
 	return nil
 }
+
+/*
+ * Ask the registry for its WWW-Authenticate challenge and exchange it for a
+ * bearer token carrying the given scope, e.g, "repository:library/ubuntu:pull".
+ * An empty token is returned if the registry does not demand bearer auth.
+ */
+func Token(registryUrl, username, password, scope string) (string, error) {
+	url := fmt.Sprintf("%s/v2/", strings.TrimSuffix(registryUrl, "/"))
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	authService := isTokenDemand(resp)
+	if authService == nil {
+		return "", nil
+	}
+	if scope != "" {
+		authService.Scope = scope
+	}
+
+	t := &TokenTransport{
+		Transport: http.DefaultTransport,
+		Username:  username,
+		Password:  password,
+	}
+	token, authResp, err := t.auth(authService)
+	if err != nil {
+		return "", err
+	}
+	if authResp != nil {
+		authResp.Body.Close()
+		return "", fmt.Errorf("http: token request to %s failed (status=%v)", authService.Realm, authResp.StatusCode)
+	}
+	return token, nil
+}
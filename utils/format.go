@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FORMAT_TABLE    = "table"
+	FORMAT_JSON     = "json"
+	FORMAT_YAML     = "yaml"
+	FORMAT_TEMPLATE = "go-template"
+)
+
+//Table holds the header and rows of records printed in table format
+type Table struct {
+	Header []string
+	Rows   [][]string
+}
+
+//WriteFormat writes records into w in the given format, one of 'table', 'json', 'yaml' and 'go-template=TEMPLATE'
+//empty format means table, template is executed for each record if records is a slice, e.g, 'go-template={{.Name}}'
+func WriteFormat(w io.Writer, format string, records interface{}, table Table) *Error {
+	switch {
+	case format == "" || format == FORMAT_TABLE:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(table.Header, "\t"))
+		for _, row := range table.Rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		if err := tw.Flush(); err != nil {
+			cerr := ErrNew(err, "could not write table")
+			return cerr
+		}
+	case format == FORMAT_JSON:
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			cerr := ErrNew(err, "could not marshal records into json")
+			return cerr
+		}
+		fmt.Fprintln(w, string(data))
+	case format == FORMAT_YAML:
+		data, err := yaml.Marshal(records)
+		if err != nil {
+			cerr := ErrNew(err, "could not marshal records into yaml")
+			return cerr
+		}
+		fmt.Fprint(w, string(data))
+	case strings.HasPrefix(format, FORMAT_TEMPLATE+"="):
+		tmpl, err := template.New("format").Parse(strings.TrimPrefix(format, FORMAT_TEMPLATE+"="))
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not parse template of format: %s", format))
+			return cerr
+		}
+		var items []interface{}
+		value := reflect.ValueOf(records)
+		if value.Kind() == reflect.Slice {
+			for idx := 0; idx < value.Len(); idx++ {
+				items = append(items, value.Index(idx).Interface())
+			}
+		} else {
+			items = append(items, records)
+		}
+		for _, item := range items {
+			if err := tmpl.Execute(w, item); err != nil {
+				cerr := ErrNew(err, fmt.Sprintf("could not execute template of format: %s", format))
+				return cerr
+			}
+			fmt.Fprintln(w)
+		}
+	default:
+		cerr := ErrNew(ErrType, fmt.Sprintf("format: %s is not supported, it should be one of 'table', 'json', 'yaml' and 'go-template=TEMPLATE'", format))
+		return cerr
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"fmt"
@@ -11,12 +12,16 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	. "github.com/JasonYangShadow/lpmx/error"
 	. "github.com/JasonYangShadow/lpmx/log"
 	. "github.com/JasonYangShadow/lpmx/paeudo"
+	"github.com/klauspost/compress/zstd"
 	"github.com/phayes/permbits"
 	"github.com/sirupsen/logrus"
 )
@@ -38,6 +43,22 @@ const (
 	TYPE_OTHER
 )
 
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+const (
+	//OCI whiteout markers, '.wh.<name>' hides <name> of lower layers and the opaque marker hides all content of lower layers inside its folder
+	WHITEOUT_PREFIX = ".wh."
+	WHITEOUT_OPAQUE = ".wh..wh..opq"
+
+	//database of ownership and device nodes inside extracted layer, which is loaded by faked
+	FAKEROOT_DB = ".fakeroot.db"
+	PAX_XATTR   = "SCHILY.xattr."
+)
+
 var (
 	memcached_checklist = []string{"memcached", "libevent"}
 	time_sleep          = 2
@@ -425,6 +446,10 @@ func GuessPathContainer(base string, layers []string, in string, file bool) (str
 			if (file && FileExist(tpath)) || (!file && FolderExist(tpath)) {
 				return tpath, nil
 			}
+			//lower layers are hidden by the whiteout inside current layer
+			if WhiteoutHides(fmt.Sprintf("%s/%s", base, layer), in) {
+				break
+			}
 		}
 	}
 	cerr := ErrNew(ErrNil, fmt.Sprintf("%s doesn't exist both in abs path and relative path", in))
@@ -460,6 +485,10 @@ func GuessPathsContainer(base string, layers []string, in string, file bool) ([]
 			if (file && FileExist(tpath)) || (!file && FolderExist(tpath)) {
 				ret = append(ret, tpath)
 			}
+			layer_path := fmt.Sprintf("%s/%s", base, layer)
+			if WhiteoutHides(layer_path, in) || (!file && FileExist(filepath.Join(tpath, WHITEOUT_OPAQUE))) {
+				break
+			}
 		}
 	}
 	if len(ret) > 0 {
@@ -469,6 +498,140 @@ func GuessPathsContainer(base string, layers []string, in string, file bool) ([]
 	return ret, cerr
 }
 
+//WhiteoutHides checks whether layer contains whiteout of rel or opaque marker of its parent folders, which hide rel inside lower layers
+func WhiteoutHides(layer string, rel string) bool {
+	rel = strings.Trim(filepath.Clean("/"+rel), "/")
+	if rel == "" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	dir := layer
+	for idx, part := range parts {
+		if FileExist(filepath.Join(dir, WHITEOUT_PREFIX+part)) {
+			return true
+		}
+		if idx > 0 && FileExist(filepath.Join(dir, WHITEOUT_OPAQUE)) {
+			return true
+		}
+		dir = filepath.Join(dir, part)
+	}
+	return false
+}
+
+//LayerLstat returns the path and info of the topmost entry of rel inside the merged view of layers under base
+//entries hidden by whiteouts, opaque folders or non-folder entries of upper layers are not found
+func LayerLstat(base string, layers []string, rel string) (string, os.FileInfo, *Error) {
+	rel = strings.Trim(filepath.Clean("/"+rel), "/")
+	for _, layer := range layers {
+		layer_path := filepath.Join(base, layer)
+		//symlinks among parents are never followed, they could point to host paths outside of layer
+		if parentNotDir(layer_path, rel) {
+			break
+		}
+		tpath := filepath.Join(layer_path, rel)
+		if fi, err := os.Lstat(tpath); err == nil {
+			return tpath, fi, nil
+		}
+		if rel == "" || layerHides(layer_path, rel) {
+			break
+		}
+	}
+	cerr := ErrNew(ErrNExist, fmt.Sprintf("/%s doesn't exist inside layers", rel))
+	return "", nil, cerr
+}
+
+//layerHides checks whether rel of lower layers is hidden by layer, either by whiteouts or by non-folder entry replacing one of its parents
+func layerHides(layer_path string, rel string) bool {
+	return WhiteoutHides(layer_path, rel) || parentNotDir(layer_path, rel)
+}
+
+//parentNotDir checks whether one of the parents of rel inside layer is not a folder, e.g, symlink or file
+//such entry replaces the folder of lower layers, and rel could not exist inside the layer itself
+func parentNotDir(layer_path string, rel string) bool {
+	for dir := filepath.Dir(rel); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if fi, err := os.Lstat(filepath.Join(layer_path, dir)); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+//LayerReadDir returns the entries of folder rel merged from layers, keyed by name and valued by the path of topmost entry
+func LayerReadDir(base string, layers []string, rel string) (map[string]string, *Error) {
+	rel = strings.Trim(filepath.Clean("/"+rel), "/")
+	if _, fi, cerr := LayerLstat(base, layers, rel); cerr != nil || !fi.IsDir() {
+		cerr := ErrNew(ErrType, fmt.Sprintf("/%s is not a folder inside layers", rel))
+		return nil, cerr
+	}
+	entries := make(map[string]string)
+	hidden := make(map[string]bool)
+	for _, layer := range layers {
+		layer_path := filepath.Join(base, layer)
+		if parentNotDir(layer_path, rel) {
+			break
+		}
+		tpath := filepath.Join(layer_path, rel)
+		fi, err := os.Lstat(tpath)
+		if err != nil || !fi.IsDir() {
+			if err == nil || layerHides(layer_path, rel) {
+				break
+			}
+			continue
+		}
+		infos, err := ioutil.ReadDir(tpath)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not read folder %s", tpath))
+			return nil, cerr
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if strings.HasPrefix(name, WHITEOUT_PREFIX) {
+				hidden[strings.TrimPrefix(name, WHITEOUT_PREFIX)] = true
+				continue
+			}
+			if _, ok := entries[name]; !ok && !hidden[name] {
+				entries[name] = filepath.Join(tpath, name)
+			}
+		}
+		if FileExist(filepath.Join(tpath, WHITEOUT_OPAQUE)) {
+			break
+		}
+	}
+	return entries, nil
+}
+
+//LayerResolve follows symlinks among the parent folders of rel inside the merged view of layers, the last element is kept untouched
+//absolute symlinks are resolved from the root of layers, so that the result never points outside
+func LayerResolve(base string, layers []string, rel string) (string, *Error) {
+	parts := strings.Split(strings.Trim(filepath.Clean("/"+rel), "/"), "/")
+	resolved := ""
+	for hops := 0; len(parts) > 1; {
+		curr := filepath.Join(resolved, parts[0])
+		tpath, fi, cerr := LayerLstat(base, layers, curr)
+		if cerr != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = curr
+			parts = parts[1:]
+			continue
+		}
+		hops++
+		if hops > 40 {
+			cerr := ErrNew(ErrType, fmt.Sprintf("too many levels of symbolic links while resolving /%s", rel))
+			return "", cerr
+		}
+		link, err := os.Readlink(tpath)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not read symlink %s", tpath))
+			return "", cerr
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join("/", resolved, link)
+		}
+		resolved = ""
+		parts = append(strings.Split(strings.Trim(filepath.Clean(link), "/"), "/"), parts[1:]...)
+	}
+	return strings.Trim(filepath.Join(resolved, parts[0]), "/"), nil
+}
+
 func AddConPath(base string, in string) string {
 	if strings.HasPrefix(in, "$") {
 		return strings.Replace(in, "$", "", -1)
@@ -531,14 +694,30 @@ func TarFiles(filelist []string, target_folder string, target_name string) *Erro
 	return nil
 }
 
+//TarOptions controls how TarLayer writes layer tarball
+type TarOptions struct {
+	Compression string
+	//entries are written with timestamps normalized to SOURCE_DATE_EPOCH(unix epoch if not set) and without owners
+	//so that the same content always produces the same tarball
+	Deterministic bool
+	//patterns of paths inside container which are left out of tarball, see MatchExclude
+	Exclude []string
+}
+
 //this tar function eliminate symlink
-func TarLayer(src_folder string, target_folder string, target_name string, layers []string) *Error {
+//symlinks pointing into layers are rewritten as absolute paths inside container, only inside tar headers
+//the tarball is written to target_folder/target_name with the suffix returned by TarSuffix(opts.Compression)
+func TarLayer(src_folder string, target_folder string, target_name string, layers []string, opts TarOptions) *Error {
 	if !FolderExist(src_folder) {
 		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s folder not exist", src_folder))
 		return cerr
 	}
+	epoch, cerr := sourceDateEpoch()
+	if cerr != nil {
+		return cerr
+	}
 
-	target_path := fmt.Sprintf("%s/%s.tar.gz", target_folder, target_name)
+	target_path := fmt.Sprintf("%s/%s%s", target_folder, target_name, TarSuffix(opts.Compression))
 	file, ferr := os.Create(target_path)
 	if ferr != nil {
 		cerr := ErrNew(ferr, fmt.Sprintf("%s creating error", target_path))
@@ -546,76 +725,69 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 	}
 	defer file.Close()
 
-	mw := io.Writer(file)
-	gzw := gzip.NewWriter(mw)
-	defer gzw.Close()
+	cw, cerr := CompressWriter(file, opts.Compression)
+	if cerr != nil {
+		return cerr
+	}
+	defer cw.Close()
 
-	tw := tar.NewWriter(gzw)
+	tw := tar.NewWriter(cw)
 	defer tw.Close()
 
+	writeHeader := func(header *tar.Header) error {
+		if opts.Deterministic {
+			header.ModTime = epoch
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+			header.Uid = 0
+			header.Gid = 0
+			header.Uname = ""
+			header.Gname = ""
+		}
+		return tw.WriteHeader(header)
+	}
+
+	//filepath.Walk visits entries in lexical order, which keeps the order of entries stable
 	err := filepath.Walk(src_folder, func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if file == src_folder {
+		if file == src_folder || file == filepath.Join(src_folder, FAKEROOT_DB) {
 			return nil
 		}
-
-		//if symlink
-		mode := fi.Mode()
-		if mode&os.ModeSymlink != 0 {
-			link, err := os.Readlink(file)
-			if err != nil {
-				return err
+		if MatchExclude(opts.Exclude, strings.TrimPrefix(file, src_folder)) {
+			if fi.IsDir() {
+				return filepath.SkipDir
 			}
-			for _, layer_path := range layers {
-				if strings.HasPrefix(link, layer_path) {
-					//let's create another symlink instead of this real one
-					//step 1 : rename real one
-					//step 2 : create new fake one with the same name
-					//step 3 : remove new fake one and restore old.one
-					err := os.Rename(file, fmt.Sprintf("%s.tar.old", file))
-					if err != nil {
-						return err
-					}
-					relative_path, err := filepath.Rel(link, layer_path)
-					if err != nil {
-						return err
-					}
-					if relative_path == "." {
-						relative_path = "/"
-					} else {
-						relative_path = fmt.Sprintf("/%s", relative_path)
-					}
-
-					err = os.Symlink(relative_path, file)
-					new_fi, err := os.Lstat(file)
-					if err != nil {
-						return err
-					}
-					//new header
-					header, err := tar.FileInfoHeader(new_fi, fi.Name())
-					if err != nil {
-						return err
-					}
-					header.Name = strings.TrimPrefix(file, src_folder)
-					if err := tw.WriteHeader(header); err != nil {
-						return err
-					}
+			return nil
+		}
 
-					//remove fake file and restore original one
-					err = os.Remove(file)
-					if err != nil {
-						return err
+		//whiteouts are written as empty files, the ones hiding nothing inside lower layers are dropped
+		if strings.HasPrefix(fi.Name(), WHITEOUT_PREFIX) && fi.Mode().IsRegular() {
+			name := strings.TrimPrefix(file, src_folder)
+			if fi.Name() != WHITEOUT_OPAQUE {
+				hidden := filepath.Join(filepath.Dir(name), strings.TrimPrefix(fi.Name(), WHITEOUT_PREFIX))
+				found := false
+				for _, layer_path := range layers {
+					if layer_path == src_folder {
+						continue
 					}
-					err = os.Rename(fmt.Sprintf("%s.tar.old", file), file)
-					if err != nil {
-						return err
+					if _, err := os.Lstat(filepath.Join(layer_path, hidden)); err == nil {
+						found = true
+						break
 					}
-					//done
+				}
+				if !found {
 					return nil
 				}
 			}
+			header := &tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				ModTime:  fi.ModTime(),
+			}
+			return writeHeader(header)
 		}
 
 		header, err := tar.FileInfoHeader(fi, fi.Name())
@@ -624,7 +796,24 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 		}
 		//modify header's name
 		header.Name = strings.TrimPrefix(file, src_folder)
-		if err := tw.WriteHeader(header); err != nil {
+
+		//if symlink
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			header.Linkname = link
+			for _, layer_path := range layers {
+				if link == layer_path || strings.HasPrefix(link, layer_path+"/") {
+					//symlink pointing into layer is stored as the absolute path inside container
+					header.Linkname = "/" + strings.TrimPrefix(strings.TrimPrefix(link, layer_path), "/")
+					break
+				}
+			}
+		}
+
+		if err := writeHeader(header); err != nil {
 			return err
 		}
 
@@ -637,60 +826,407 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 		if err != nil {
 			return err
 		}
+		defer f.Close()
 		if _, err := io.Copy(tw, f); err != nil {
 			return err
 		}
-		f.Close()
 		return nil
 	})
 	if err != nil {
 		cerr := ErrNew(err, "tar file error")
 		return cerr
 	}
+	return closeTarWriters(tw, cw, file)
+}
+
+//closeTarWriters closes tar writer, compress writer and file in order, so that tarball which is not completely flushed is reported
+func closeTarWriters(tw *tar.Writer, cw io.WriteCloser, file *os.File) *Error {
+	if err := tw.Close(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not close tar writer of %s", file.Name()))
+		return cerr
+	}
+	if err := cw.Close(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not close compress writer of %s", file.Name()))
+		return cerr
+	}
+	if err := file.Close(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not close %s", file.Name()))
+		return cerr
+	}
 	return nil
+}
+
+//MergeLayers merges layer tarballs, base layer first, into one tarball written to target with compression
+//whiteouts and opaque markers of upper layers remove the entries of lower layers and are dropped, as nothing lies below the merged layer
+//headers are copied as they are, so that ownership, device nodes and xattrs are kept
+func MergeLayers(layers []string, target string, compression string) *Error {
+	type entryPos struct {
+		layer int
+		index int
+	}
+	//final entries, keyed by the cleaned path inside layer
+	winners := make(map[string]entryPos)
+	removeTree := func(name string, self bool) {
+		for key := range winners {
+			if (self && key == name) || strings.HasPrefix(key, name+"/") || name == "." {
+				delete(winners, key)
+			}
+		}
+	}
+
+	for idx, layer := range layers {
+		r, cerr := DecompressReader(layer)
+		if cerr != nil {
+			return cerr
+		}
+		//whiteouts of one layer only hide the content of lower layers
+		entries := make(map[string]entryPos)
+		dirs := make(map[string]bool)
+		var hidden []string
+		var opaques []string
+		tr := tar.NewReader(r)
+		for index := 0; ; index++ {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				cerr := ErrNew(err, fmt.Sprintf("reading tar header of %s errors", layer))
+				return cerr
+			}
+			name, ok := cleanEntryName(header.Name)
+			if !ok || name == "." || header.Typeflag == tar.TypeXGlobalHeader {
+				continue
+			}
+			base := filepath.Base(name)
+			if base == WHITEOUT_OPAQUE {
+				opaques = append(opaques, filepath.Dir(name))
+				continue
+			}
+			if strings.HasPrefix(base, WHITEOUT_PREFIX) {
+				hidden = append(hidden, filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, WHITEOUT_PREFIX)))
+				continue
+			}
+			entries[name] = entryPos{idx, index}
+			dirs[name] = header.Typeflag == tar.TypeDir
+		}
+		r.Close()
 
+		for _, name := range hidden {
+			removeTree(name, true)
+		}
+		for _, dir := range opaques {
+			removeTree(dir, false)
+		}
+		for name, pos := range entries {
+			//entry replacing folder of lower layers with non-folder removes its content as well
+			if _, ok := winners[name]; ok && !dirs[name] {
+				removeTree(name, false)
+			}
+			winners[name] = pos
+		}
+	}
+
+	file, ferr := os.Create(target)
+	if ferr != nil {
+		cerr := ErrNew(ferr, fmt.Sprintf("%s creating error", target))
+		return cerr
+	}
+	defer file.Close()
+	cw, cerr := CompressWriter(file, compression)
+	if cerr != nil {
+		return cerr
+	}
+	defer cw.Close()
+	tw := tar.NewWriter(cw)
+	defer tw.Close()
+
+	//entries are written in the order of layers, so that folders and hardlink targets come before their users
+	for idx, layer := range layers {
+		r, cerr := DecompressReader(layer)
+		if cerr != nil {
+			return cerr
+		}
+		tr := tar.NewReader(r)
+		for index := 0; ; index++ {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				cerr := ErrNew(err, fmt.Sprintf("reading tar header of %s errors", layer))
+				return cerr
+			}
+			name, ok := cleanEntryName(header.Name)
+			if !ok {
+				continue
+			}
+			if pos, ok := winners[name]; !ok || pos != (entryPos{idx, index}) {
+				continue
+			}
+			if header.Typeflag == tar.TypeLink {
+				link, lok := cleanEntryName(header.Linkname)
+				if pos, ok := winners[link]; !lok || !ok || pos.layer > idx {
+					continue
+				}
+			}
+			if header.Typeflag == tar.TypeDir {
+				name += "/"
+			}
+			header.Name = name
+			if err := tw.WriteHeader(header); err != nil {
+				r.Close()
+				cerr := ErrNew(err, fmt.Sprintf("writing tar header of %s errors", name))
+				return cerr
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				r.Close()
+				cerr := ErrNew(err, fmt.Sprintf("copying content of %s errors", name))
+				return cerr
+			}
+		}
+		r.Close()
+	}
+	return closeTarWriters(tw, cw, file)
+}
+
+//MatchExclude checks whether path inside container matches one of patterns
+//patterns without '/' match the name of file or folder at any depth, e.g, '*.pyc'
+//the others match the whole path from container root, e.g, '/var/cache/*', content of matched folders is matched as well
+func MatchExclude(patterns []string, path string) bool {
+	path = "/" + strings.Trim(path, "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.TrimSpace(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+				return true
+			}
+			continue
+		}
+		pattern = "/" + strings.TrimPrefix(pattern, "/")
+		for p := path; p != "/"; p = filepath.Dir(p) {
+			if ok, _ := filepath.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//ExcludedPaths returns the topmost paths inside root matching patterns, paths are relative to root and start with '/'
+func ExcludedPaths(root string, patterns []string) ([]string, *Error) {
+	var paths []string
+	err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == root {
+			return nil
+		}
+		rel := strings.TrimPrefix(file, root)
+		if MatchExclude(patterns, rel) {
+			paths = append(paths, rel)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not walk folder %s", root))
+		return nil, cerr
+	}
+	return paths, nil
+}
+
+//ReadIgnoreFile reads patterns from file, one pattern per line, empty lines and lines starting with '#' are ignored
+func ReadIgnoreFile(file string) ([]string, *Error) {
+	data, cerr := ReadFromFile(file)
+	if cerr != nil {
+		return nil, cerr
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+//sourceDateEpoch returns the time defined by SOURCE_DATE_EPOCH, unix epoch is returned if it is not set
+func sourceDateEpoch() (time.Time, *Error) {
+	value := strings.TrimSpace(os.Getenv("SOURCE_DATE_EPOCH"))
+	if value == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("SOURCE_DATE_EPOCH %s is not valid", value))
+		return time.Time{}, cerr
+	}
+	return time.Unix(seconds, 0).UTC(), nil
 }
 
 func Untar(target string, folder string) *Error {
+	skipped, cerr := untar(target, folder, "", false)
+	reportSkipped(target, skipped)
+	return cerr
+}
+
+//UntarLayer extracts image layer with its metadata, hardlinks are recreated, modes and mtimes are restored
+//ownership and device nodes, which can't be created without privilege, are recorded inside FAKEROOT_DB of folder
+//layer is decompressed according to media_type, or its magic bytes if media_type is empty
+func UntarLayer(target string, folder string, media_type string) *Error {
+	skipped, cerr := untar(target, folder, media_type, true)
+	reportSkipped(target, skipped)
+	return cerr
+}
+
+func reportSkipped(target string, skipped []string) {
+	for _, entry := range skipped {
+		LOGGER.WithFields(logrus.Fields{
+			"tarball": target,
+			"entry":   entry,
+		}).Warn("tar entry is skipped or not extracted as it is")
+	}
+}
+
+//untar extracts tarball into folder, entries resolving outside of folder are skipped and symlinks pointing outside are clamped inside folder
+//descriptions of these entries and the ones not supported are returned
+func untar(target string, folder string, media_type string, preserve bool) ([]string, *Error) {
 	if !FileExist(target) {
 		cerr := ErrNew(ErrNExist, fmt.Sprintf("file %s does not exist", target))
-		return cerr
+		return nil, cerr
 	}
-	r, err := os.Open(target)
-	if err != nil {
-		cerr := ErrNew(ErrFileIO, fmt.Sprintf("open file %s failure", target))
-		return cerr
+	r, cerr := DecompressLayerReader(target, media_type)
+	if cerr != nil {
+		return nil, cerr
 	}
 	defer r.Close()
-	gzr, err := gzip.NewReader(r)
+	tr := tar.NewReader(r)
+
+	folder = filepath.Clean(folder)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		cerr := ErrNew(err, "untar making dir error")
+		return nil, cerr
+	}
+	root, err := filepath.EvalSymlinks(folder)
 	if err != nil {
-		cerr := ErrNew(err, fmt.Sprintf("gzip open file %s failure", target))
-		return cerr
+		cerr := ErrNew(err, fmt.Sprintf("could not resolve folder %s", folder))
+		return nil, cerr
+	}
+	//fakeroot database describes only the files of this extraction, records left by interrupted or previous extraction are dropped
+	db := filepath.Join(folder, FAKEROOT_DB)
+	if preserve {
+		if err := os.Remove(db); err != nil && !os.IsNotExist(err) {
+			cerr := ErrNew(err, fmt.Sprintf("could not remove stale fakeroot database %s", db))
+			return nil, cerr
+		}
 	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
+	//paths extracted from this tarball, which are kept when opaque marker is met
+	extracted := make(map[string]bool)
+	var skipped []string
+	//metadata of folders is restored after their children are written
+	var dirs []string
+	dir_headers := make(map[string]*tar.Header)
+	//fakeroot records keyed by the path they describe, records of paths removed or replaced later are dropped
+	records := make(map[string]string)
 
 	for {
 		header, err := tr.Next()
-
-		switch {
-		case err == io.EOF:
-			return nil
-
-		case err != nil:
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			cerr := ErrNew(err, "reading tar header errors")
-			return cerr
+			return skipped, cerr
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
 
-		case header == nil:
+		name, ok := cleanEntryName(header.Name)
+		if !ok {
+			skipped = append(skipped, fmt.Sprintf("%s: path is outside of layer root", header.Name))
+			continue
+		}
+		if name == "." {
+			continue
+		}
+		target := filepath.Join(folder, name)
+		//symlinks extracted before may redirect the entry to somewhere outside
+		if !insideRoot(root, folder, filepath.Dir(target)) {
+			skipped = append(skipped, fmt.Sprintf("%s: parent folder resolves outside of layer root", header.Name))
 			continue
 		}
 
-		if !strings.HasSuffix(folder, "/") {
-			folder = folder + "/"
+		//whiteouts remove the content extracted into folder before and are kept as markers for hiding lower layers
+		if base := filepath.Base(target); strings.HasPrefix(base, WHITEOUT_PREFIX) {
+			dir := filepath.Dir(target)
+			if base == WHITEOUT_OPAQUE {
+				cerr := removeUnextracted(dir, extracted, records)
+				if cerr != nil {
+					return skipped, cerr
+				}
+			} else {
+				hidden := strings.TrimPrefix(base, WHITEOUT_PREFIX)
+				hidden_path := filepath.Join(dir, hidden)
+				//symlinks are removed rather than followed, so the folder holding them decides
+				check := hidden_path
+				if fi, err := os.Lstat(hidden_path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+					check = dir
+				}
+				if hidden == "" || hidden == "." || hidden == ".." || strings.Contains(hidden, "/") || !insideRoot(root, folder, check) {
+					skipped = append(skipped, fmt.Sprintf("%s: whiteout target is outside of layer root", header.Name))
+					continue
+				}
+				if err := os.RemoveAll(hidden_path); err != nil {
+					cerr := ErrNew(err, fmt.Sprintf("untar removing whiteout target of %s error", target))
+					return skipped, cerr
+				}
+				dropRecords(records, hidden_path)
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				cerr := ErrNew(err, "untar making dir error")
+				return skipped, cerr
+			}
+			f, err := os.Create(target)
+			if err != nil {
+				cerr := ErrNew(err, fmt.Sprintf("untar create whiteout %s error", target))
+				return skipped, cerr
+			}
+			f.Close()
+			markExtracted(extracted, folder, target)
+			continue
+		}
+		markExtracted(extracted, folder, target)
+		//metadata of this entry replaces the one recorded for the same path before
+		delete(records, target)
+
+		//existing symlink or file is replaced rather than written through
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				cerr := ErrNew(err, fmt.Sprintf("untar removing existing %s error", target))
+				return skipped, cerr
+			}
+			dropRecords(records, target)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			cerr := ErrNew(err, "untar making dir error")
+			return skipped, cerr
 		}
-		target := filepath.Join(folder, header.Name)
 
+		//mode recorded for fakeroot if it differs from the one on disk
+		var fake_mode uint32
+		var rdev uint64
 		switch header.Typeflag {
 
 		// if its a dir and it doesn't exist create it
@@ -698,42 +1234,495 @@ func Untar(target string, folder string) *Error {
 			if _, err := os.Stat(target); err != nil {
 				if err := os.MkdirAll(target, 0755); err != nil {
 					cerr := ErrNew(err, "untar making dir error")
-					return cerr
+					return skipped, cerr
+				}
+			}
+			if preserve {
+				if _, ok := dir_headers[target]; !ok {
+					dirs = append(dirs, target)
+				}
+				dir_headers[target] = header
+				//folders are kept accessible by owner, otherwise lpmx could not write or remove their content
+				if perm := uint32(header.Mode) & 07777; perm&0700 != 0700 {
+					fake_mode = syscall.S_IFDIR | perm
 				}
 			}
 
 		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
 				cerr := ErrNew(err, fmt.Sprintf("untar create file %s error", target))
-				return cerr
+				return skipped, cerr
 			}
 
 			// copy over contents
 			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
 				cerr := ErrNew(err, "untar copying file content error")
-				return cerr
+				return skipped, cerr
 			}
 
 			f.Close()
+			if preserve {
+				//mode passed to OpenFile is masked by umask and does not contain setuid, setgid and sticky bits
+				os.Chmod(target, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+				skipped = append(skipped, restoreXattrs(target, header)...)
+				os.Chtimes(target, header.ModTime, header.ModTime)
+			}
 
 		case tar.TypeSymlink:
 			//if linkname is absolute path should be linked to the same layer
-			if strings.HasPrefix(header.Linkname, "/") {
-				os.Symlink(fmt.Sprintf("%s%s", strings.TrimSuffix(folder, "/"), header.Linkname), target)
-			} else {
-				os.Symlink(header.Linkname, target)
+			link, clamped := clampLink(folder, name, header.Linkname)
+			//link passing through symlinks extracted before may still climb above layer root
+			if !clamped {
+				dest := link
+				if !filepath.IsAbs(dest) {
+					//joined without cleaning, '..' after symlink is resolved against the symlink target
+					dest = filepath.Dir(target) + "/" + link
+				}
+				if !insideRoot(root, folder, dest) {
+					link = resolveInside(folder, root, filepath.Dir(name)+"/"+header.Linkname)
+					clamped = true
+				}
+			}
+			if clamped {
+				skipped = append(skipped, fmt.Sprintf("%s: symlink to %s is clamped to %s", header.Name, header.Linkname, link))
 			}
+			os.Symlink(link, target)
 
 			//we should avoid of creating hard link
 		case tar.TypeLink:
-			if strings.HasPrefix(header.Linkname, "/") {
-				os.Symlink(fmt.Sprintf("%s%s", strings.TrimSuffix(folder, "/"), header.Linkname), target)
-			} else {
-				os.Symlink(header.Linkname, target)
+			link, ok := cleanEntryName(header.Linkname)
+			if !ok {
+				skipped = append(skipped, fmt.Sprintf("%s: hardlink to %s is outside of layer root", header.Name, header.Linkname))
+				continue
+			}
+			link_target := filepath.Join(folder, link)
+			//hardlinks are only recreated inside the same layer, symlink is used if it is impossible
+			if preserve && insideRoot(root, folder, filepath.Dir(link_target)) {
+				if err := os.Link(link_target, target); err == nil {
+					continue
+				}
+				skipped = append(skipped, fmt.Sprintf("%s: hardlink to %s is replaced by symlink", header.Name, header.Linkname))
+			}
+			if !insideRoot(root, folder, link_target) {
+				link_target = resolveInside(folder, root, link)
+			}
+			os.Symlink(link_target, target)
+
+		case tar.TypeChar, tar.TypeBlock:
+			if !preserve {
+				skipped = append(skipped, fmt.Sprintf("%s: device node is not supported", header.Name))
+				continue
+			}
+			//device nodes are created as empty files and served as devices by fakeroot
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+			if err != nil {
+				cerr := ErrNew(err, fmt.Sprintf("untar create device placeholder %s error", target))
+				return skipped, cerr
+			}
+			f.Close()
+			fake_mode = syscall.S_IFCHR
+			if header.Typeflag == tar.TypeBlock {
+				fake_mode = syscall.S_IFBLK
 			}
+			fake_mode |= uint32(header.Mode) & 07777
+			rdev = mkdev(header.Devmajor, header.Devminor)
+
+		case tar.TypeFifo:
+			if !preserve {
+				skipped = append(skipped, fmt.Sprintf("%s: fifo is not supported", header.Name))
+				continue
+			}
+			if err := syscall.Mkfifo(target, uint32(header.Mode)&07777); err != nil {
+				skipped = append(skipped, fmt.Sprintf("%s: fifo could not be created: %s", header.Name, err.Error()))
+				continue
+			}
+
+		default:
+			skipped = append(skipped, fmt.Sprintf("%s: entry type %q is not supported", header.Name, header.Typeflag))
+			continue
+		}
+
+		if preserve && (header.Uid != 0 || header.Gid != 0 || fake_mode != 0) {
+			record, err := fakerootRecord(target, fake_mode, header.Uid, header.Gid, rdev)
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("%s: ownership could not be recorded: %s", header.Name, err.Error()))
+				continue
+			}
+			records[target] = record
+		}
+	}
+
+	//children are written, the deepest folders are restored firstly
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		header := dir_headers[dirs[idx]]
+		os.Chmod(dirs[idx], header.FileInfo().Mode().Perm()|0700)
+		skipped = append(skipped, restoreXattrs(dirs[idx], header)...)
+		os.Chtimes(dirs[idx], header.ModTime, header.ModTime)
+	}
+	if len(records) > 0 {
+		f, err := os.OpenFile(db, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not open fakeroot database %s", db))
+			return skipped, cerr
+		}
+		defer f.Close()
+		var paths []string
+		for path := range records {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		var lines []string
+		for _, path := range paths {
+			lines = append(lines, records[path])
+		}
+		if _, err := f.WriteString(strings.Join(lines, "")); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not write fakeroot database %s", db))
+			return skipped, cerr
+		}
+	}
+	return skipped, nil
+}
+
+//fakerootRecord returns the line of target inside the database loaded by 'faked --load', mode of file on disk is used if mode is 0
+func fakerootRecord(target string, mode uint32, uid int, gid int, rdev uint64) (string, error) {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("stat of %s is not available", target)
+	}
+	if mode == 0 {
+		mode = uint32(st.Mode)
+	}
+	return fmt.Sprintf("dev=%x,ino=%d,mode=%o,uid=%d,gid=%d,nlink=%d,rdev=%d\n", uint64(st.Dev), uint64(st.Ino), mode, uid, gid, uint64(st.Nlink), rdev), nil
+}
+
+//mkdev encodes device number in the same way as glibc makedev
+func mkdev(major int64, minor int64) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return (mi & 0xff) | ((ma & 0xfff) << 8) | ((mi &^ 0xff) << 12) | ((ma &^ 0xfff) << 32)
+}
+
+//restoreXattrs sets extended attributes recorded inside PAX headers, the ones which can't be set are returned
+func restoreXattrs(target string, header *tar.Header) []string {
+	var failed []string
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, PAX_XATTR) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, PAX_XATTR)
+		if err := syscall.Setxattr(target, attr, []byte(value), 0); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: xattr %s could not be restored: %s", header.Name, attr, err.Error()))
 		}
 	}
+	return failed
+}
+
+//cleanEntryName returns the path of tar entry relative to layer root, false is returned if it points outside
+func cleanEntryName(name string) (string, bool) {
+	name = filepath.Clean(strings.TrimLeft(name, "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+//insideRoot checks whether dir resolves inside root after following symlinks, root is the resolved path of folder
+func insideRoot(root string, folder string, dir string) bool {
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			real, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				return false
+			}
+			return real == root || strings.HasPrefix(real, root+"/")
+		}
+		//dir does not exist yet, its nearest existing parent decides where it will be created
+		if dir == folder || dir == filepath.Dir(dir) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+//clampLink returns the symlink target created for entry name inside folder
+//absolute links are rebased onto folder and links climbing above layer root are clamped as if '..' of root is root itself
+func clampLink(folder string, name string, linkname string) (string, bool) {
+	if filepath.IsAbs(linkname) {
+		return filepath.Join(folder, filepath.Clean(linkname)), linkEscapes(linkname)
+	}
+	joined := filepath.Dir(name) + "/" + linkname
+	if linkEscapes(joined) {
+		return filepath.Join(folder, filepath.Clean("/"+joined)), true
+	}
+	return linkname, false
+}
+
+//resolveInside resolves path inside folder as if folder is '/', symlinks extracted before are followed and '..' never climbs above folder
+//root is the resolved path of folder, absolute symlinks pointing into folder or root are followed inside folder as well
+func resolveInside(folder string, root string, path string) string {
+	resolved := ""
+	parts := strings.Split(path, "/")
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = strings.TrimPrefix(filepath.Dir("/"+resolved), "/")
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		if fi, err := os.Lstat(filepath.Join(folder, next)); err == nil && fi.Mode()&os.ModeSymlink != 0 && hops < 255 {
+			hops++
+			link, _ := os.Readlink(filepath.Join(folder, next))
+			if filepath.IsAbs(link) {
+				for _, prefix := range []string{folder, root} {
+					if link == prefix || strings.HasPrefix(link, prefix+"/") {
+						link = strings.TrimPrefix(link, prefix)
+						break
+					}
+				}
+				resolved = ""
+			}
+			parts = append(strings.Split(link, "/"), parts...)
+			continue
+		}
+		resolved = next
+	}
+	return filepath.Join(folder, resolved)
+}
+
+//linkEscapes checks whether path climbs above its root by '..' components
+func linkEscapes(path string) bool {
+	depth := 0
+	for _, part := range strings.Split(path, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+//markExtracted records target and its parent folders inside folder as extracted
+func markExtracted(extracted map[string]bool, folder string, target string) {
+	folder = filepath.Clean(folder)
+	for path := target; strings.HasPrefix(path, folder) && path != folder; path = filepath.Dir(path) {
+		extracted[path] = true
+	}
+}
+
+//removeUnextracted removes the content of dir which is not extracted from current tarball, together with its fakeroot records
+func removeUnextracted(dir string, extracted map[string]bool, records map[string]string) *Error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		cerr := ErrNew(err, fmt.Sprintf("could not read dir %s", dir))
+		return cerr
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if extracted[path] {
+			if file.IsDir() {
+				if cerr := removeUnextracted(path, extracted, records); cerr != nil {
+					return cerr
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not remove %s", path))
+			return cerr
+		}
+		dropRecords(records, path)
+	}
+	return nil
+}
+
+//dropRecords removes fakeroot records of path and the paths inside it
+func dropRecords(records map[string]string, path string) {
+	for target := range records {
+		if target == path || strings.HasPrefix(target, path+"/") {
+			delete(records, target)
+		}
+	}
+}
+
+//DetectCompression checks the magic bytes of file, files without known magic bytes are treated as uncompressed
+func DetectCompression(file string) (string, *Error) {
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open file %s", file))
+		return "", cerr
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		cerr := ErrNew(err, fmt.Sprintf("could not read file %s", file))
+		return "", cerr
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return COMPRESSION_GZIP, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return COMPRESSION_ZSTD, nil
+	}
+	return COMPRESSION_NONE, nil
+}
+
+type decompressReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	var err error
+	for idx := len(r.closers) - 1; idx >= 0; idx-- {
+		if cerr := r.closers[idx].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+//MediaTypeCompression returns the compression declared by layer media type of docker or OCI, including foreign and nondistributable layers
+//empty string is returned if media type is empty or unknown
+func MediaTypeCompression(media_type string) string {
+	switch {
+	case strings.HasSuffix(media_type, "+zstd"):
+		return COMPRESSION_ZSTD
+	case strings.HasSuffix(media_type, "+gzip"), strings.HasSuffix(media_type, ".tar.gzip"):
+		return COMPRESSION_GZIP
+	case strings.HasSuffix(media_type, ".tar"):
+		return COMPRESSION_NONE
+	}
+	return ""
+}
+
+//DecompressReader opens file and returns the reader of decompressed content, compression is detected by magic bytes
+func DecompressReader(file string) (io.ReadCloser, *Error) {
+	return DecompressLayerReader(file, "")
+}
+
+//DecompressLayerReader is DecompressReader of layer with media type, compression declared by media type is preferred over magic bytes
+func DecompressLayerReader(file string, media_type string) (io.ReadCloser, *Error) {
+	comp := MediaTypeCompression(media_type)
+	if comp == "" {
+		var cerr *Error
+		comp, cerr = DetectCompression(file)
+		if cerr != nil {
+			return nil, cerr
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(ErrFileIO, fmt.Sprintf("open file %s failure", file))
+		return nil, cerr
+	}
+	switch comp {
+	case COMPRESSION_GZIP:
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			cerr := ErrNew(err, fmt.Sprintf("gzip open file %s failure", file))
+			return nil, cerr
+		}
+		return &decompressReader{Reader: gzr, closers: []io.Closer{f, gzr}}, nil
+	case COMPRESSION_ZSTD:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			cerr := ErrNew(err, fmt.Sprintf("zstd open file %s failure", file))
+			return nil, cerr
+		}
+		return &decompressReader{Reader: zr, closers: []io.Closer{f, zr.IOReadCloser()}}, nil
+	case COMPRESSION_NONE:
+		return f, nil
+	}
+	f.Close()
+	cerr := ErrNew(ErrType, fmt.Sprintf("compression %s of file %s is not supported", comp, file))
+	return nil, cerr
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+//CompressWriter wraps w with the writer of compression, closing the returned writer does not close w
+func CompressWriter(w io.Writer, compression string) (io.WriteCloser, *Error) {
+	switch compression {
+	//gzip header is left empty and zstd blocks are encoded sequentially, so that the same content is always compressed into the same bytes
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_ZSTD:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			cerr := ErrNew(err, "could not create zstd writer")
+			return nil, cerr
+		}
+		return zw, nil
+	case COMPRESSION_NONE:
+		return nopWriteCloser{w}, nil
+	}
+	cerr := ErrNew(ErrType, fmt.Sprintf("compression %s is not supported", compression))
+	return nil, cerr
+}
+
+//TarSuffix returns the file suffix of tarball compressed by compression
+func TarSuffix(compression string) string {
+	switch compression {
+	case COMPRESSION_ZSTD:
+		return ".tar.zst"
+	case COMPRESSION_NONE:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+//GzipFile compresses src file into dst file
+func GzipFile(src string, dst string) *Error {
+	in, err := os.Open(src)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open file %s", src))
+		return cerr
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not create file %s", dst))
+		return cerr
+	}
+	defer out.Close()
+	gzw := gzip.NewWriter(out)
+	if _, err := io.Copy(gzw, in); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not compress file %s", src))
+		return cerr
+	}
+	if err := gzw.Close(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not compress file %s", src))
+		return cerr
+	}
+	return nil
 }
 
 func ReverseStrArray(input []string) []string {
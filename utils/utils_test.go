@@ -1,13 +1,21 @@
 package utils
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestTar(t *testing.T) {
 	layers := []string{"/tmp"}
-	err := TarLayer("/tmp/test", "/tmp", "file", layers)
+	err := TarLayer("/tmp/test", "/tmp", "file", layers, TarOptions{Compression: COMPRESSION_GZIP})
 	if err != nil {
 		t.Error(err)
 	}
@@ -49,3 +57,684 @@ func TestUtils2(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDetectCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "layer.tar")
+	if err := ioutil.WriteFile(plain, []byte("plain tar content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	compressed := filepath.Join(dir, "layer.tar.gz")
+	if cerr := GzipFile(plain, compressed); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if comp, cerr := DetectCompression(plain); cerr != nil || comp != COMPRESSION_NONE {
+		t.Errorf("plain file should not be compressed, got %s, %v", comp, cerr)
+	}
+	if comp, cerr := DetectCompression(compressed); cerr != nil || comp != COMPRESSION_GZIP {
+		t.Errorf("gzip file is not detected, got %s, %v", comp, cerr)
+	}
+}
+
+func TestMediaTypeCompression(t *testing.T) {
+	cases := map[string]string{
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":            COMPRESSION_GZIP,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    COMPRESSION_GZIP,
+		"application/vnd.oci.image.layer.v1.tar":                       COMPRESSION_NONE,
+		"application/vnd.oci.image.layer.v1.tar+gzip":                  COMPRESSION_GZIP,
+		"application/vnd.oci.image.layer.v1.tar+zstd":                  COMPRESSION_ZSTD,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar":      COMPRESSION_NONE,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": COMPRESSION_GZIP,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": COMPRESSION_ZSTD,
+		"application/vnd.oci.image.config.v1+json":                     "",
+		"": "",
+	}
+	for media_type, want := range cases {
+		if comp := MediaTypeCompression(media_type); comp != want {
+			t.Errorf("compression of %q should be %q, got %q", media_type, want, comp)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "src/etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "src/etc/hostname"), []byte("lpmx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cerr := TarLayer(filepath.Join(dir, "src"), dir, "layer", nil, TarOptions{Compression: COMPRESSION_NONE}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	tarball := filepath.Join(dir, "layer"+TarSuffix(COMPRESSION_NONE))
+	//media type takes precedence over magic bytes, magic bytes are only checked if media type is not given
+	if _, cerr := untar(tarball, filepath.Join(dir, "gzip"), "application/vnd.oci.image.layer.v1.tar+gzip", true); cerr == nil {
+		t.Error("plain tarball declared as gzip should not be extracted")
+	}
+	for _, media_type := range []string{"application/vnd.oci.image.layer.v1.tar", ""} {
+		folder := filepath.Join(dir, "plain"+media_type)
+		if _, cerr := untar(tarball, folder, media_type, true); cerr != nil {
+			t.Fatalf("untar plain tarball with media type %q failure: %v", media_type, cerr)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(folder, "etc/hostname")); err != nil || string(data) != "lpmx" {
+			t.Errorf("content of plain tarball with media type %q is not extracted, got %q, %v", media_type, data, err)
+		}
+	}
+}
+
+func TestUntarCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("lpmx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, comp := range []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		if cerr := TarLayer(src, dir, comp, nil, TarOptions{Compression: comp}); cerr != nil {
+			t.Fatal(cerr)
+		}
+		tarball := filepath.Join(dir, comp+TarSuffix(comp))
+		if detected, cerr := DetectCompression(tarball); cerr != nil || detected != comp {
+			t.Errorf("%s tarball is detected as %s, %v", comp, detected, cerr)
+		}
+		target := filepath.Join(dir, "untar_"+comp)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if cerr := Untar(tarball, target); cerr != nil {
+			t.Fatalf("untar %s tarball failure: %v", comp, cerr)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(target, "etc", "hostname"))
+		if err != nil || string(data) != "lpmx" {
+			t.Errorf("content of %s tarball is not extracted, got %q, %v", comp, data, err)
+		}
+	}
+}
+
+func TestWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"lower/etc/removed", "lower/etc/kept", "lower/opq/old", "lower/usr/lib/libc.so", "rw/usr/lib/libz.so", "rw/opq/new"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, marker := range []string{"rw/etc/.wh.removed", "rw/etc/.wh.nothing", "rw/opq/.wh..wh..opq"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, marker)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, marker), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layers := []string{"rw", "lower"}
+
+	if _, cerr := GuessPathContainer(dir, layers, "etc/removed", true); cerr == nil {
+		t.Error("file hidden by whiteout should not be found")
+	}
+	if path, cerr := GuessPathContainer(dir, layers, "etc/kept", true); cerr != nil || path != filepath.Join(dir, "lower/etc/kept") {
+		t.Errorf("file of lower layer is not found, got %s, %v", path, cerr)
+	}
+	if _, cerr := GuessPathContainer(dir, layers, "opq/old", true); cerr == nil {
+		t.Error("file hidden by opaque folder should not be found")
+	}
+	if paths, cerr := GuessPathsContainer(dir, layers, "opq", false); cerr != nil || len(paths) != 1 {
+		t.Errorf("opaque folder should only be found inside upper layer, got %v, %v", paths, cerr)
+	}
+	if paths, cerr := GuessPathsContainer(dir, layers, "usr/lib", false); cerr != nil || len(paths) != 2 {
+		t.Errorf("folder should be found inside both layers, got %v, %v", paths, cerr)
+	}
+
+	//only whiteouts hiding files of lower layers are written into tarball
+	if cerr := TarLayer(filepath.Join(dir, "rw"), dir, "rw", []string{filepath.Join(dir, "rw"), filepath.Join(dir, "lower")}, TarOptions{Compression: COMPRESSION_NONE}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	f, err := os.Open(filepath.Join(dir, "rw.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := make(map[string]int64)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		entries[header.Name] = header.Size
+	}
+	if size, ok := entries["/etc/.wh.removed"]; !ok || size != 0 {
+		t.Errorf("whiteout of removed file is not written, entries: %v", entries)
+	}
+	if _, ok := entries["/opq/.wh..wh..opq"]; !ok {
+		t.Errorf("opaque marker is not written, entries: %v", entries)
+	}
+	if _, ok := entries["/etc/.wh.nothing"]; ok {
+		t.Error("whiteout hiding nothing should be dropped")
+	}
+
+	//extracting upper layer onto lower layer applies whiteouts
+	if cerr := Untar(filepath.Join(dir, "rw.tar"), filepath.Join(dir, "lower")); cerr != nil {
+		t.Fatal(cerr)
+	}
+	for _, file := range []string{"lower/etc/removed", "lower/opq/old"} {
+		if _, err := os.Lstat(filepath.Join(dir, file)); err == nil {
+			t.Errorf("%s should be removed by whiteout", file)
+		}
+	}
+	for _, file := range []string{"lower/etc/kept", "lower/opq/new", "lower/usr/lib/libc.so", "lower/usr/lib/libz.so", "lower/etc/.wh.removed"} {
+		if _, err := os.Lstat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("%s should exist after extracting: %v", file, err)
+		}
+	}
+}
+
+func TestUntarUnsafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	folder := filepath.Join(dir, "layer")
+	for _, d := range []string{outside, folder} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//symlinks left by former extraction
+	if err := os.Symlink(outside, filepath.Join(folder, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(folder, "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	tarball := filepath.Join(dir, "layer.tar")
+	f, err := os.Create(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	entries := []*tar.Header{
+		{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "/abs/ok", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		{Name: "up/viaup", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "out/pwned", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "secret", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../../outside/secret"},
+		//lexically harmless link climbing through the root link extracted before
+		{Name: "rootlink", Typeflag: tar.TypeSymlink, Linkname: "/"},
+		{Name: "viaroot", Typeflag: tar.TypeSymlink, Linkname: "rootlink/.."},
+		//whiteouts hiding the parent of layer root, layer root itself or nothing
+		{Name: ".wh...", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "sub/.wh...", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "sub/.wh.", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	for _, header := range entries {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte("x"))
+		}
+	}
+	tw.Close()
+	f.Close()
+
+	skipped, cerr := untar(tarball, folder, "", false)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(skipped) != 8 {
+		t.Errorf("escape, clamped symlinks, symlinked parent, hardlink and whiteouts should be reported, got %v", skipped)
+	}
+	for _, file := range []string{folder, filepath.Join(outside, "secret")} {
+		if _, err := os.Lstat(file); err != nil {
+			t.Errorf("%s should not be removed by whiteout: %v", file, err)
+		}
+	}
+	for _, file := range []string{filepath.Join(dir, "escape"), filepath.Join(outside, "pwned")} {
+		if _, err := os.Lstat(file); err == nil {
+			t.Errorf("%s should not be created outside of layer root", file)
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+		t.Errorf("file outside of layer root is overwritten through symlink: %q", data)
+	}
+	for _, file := range []string{"abs/ok", "viaup", "secret"} {
+		if _, err := os.Lstat(filepath.Join(folder, file)); err != nil {
+			t.Errorf("%s should be extracted inside layer root: %v", file, err)
+		}
+	}
+	if link, _ := os.Readlink(filepath.Join(folder, "up")); link != folder {
+		t.Errorf("symlink climbing above layer root should be clamped to %s, got %s", folder, link)
+	}
+	root, _ := filepath.EvalSymlinks(folder)
+	if real, err := filepath.EvalSymlinks(filepath.Join(folder, "viaroot")); err != nil || real != root {
+		t.Errorf("symlink climbing through extracted symlink should be clamped to %s, got %s, %v", root, real, err)
+	}
+}
+
+func TestUntarLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir_time := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	file_time := time.Date(2018, 6, 7, 8, 9, 10, 0, time.UTC)
+	tarball := filepath.Join(dir, "layer.tar")
+	f, err := os.Create(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	entries := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: dir_time},
+		{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 04755, Size: 4, ModTime: file_time, Uid: 1000, Gid: 1000},
+		{Name: "bin/alias", Typeflag: tar.TypeLink, Linkname: "bin/tool", ModTime: file_time},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "unknown", Typeflag: 'Z'},
+	}
+	for _, header := range entries {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte("tool"))
+		}
+	}
+	tw.Close()
+	f.Close()
+
+	folder := filepath.Join(dir, "layer")
+	skipped, cerr := untar(tarball, folder, "", true)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(skipped) != 1 || !strings.HasPrefix(skipped[0], "unknown") {
+		t.Errorf("only unsupported entry should be reported, got %v", skipped)
+	}
+
+	tool, err := os.Stat(filepath.Join(folder, "bin/tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tool.ModTime().Equal(file_time) || tool.Mode()&os.ModeSetuid == 0 || tool.Mode().Perm() != 0755 {
+		t.Errorf("metadata of file is not restored, mtime: %s, mode: %s", tool.ModTime(), tool.Mode())
+	}
+	if alias, err := os.Lstat(filepath.Join(folder, "bin/alias")); err != nil || !os.SameFile(tool, alias) {
+		t.Errorf("hardlink is not recreated: %v", err)
+	}
+	bin, err := os.Stat(filepath.Join(folder, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bin.ModTime().Equal(dir_time) || bin.Mode().Perm() != 0755 {
+		t.Errorf("metadata of folder is not restored, mtime: %s, mode: %s", bin.ModTime(), bin.Mode())
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(folder, FAKEROOT_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := string(data)
+	for _, record := range []string{"mode=40555,uid=0,gid=0", "mode=104755,uid=1000,gid=1000", "mode=20666,uid=0,gid=0,nlink=1,rdev=259"} {
+		if !strings.Contains(db, record) {
+			t.Errorf("fakeroot database does not contain %s:\n%s", record, db)
+		}
+	}
+
+	//extracting layer again, e.g, retry after interruption, should not duplicate records
+	if _, cerr := untar(tarball, folder, "", true); cerr != nil {
+		t.Fatal(cerr)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(folder, FAKEROOT_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(string(data), "mode=104755,uid=1000,gid=1000"); count != 1 {
+		t.Errorf("fakeroot database should be rewritten by new extraction, record is found %d times:\n%s", count, data)
+	}
+}
+
+func TestUntarLayerStaleRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tarball := filepath.Join(dir, "layer.tar")
+	f, err := os.Create(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	entries := []*tar.Header{
+		//device replaced by regular file owned by root
+		{Name: "dev/tty", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 5, Devminor: 0},
+		{Name: "dev/tty", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		//file removed by whiteout
+		{Name: "home/user", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, Uid: 1000, Gid: 1000},
+		{Name: "home/.wh.user", Typeflag: tar.TypeReg, Mode: 0644},
+		//folder whose owner is changed by later entry
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 1000},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "keep", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, Uid: 1000, Gid: 1000},
+	}
+	for _, header := range entries {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte("data"))
+		}
+	}
+	tw.Close()
+	f.Close()
+
+	folder := filepath.Join(dir, "layer")
+	if _, cerr := untar(tarball, folder, "", true); cerr != nil {
+		t.Fatal(cerr)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(folder, FAKEROOT_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep, err := os.Lstat(filepath.Join(folder, "keep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino := fmt.Sprintf(",ino=%d,", keep.Sys().(*syscall.Stat_t).Ino)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], ino) {
+		t.Errorf("records of paths removed or replaced should be dropped, only the one of keep is expected:\n%s", data)
+	}
+}
+
+func TestTarLayerDeterministic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "rw")
+	if err := os.MkdirAll(filepath.Join(src, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "usr/bin/tool"), []byte("tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(src, "usr/bin/alias")
+	if err := os.Symlink(filepath.Join(src, "usr/bin/tool"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1546300800")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+	var shas []string
+	for idx, name := range []string{"first", "second"} {
+		mtime := time.Now().Add(time.Duration(idx) * time.Hour)
+		os.Chtimes(filepath.Join(src, "usr/bin/tool"), mtime, mtime)
+		if cerr := TarLayer(src, dir, name, []string{src}, TarOptions{Compression: COMPRESSION_GZIP, Deterministic: true}); cerr != nil {
+			t.Fatal(cerr)
+		}
+		sha, cerr := Sha256file(filepath.Join(dir, name+".tar.gz"))
+		if cerr != nil {
+			t.Fatal(cerr)
+		}
+		shas = append(shas, sha)
+	}
+	if shas[0] != shas[1] {
+		t.Errorf("identical content should produce identical tarball, got %v", shas)
+	}
+	//source tree is not touched while rewriting symlink
+	if target, err := os.Readlink(link); err != nil || target != filepath.Join(src, "usr/bin/tool") {
+		t.Errorf("symlink inside source folder is modified: %s, %v", target, err)
+	}
+
+	r, cerr := DecompressReader(filepath.Join(dir, "first.tar.gz"))
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if header.ModTime.Unix() != 1546300800 || header.Uid != 0 || header.Uname != "" {
+			t.Errorf("header of %s is not normalized: %v, %d, %s", header.Name, header.ModTime, header.Uid, header.Uname)
+		}
+		if header.Name == "/usr/bin/alias" && header.Linkname != "/usr/bin/tool" {
+			t.Errorf("symlink should point to path inside container, got %s", header.Linkname)
+		}
+	}
+}
+
+func TestMatchExclude(t *testing.T) {
+	patterns := []string{"/var/cache/*", "*.pyc", "/tmp/", "usr/share/doc"}
+	cases := map[string]bool{
+		"/var/cache/apt":          true,
+		"/var/cache/apt/archives": true,
+		"/var/cache":              false,
+		"/usr/lib/a.pyc":          true,
+		"/tmp":                    true,
+		"/tmp/file":               true,
+		"/usr/share/doc/readme":   true,
+		"/usr/share/docs":         false,
+		"/etc/passwd":             false,
+	}
+	for path, want := range cases {
+		if got := MatchExclude(patterns, path); got != want {
+			t.Errorf("MatchExclude(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMergeLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeLayer := func(name string, entries []*tar.Header) string {
+		tarball := filepath.Join(dir, name)
+		f, err := os.Create(tarball)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(f)
+		for _, header := range entries {
+			if header.Typeflag == tar.TypeReg {
+				header.Size = int64(len(name))
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			if header.Size > 0 {
+				tw.Write([]byte(name))
+			}
+		}
+		tw.Close()
+		f.Close()
+		return tarball
+	}
+	base := writeLayer("base", []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/removed", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/replaced", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "opq/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "opq/old", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "lib/libc.so", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000},
+	})
+	upper := writeLayer("upper", []*tar.Header{
+		{Name: "etc/.wh.removed", Typeflag: tar.TypeReg},
+		{Name: "etc/replaced", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "opq/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "opq/new", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	})
+
+	target := filepath.Join(dir, "merged.tar")
+	if cerr := MergeLayers([]string{base, upper}, target, COMPRESSION_NONE); cerr != nil {
+		t.Fatal(cerr)
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		entries[header.Name] = header
+	}
+	for _, name := range []string{"etc/removed", "opq/old", "etc/.wh.removed", "opq/.wh..wh..opq"} {
+		if _, ok := entries[name]; ok {
+			t.Errorf("%s should not be inside merged layer", name)
+		}
+	}
+	if header, ok := entries["etc/replaced"]; !ok || header.Mode != 0600 {
+		t.Errorf("etc/replaced should be taken from upper layer, got %v", header)
+	}
+	if header, ok := entries["lib/libc.so"]; !ok || header.Uid != 1000 {
+		t.Errorf("owner of lib/libc.so should be kept, got %v", header)
+	}
+	for _, name := range []string{"etc/", "opq/", "opq/new", "dev/null"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("%s should be inside merged layer", name)
+		}
+	}
+}
+
+func TestLayerView(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"lower/usr/lib/libc.so", "lower/usr/lib/libm.so", "lower/etc/hosts", "lower/opt/old", "rw/usr/lib/libz.so", "rw/usr/lib/.wh.libm.so", "rw/opt/.wh..wh..opq", "rw/opt/new", "rw/etc"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("/usr/lib", filepath.Join(dir, "lower/lib"))
+	layers := []string{"rw", "lower"}
+
+	if path, _, cerr := LayerLstat(dir, layers, "/usr/lib/libc.so"); cerr != nil || path != filepath.Join(dir, "lower/usr/lib/libc.so") {
+		t.Errorf("file of lower layer is not found, got %s, %v", path, cerr)
+	}
+	for _, hidden := range []string{"usr/lib/libm.so", "opt/old", "etc/hosts"} {
+		if _, _, cerr := LayerLstat(dir, layers, hidden); cerr == nil {
+			t.Errorf("%s should be hidden by upper layer", hidden)
+		}
+	}
+
+	entries, cerr := LayerReadDir(dir, layers, "usr/lib")
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if len(entries) != 2 || entries["libz.so"] != filepath.Join(dir, "rw/usr/lib/libz.so") || entries["libc.so"] == "" {
+		t.Errorf("merged folder should contain libc.so and libz.so, got %v", entries)
+	}
+	if entries, cerr := LayerReadDir(dir, layers, "opt"); cerr != nil || len(entries) != 1 {
+		t.Errorf("opaque folder should only contain new, got %v, %v", entries, cerr)
+	}
+
+	if rel, cerr := LayerResolve(dir, layers, "/lib/libz.so"); cerr != nil || rel != "usr/lib/libz.so" {
+		t.Errorf("symlink of parent folder should be resolved, got %s, %v", rel, cerr)
+	}
+
+	//symlinks among parents inside lower layer are not followed to the host
+	host := filepath.Join(dir, "host")
+	os.MkdirAll(host, 0755)
+	ioutil.WriteFile(filepath.Join(host, "passwd"), []byte("host"), 0644)
+	os.MkdirAll(filepath.Join(dir, "rw/a"), 0755)
+	os.Symlink(host, filepath.Join(dir, "lower/a"))
+	os.Symlink(host, filepath.Join(dir, "lower/b"))
+	for _, rel := range []string{"a/passwd", "b/passwd"} {
+		if path, _, cerr := LayerLstat(dir, layers, rel); cerr == nil {
+			t.Errorf("%s should not be found through symlinked parent, got %s", rel, path)
+		}
+	}
+	if entries, cerr := LayerReadDir(dir, layers, "a"); cerr != nil || len(entries) != 0 {
+		t.Errorf("folder of upper layer should hide symlink of lower layer, got %v, %v", entries, cerr)
+	}
+}
+
+func TestWriteFormat(t *testing.T) {
+	type record struct {
+		Name string `json:"name" yaml:"name"`
+		Size int64  `json:"size" yaml:"size"`
+	}
+	records := []record{{Name: "a-container-name-longer-than-fifteen", Size: 1}, {Name: "b", Size: 20}}
+	table := Table{Header: []string{"Name", "Size"}}
+	for _, r := range records {
+		table.Rows = append(table.Rows, []string{r.Name, fmt.Sprintf("%d", r.Size)})
+	}
+
+	expected := map[string]string{
+		"table":                           "Name                                  Size\na-container-name-longer-than-fifteen  1\nb                                     20\n",
+		"json":                            "[\n  {\n    \"name\": \"a-container-name-longer-than-fifteen\",\n    \"size\": 1\n  },\n  {\n    \"name\": \"b\",\n    \"size\": 20\n  }\n]\n",
+		"yaml":                            "- name: a-container-name-longer-than-fifteen\n  size: 1\n- name: b\n  size: 20\n",
+		"go-template={{.Name}}:{{.Size}}": "a-container-name-longer-than-fifteen:1\nb:20\n",
+	}
+	for format, output := range expected {
+		var buf bytes.Buffer
+		if cerr := WriteFormat(&buf, format, records, table); cerr != nil {
+			t.Fatal(cerr)
+		}
+		if buf.String() != output {
+			t.Errorf("format %s got unexpected output:\n%s", format, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if cerr := WriteFormat(&buf, "xml", records, table); cerr == nil {
+		t.Error("unsupported format should fail")
+	}
+}